@@ -0,0 +1,20 @@
+package endpoint
+
+import (
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func FetchFlaggedImages(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	result, err := service.FetchFlaggedImages(c.Request.Context(), c.Query("cursor"), limit)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
@@ -1,6 +1,7 @@
 package endpoint
 
 import (
+	"bufio"
 	"errors"
 	"idraw-server/api/request"
 	"idraw-server/api/response"
@@ -12,9 +13,12 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// sniffLen http.DetectContentType 最多读取的字节数
+const sniffLen = 512
+
 func GetDailyLimits(c *gin.Context) {
 	openId := c.Query("openId")
-	response.Success(c, service.GetDailyLimits(openId))
+	response.Success(c, service.GetDailyLimits(c.Request.Context(), openId))
 }
 
 func IncreaseDailyLimits(c *gin.Context) {
@@ -25,13 +29,16 @@ func IncreaseDailyLimits(c *gin.Context) {
 		return
 	}
 	num, _ := strconv.Atoi(number)
-	service.IncreaseDailyLimits(openId, num)
+	if err := service.IncreaseDailyLimits(c.Request.Context(), openId, num); err != nil {
+		response.Fail(c, http.StatusInternalServerError, err)
+		return
+	}
 	response.Success(c, nil)
 }
 
 func GetCurrentUsages(c *gin.Context) {
 	if openId := c.Query("openId"); openId != "" {
-		data := service.GetCurrentUsages(openId)
+		data := service.GetCurrentUsages(c.Request.Context(), openId)
 		response.Success(c, data)
 	} else {
 		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
@@ -45,7 +52,7 @@ func FetchRecordsCount(c *gin.Context) {
 		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
 		return
 	}
-	count, err := service.FetchRecordsCount(openId)
+	count, err := service.FetchRecordsCount(c.Request.Context(), openId)
 	if err != nil {
 		response.Fail(c, http.StatusServiceUnavailable, err)
 		return
@@ -60,7 +67,7 @@ func FetchRecords(c *gin.Context) {
 		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
 		return
 	}
-	records, err := service.FetchRecords(openId, calledType)
+	records, err := service.FetchRecords(c.Request.Context(), openId, calledType)
 	if err != nil {
 		response.Fail(c, http.StatusServiceUnavailable, err)
 		return
@@ -70,14 +77,17 @@ func FetchRecords(c *gin.Context) {
 
 func ServeFile(c *gin.Context) {
 	if fileName := c.Query("fileName"); fileName != "" {
-		file, err := service.ServeFile(fileName)
+		file, err := service.ServeImage(c.Request.Context(), fileName, c.Query("sig"))
 		if err != nil {
 			response.Fail(c, http.StatusServiceUnavailable, err)
 			return
 		}
 		defer file.Close()
-		c.Writer.Header().Add("Content-Type", "image/png")
-		_, err = io.Copy(c.Writer, file)
+		// uploads may be jpeg or webp, sniff the type instead of assuming png
+		reader := bufio.NewReaderSize(file, sniffLen)
+		head, _ := reader.Peek(sniffLen)
+		c.Writer.Header().Add("Content-Type", http.DetectContentType(head))
+		_, err = io.Copy(c.Writer, reader)
 		if err != nil {
 			response.Fail(c, http.StatusServiceUnavailable, err)
 			return
@@ -95,7 +105,7 @@ func UploadFile(c *gin.Context) {
 		response.Fail(c, http.StatusBadRequest, err)
 		return
 	}
-	result, err := service.UploadFile(req)
+	result, err := service.UploadFile(c.Request.Context(), req)
 	if err != nil {
 		response.Fail(c, http.StatusServiceUnavailable, err)
 		return
@@ -109,7 +119,7 @@ func GenerateImagesByPrompt(c *gin.Context) {
 		response.Fail(c, http.StatusBadRequest, err)
 		return
 	}
-	result, err := service.GenerateImagesByPrompt(req)
+	result, err := service.GenerateImagesByPrompt(c.Request.Context(), req)
 	if err != nil {
 		response.Fail(c, http.StatusServiceUnavailable, err)
 		return
@@ -123,7 +133,43 @@ func GenerateImageVariationsByImage(c *gin.Context) {
 		response.Fail(c, http.StatusBadRequest, err)
 		return
 	}
-	result, err := service.GenerateImageVariationsByImage(req)
+	result, err := service.GenerateImageVariationsByImage(c.Request.Context(), req)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func CreatePoster(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	req := request.PosterReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.CreatePoster(c.Request.Context(), req.OpenId, uint(id), req.Index)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func FetchSimilarImages(c *gin.Context) {
+	openId := c.Query("openId")
+	fileName := c.Query("fileName")
+	if openId == "" || fileName == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	maxDistance, _ := strconv.Atoi(c.Query("maxDistance"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	result, err := service.FetchSimilarImages(c.Request.Context(), openId, fileName, maxDistance, limit)
 	if err != nil {
 		response.Fail(c, http.StatusServiceUnavailable, err)
 		return
@@ -0,0 +1,67 @@
+package endpoint
+
+import (
+	"errors"
+	"idraw-server/api/request"
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetCheckIn(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	result, err := service.GetCheckIn(c.Request.Context(), openId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func CheckIn(c *gin.Context) {
+	req := request.BonusReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.CheckIn(c.Request.Context(), req.OpenId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func IssueAdNonce(c *gin.Context) {
+	req := request.BonusReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.IssueAdNonce(c.Request.Context(), req.OpenId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func RewardAd(c *gin.Context) {
+	req := request.AdCompletionReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.RewardAd(c.Request.Context(), req.OpenId, req.Nonce)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
@@ -0,0 +1,167 @@
+package endpoint
+
+import (
+	"errors"
+	"html/template"
+	"idraw-server/api/request"
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sharePage 小程序外打开分享链接时展示的页面，带有 OpenGraph 标签供社交平台生成预览
+var sharePage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:type" content="article">
+<meta property="og:site_name" content="iDraw">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.PageUrl}}">
+{{if .ImageUrl}}<meta property="og:image" content="{{.ImageUrl}}">
+<meta name="twitter:card" content="summary_large_image">{{end}}
+<style>body{margin:0;font-family:sans-serif;text-align:center;background:#111;color:#eee}img{max-width:100%}p{padding:0 16px}</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .ImageUrl}}<img src="{{.ImageUrl}}" alt="{{.Description}}">{{end}}
+<p>{{.Description}}</p>
+<p>在微信中搜索小程序「iDraw」，也来画一幅吧</p>
+</body>
+</html>
+`))
+
+func Publish(c *gin.Context) {
+	req := request.PublicationReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.Publish(c.Request.Context(), req.OpenId, req.RecordId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func Unpublish(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	if err := service.Unpublish(c.Request.Context(), openId, c.Param("token")); err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, nil)
+}
+
+func FetchGallery(c *gin.Context) {
+	q := service.GalleryQuery{
+		OpenId: c.Query("openId"),
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			response.Fail(c, http.StatusBadRequest, err)
+			return
+		}
+		q.Limit = n
+	}
+	if window := c.Query("window"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			response.Fail(c, http.StatusBadRequest, err)
+			return
+		}
+		q.Window = d
+	}
+	result, err := service.FetchGallery(c.Request.Context(), q)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func FetchPublication(c *gin.Context) {
+	result, err := service.FetchPublication(c.Request.Context(), c.Param("token"), c.Query("openId"))
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func ServeGalleryImage(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	file, err := service.ServeGalleryImage(c.Request.Context(), c.Param("token"), index)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer file.Close()
+	c.Writer.Header().Add("Content-Type", "image/png")
+	c.Writer.Header().Add("Cache-Control", "public, max-age=86400")
+	if _, err = io.Copy(c.Writer, file); err != nil {
+		c.Error(err)
+	}
+}
+
+func Like(c *gin.Context) {
+	req := request.LikeReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.Like(c.Request.Context(), req.OpenId, c.Param("token"), true)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func Unlike(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	result, err := service.Like(c.Request.Context(), openId, c.Param("token"), false)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func SharePage(c *gin.Context) {
+	page, err := service.FetchSharePage(c.Request.Context(), c.Param("token"))
+	if err != nil {
+		c.Error(err)
+		c.String(http.StatusNotFound, "作品不存在或已取消发布")
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := sharePage.Execute(c.Writer, page); err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,21 @@
+package endpoint
+
+import (
+	"idraw-server/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, service.CheckLiveness())
+}
+
+func Readiness(c *gin.Context) {
+	result, ready := service.CheckReadiness(c.Request.Context())
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,109 @@
+package endpoint
+
+import (
+	"errors"
+	"idraw-server/api/request"
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetCreditPacks(c *gin.Context) {
+	response.Success(c, service.CreditPacks())
+}
+
+func GetCreditBalance(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	balance, err := service.GetCreditBalance(c.Request.Context(), openId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, balance)
+}
+
+func RedeemCoupon(c *gin.Context) {
+	req := request.CouponRedeemReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.RedeemCoupon(c.Request.Context(), req.OpenId, req.Code)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func CreateOrder(c *gin.Context) {
+	req := request.OrderCreationReq{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.Fail(c, http.StatusBadRequest, err)
+		return
+	}
+	result, err := service.CreateOrder(c.Request.Context(), req.OpenId, req.PackId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func FetchOrders(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	orders, err := service.FetchOrders(c.Request.Context(), openId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, orders)
+}
+
+func QueryOrder(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	order, err := service.QueryOrder(c.Request.Context(), openId, c.Param("outTradeNo"))
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, order)
+}
+
+func CloseOrder(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	if err := service.CloseOrder(c.Request.Context(), openId, c.Param("outTradeNo")); err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, nil)
+}
+
+// PaymentNotify 微信支付结果回调，应答格式由微信支付规定，非 2xx 应答会触发微信重试
+func PaymentNotify(c *gin.Context) {
+	if err := service.HandlePaymentNotify(c.Request.Context(), c.Request); err != nil {
+		log.Println("handle payment notification failed, the error is", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"code": "FAIL", "message": "失败"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
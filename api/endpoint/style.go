@@ -0,0 +1,27 @@
+package endpoint
+
+import (
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func FetchStyles(c *gin.Context) {
+	result, err := service.FetchStyles(c.Request.Context())
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func FetchWildcards(c *gin.Context) {
+	result, err := service.FetchWildcards(c.Request.Context())
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
@@ -0,0 +1,48 @@
+package endpoint
+
+import (
+	"errors"
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const heartbeatInterval = 15 * time.Second
+
+// StreamTaskEvents 以 SSE 推送生成任务的状态变化，任务结束后关闭连接
+func StreamTaskEvents(c *gin.Context) {
+	taskId := c.Param("id")
+	if taskId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	events, err := service.SubscribeTaskEvents(c.Request.Context(), taskId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// disable the proxy buffering of nginx
+	c.Header("X-Accel-Buffering", "no")
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.State, event)
+			return !service.IsTerminalTaskState(event.State)
+		case <-heartbeat.C:
+			// a comment line keeps the connection alive through proxies
+			io.WriteString(w, ": heartbeat\n\n")
+			return true
+		}
+	})
+}
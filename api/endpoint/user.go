@@ -0,0 +1,38 @@
+package endpoint
+
+import (
+	"errors"
+	"idraw-server/api/response"
+	"idraw-server/service"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetEntitlements(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	result, err := service.GetEntitlements(c.Request.Context(), openId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
+
+func FetchReferrals(c *gin.Context) {
+	openId := c.Query("openId")
+	if openId == "" {
+		response.Fail(c, http.StatusBadRequest, errors.New("error params"))
+		return
+	}
+	result, err := service.FetchReferrals(c.Request.Context(), openId)
+	if err != nil {
+		response.Fail(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	response.Success(c, result)
+}
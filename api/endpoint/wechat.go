@@ -1,9 +1,12 @@
 package endpoint
 
 import (
+	"encoding/json"
 	"errors"
 	"idraw-server/api/response"
+	"idraw-server/apperror"
 	"idraw-server/service"
+	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -11,9 +14,10 @@ import (
 
 func WeLogin(c *gin.Context) {
 	if code := c.Query("code"); code != "" {
-		data, err := service.WeChatLogin(code)
+		data, err := service.WeChatLogin(c.Request.Context(), code, c.Query("inviteCode"))
 		if err != nil {
 			response.Fail(c, http.StatusServiceUnavailable, err)
+			return
 		}
 		response.Success(c, *data)
 	} else {
@@ -21,3 +25,74 @@ func WeLogin(c *gin.Context) {
 		return
 	}
 }
+
+// VerifyPushUrl 小程序消息推送配置服务器地址时的校验
+func VerifyPushUrl(c *gin.Context) {
+	if !service.VerifyPushSignature(c.Query("signature"), c.Query("timestamp"), c.Query("nonce")) {
+		c.String(http.StatusUnauthorized, "invalid signature")
+		return
+	}
+	c.String(http.StatusOK, c.Query("echostr"))
+}
+
+// ReceivePush 小程序消息推送，数据格式需配置为 json 明文，目前只处理 wxa_media_check 事件
+func ReceivePush(c *gin.Context) {
+	if !service.VerifyPushSignature(c.Query("signature"), c.Query("timestamp"), c.Query("nonce")) {
+		c.String(http.StatusUnauthorized, "invalid signature")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		c.String(http.StatusBadRequest, "failed to read the body")
+		return
+	}
+	event := service.MediaCheckEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.Error(err)
+		c.String(http.StatusBadRequest, "invalid body")
+		return
+	}
+	if event.MsgType == "event" && event.Event == "wxa_media_check" {
+		if err := service.HandleMediaCheckEvent(c.Request.Context(), event); err != nil {
+			// 返回非 success 时微信会重试推送
+			c.Error(err)
+			c.String(http.StatusInternalServerError, "failed")
+			return
+		}
+	}
+	c.String(http.StatusOK, "success")
+}
+
+// VerifyCallbackUrl 公众号配置服务器地址时的校验
+func VerifyCallbackUrl(c *gin.Context) {
+	if !service.VerifyCallbackSignature(c.Query("signature"), c.Query("timestamp"), c.Query("nonce")) {
+		c.String(http.StatusUnauthorized, "invalid signature")
+		return
+	}
+	c.String(http.StatusOK, c.Query("echostr"))
+}
+
+// ReceiveCallback 公众号消息推送，消息加解密方式需配置为安全模式，有回复时以加密的 xml 被动回复
+func ReceiveCallback(c *gin.Context) {
+	if !service.VerifyCallbackSignature(c.Query("signature"), c.Query("timestamp"), c.Query("nonce")) {
+		c.String(http.StatusUnauthorized, "invalid signature")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	if err != nil {
+		c.String(http.StatusBadRequest, "failed to read the body")
+		return
+	}
+	reply, err := service.HandleOfficialAccountMessage(c.Request.Context(), c.Query("timestamp"), c.Query("nonce"), c.Query("msg_signature"), body)
+	if err != nil {
+		// 返回非 success 时微信会重试推送
+		c.Error(err)
+		c.String(apperror.From(err, http.StatusInternalServerError).Status(), "failed")
+		return
+	}
+	if reply == nil {
+		c.String(http.StatusOK, "success")
+		return
+	}
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", reply)
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"idraw-server/api/response"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth 运维接口需在 Authorization 头中携带 Bearer <ADMIN_TOKEN>，未配置 ADMIN_TOKEN 时运维接口不可用
+func AdminAuth() gin.HandlerFunc {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		log.Println("lack env ADMIN_TOKEN, admin endpoints are disabled")
+	}
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			response.Fail(c, http.StatusUnauthorized, errors.New("invalid admin token"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
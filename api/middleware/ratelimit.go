@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/service"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+type Rate struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Policy 描述一条路由的限流策略，PerUser 只在能从请求中解析出用户时生效
+type Policy struct {
+	PerIP   Rate
+	PerUser Rate
+}
+
+// maxUserBodySize 解析用户时最多读取的 json 请求体大小，超出部分原样留给 handler
+const maxUserBodySize = 64 << 10
+
+// defaultPolicy 未在 policies 中单独配置的路由使用该策略
+var defaultPolicy = Policy{
+	PerIP: Rate{Limit: 120, Window: time.Minute},
+}
+
+// policies 所有路由的限流策略集中在这里配置，key 为 "METHOD 路由模板"
+var policies = map[string]Policy{
+	// 微信登录
+	"GET /api/wx/login": {
+		PerIP: Rate{Limit: 10, Window: time.Minute},
+	},
+	// 文件上传
+	"POST /api/images": {
+		PerIP:   Rate{Limit: 20, Window: time.Minute},
+		PerUser: Rate{Limit: 100, Window: time.Hour},
+	},
+	// 文件下载
+	"GET /api/images": {
+		PerIP: Rate{Limit: 300, Window: time.Minute},
+	},
+	// 生成记录查询
+	"GET /api/images/records": {
+		PerIP:   Rate{Limit: 60, Window: time.Minute},
+		PerUser: Rate{Limit: 30, Window: time.Minute},
+	},
+	"GET /api/images/records/count": {
+		PerIP:   Rate{Limit: 60, Window: time.Minute},
+		PerUser: Rate{Limit: 30, Window: time.Minute},
+	},
+	// 微信支付回调，来源为微信支付的服务器
+	"POST /api/payments/notify": {
+		PerIP: Rate{Limit: 600, Window: time.Minute},
+	},
+	// 小程序消息推送，来源为微信的服务器
+	"POST /api/wx/push": {
+		PerIP: Rate{Limit: 600, Window: time.Minute},
+	},
+	// 公众号消息推送，来源为微信的服务器
+	"POST /api/wx/callback": {
+		PerIP: Rate{Limit: 600, Window: time.Minute},
+	},
+	// 下单
+	"POST /api/payments/orders": {
+		PerIP: Rate{Limit: 20, Window: time.Minute},
+	},
+	// 兑换码兑换，限制得较严以防止穷举
+	"POST /api/credits/redeem": {
+		PerIP: Rate{Limit: 10, Window: time.Minute},
+	},
+	// 签到与激励视频
+	"POST /api/bonus/checkin": {
+		PerIP: Rate{Limit: 10, Window: time.Minute},
+	},
+	"POST /api/bonus/ads/nonce": {
+		PerIP: Rate{Limit: 20, Window: time.Minute},
+	},
+	"POST /api/bonus/ads/complete": {
+		PerIP: Rate{Limit: 20, Window: time.Minute},
+	},
+	// 相似图片查询
+	"GET /api/images/similar": {
+		PerIP:   Rate{Limit: 60, Window: time.Minute},
+		PerUser: Rate{Limit: 30, Window: time.Minute},
+	},
+	// 合成分享海报
+	"POST /api/images/records/:id/poster": {
+		PerIP: Rate{Limit: 20, Window: time.Minute},
+	},
+	// 画廊发布与点赞
+	"POST /api/gallery": {
+		PerIP: Rate{Limit: 20, Window: time.Minute},
+	},
+	"POST /api/gallery/:token/like": {
+		PerIP: Rate{Limit: 60, Window: time.Minute},
+	},
+	"DELETE /api/gallery/:token/like": {
+		PerIP:   Rate{Limit: 60, Window: time.Minute},
+		PerUser: Rate{Limit: 30, Window: time.Minute},
+	},
+	// 作品图片
+	"GET /api/gallery/:token/images/:index": {
+		PerIP: Rate{Limit: 300, Window: time.Minute},
+	},
+	// 图片生成
+	service.GenerationRoute: {
+		PerIP:   Rate{Limit: 10, Window: time.Minute},
+		PerUser: Rate{Limit: service.GenerationUserLimit, Window: service.GenerationUserWindow},
+	},
+	"POST /api/images/variations": {
+		PerIP:   Rate{Limit: 10, Window: time.Minute},
+		PerUser: Rate{Limit: 5, Window: time.Minute},
+	},
+}
+
+// RateLimit 按 policies 对每个请求做 IP 维度和用户维度的限流，allowlist 内的调用方不受限制
+func RateLimit(skipPaths ...string) gin.HandlerFunc {
+	allowlist := parseAllowlist(os.Getenv("RATE_LIMIT_ALLOWLIST"))
+	skip := make(map[string]bool, len(skipPaths))
+	for _, p := range skipPaths {
+		skip[p] = true
+	}
+	return func(c *gin.Context) {
+		if skip[c.Request.URL.Path] || c.FullPath() == "" {
+			c.Next()
+			return
+		}
+		ip := c.ClientIP()
+		if isAllowlisted(allowlist, ip) {
+			c.Next()
+			return
+		}
+		route := c.Request.Method + " " + c.FullPath()
+		policy, ok := policies[route]
+		if !ok {
+			policy = defaultPolicy
+		}
+		if !check(c, route, "ip:"+ip, policy.PerIP) {
+			return
+		}
+		if policy.PerUser.Limit > 0 {
+			if openId := requestUser(c); openId != "" && !check(c, route, "user:"+openId, policy.PerUser) {
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// userFields 请求体中标识用户的字段，与 api/request 中的结构体保持一致
+type userFields struct {
+	OpenId string `json:"openId"`
+	User   string `json:"user"`
+}
+
+// requestUser 按 handler 的取值方式解析请求的用户：查询参数 openId、json 请求体中的 openId 或 user、表单中的 user。
+// 读取 json 请求体后会将其放回，表单解析的结果由 http.Request 缓存，不影响 handler 再次绑定
+func requestUser(c *gin.Context) string {
+	if openId := c.Query("openId"); openId != "" {
+		return openId
+	}
+	switch c.ContentType() {
+	case binding.MIMEJSON:
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxUserBodySize))
+		c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+		if err != nil {
+			return ""
+		}
+		fields := userFields{}
+		json.Unmarshal(body, &fields)
+		if fields.OpenId != "" {
+			return fields.OpenId
+		}
+		return fields.User
+	case binding.MIMEMultipartPOSTForm, binding.MIMEPOSTForm:
+		if user := c.PostForm("user"); user != "" {
+			return user
+		}
+		return c.PostForm("openId")
+	default:
+		return ""
+	}
+}
+
+// check 执行一次限流判断并写入 RateLimit 响应头，被拒绝时直接以 429 结束请求
+func check(c *gin.Context, route string, subject string, rate Rate) bool {
+	if rate.Limit <= 0 {
+		return true
+	}
+	result, err := service.AllowRequest(c.Request.Context(), route+":"+subject, rate.Limit, rate.Window)
+	if err != nil {
+		// fail open, a broken redis must not take every endpoint down with it
+		log.Println("rate limit check failed, let the request pass, the error is", err)
+		return true
+	}
+	resetSeconds := strconv.Itoa(int(math.Ceil(result.ResetAfter.Seconds())))
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", resetSeconds)
+	if !result.Allowed {
+		c.Header("Retry-After", resetSeconds)
+		response.Fail(c, http.StatusTooManyRequests, apperror.New(apperror.CodeTooManyRequests, errors.New(route+" exceeds the limit for "+subject)))
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// parseAllowlist 解析逗号分隔的 IP 或 CIDR 列表
+func parseAllowlist(val string) []*net.IPNet {
+	result := []*net.IPNet{}
+	for _, item := range strings.Split(val, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			log.Printf("ignore invalid rate limit allowlist entry %s, the error is %s", item, err)
+			continue
+		}
+		result = append(result, ipNet)
+	}
+	return result
+}
+
+func isAllowlisted(allowlist []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range allowlist {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+package openapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+)
+
+const SpecPath = "/openapi.json"
+
+// swaggerInitializer 覆盖 swagger ui 自带的初始化脚本，指向本服务的文档
+const swaggerInitializer = `window.onload = function() {
+  window.ui = SwaggerUIBundle({
+    url: "` + SpecPath + `",
+    dom_id: "#swagger-ui",
+    deepLinking: true,
+    presets: [SwaggerUIBundle.presets.apis, SwaggerUIStandalonePreset],
+    layout: "StandaloneLayout"
+  });
+};
+`
+
+// ServeSpec 返回 openapi 文档
+func ServeSpec(c *gin.Context) {
+	c.JSON(http.StatusOK, Build())
+}
+
+// ServeSwaggerUI 提供内置的 swagger ui 静态资源，需挂载在 /swagger/*any 上
+func ServeSwaggerUI() gin.HandlerFunc {
+	fileServer := http.StripPrefix("/swagger", http.FileServer(swaggerFiles.HTTP))
+	return func(c *gin.Context) {
+		switch strings.TrimPrefix(c.Param("any"), "/") {
+		case "":
+			c.Redirect(http.StatusMovedPermanently, "/swagger/index.html")
+		case "swagger-initializer.js":
+			c.Data(http.StatusOK, "application/javascript", []byte(swaggerInitializer))
+		default:
+			fileServer.ServeHTTP(c.Writer, c.Request)
+		}
+	}
+}
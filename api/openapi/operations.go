@@ -0,0 +1,310 @@
+package openapi
+
+import (
+	"idraw-server/api/request"
+	"idraw-server/api/response"
+	"net/http"
+)
+
+var respBody = response.RespBody{}
+
+// operations 所有业务接口的契约，新增或修改路由时需同步更新，spec_test.go 会与实际注册的路由及 handler 比对
+var operations = []operation{
+	{
+		method:  http.MethodGet,
+		path:    "/api/wx/login",
+		summary: "微信登录",
+		tag:     "wechat",
+		params:  []param{query("code", true), query("inviteCode", false)},
+		data:    response.WeChatLoginDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/users/me/entitlements",
+		summary: "当前会员等级下的额度与能力",
+		tag:     "users",
+		params:  []param{query("openId", true)},
+		data:    response.EntitlementsDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/users/me/referrals",
+		summary: "我的邀请码及邀请记录",
+		tag:     "users",
+		params:  []param{query("openId", true)},
+		data:    response.ReferralsDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images/dailyLimits",
+		summary: "获取每日限额",
+		tag:     "quota",
+		params:  []param{query("openId", false)},
+		data:    0,
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images/currentUsages",
+		summary: "当前使用值",
+		tag:     "quota",
+		params:  []param{query("openId", true)},
+		data:    0,
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images",
+		summary: "文件下载",
+		tag:     "images",
+		params:  []param{query("fileName", true), query("sig", false)},
+		raw:     contentImage,
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images/records",
+		summary: "生成记录查询",
+		tag:     "images",
+		params:  []param{query("openId", true), query("calledType", true)},
+		data:    []response.RecordDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images/records/count",
+		summary: "生成纪录总数查询",
+		tag:     "images",
+		params:  []param{query("openId", true)},
+		data:    0,
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/images",
+		summary:     "文件上传",
+		tag:         "images",
+		body:        request.FileUploadReq{},
+		contentType: contentMultipart,
+		data:        "",
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/images/generations",
+		summary:     "根据场景描述产出符合场景的图片，应答只含图片路径，改写后的描述随进度事件 STORED 推送并保存在生成记录中",
+		tag:         "images",
+		body:        request.ImageGenerationReq{},
+		contentType: contentJson,
+		data:        []string{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/images/variations",
+		summary:     "根据图片产出其变体",
+		tag:         "images",
+		body:        request.ImageVariationReq{},
+		contentType: contentMultipart,
+		data:        []string{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images/tasks/:id/events",
+		summary: "生成任务进度事件流（SSE），每条事件的 data 为 TaskEventDto",
+		tag:     "images",
+		params:  []param{path("id")},
+		raw:     contentEventStream,
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/images/similar",
+		summary: "查询用户自己的图片中与 fileName 视觉上相似的图片，maxDistance 默认为 10",
+		tag:     "images",
+		params: []param{query("openId", true), query("fileName", true),
+			queryInt("maxDistance", false), queryInt("limit", false)},
+		data: []response.SimilarImageDto{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/images/records/:id/poster",
+		summary:     "合成分享海报，返回海报的 fileName，通过文件下载接口获取",
+		tag:         "images",
+		params:      []param{path("id")},
+		body:        request.PosterReq{},
+		contentType: contentJson,
+		data:        "",
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/styles",
+		summary: "风格预设列表",
+		tag:     "styles",
+		data:    []response.StyleDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/wildcards",
+		summary: "动态描述中可通过 __name__ 引用的词表",
+		tag:     "styles",
+		data:    []response.WildcardDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/gallery",
+		summary: "画廊列表，sort 为 latest 或 trending，window 为热门的统计时长如 24h",
+		tag:     "gallery",
+		params: []param{query("openId", false), query("sort", false), query("window", false),
+			query("cursor", false), queryInt("limit", false)},
+		data: response.GalleryPageDto{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/gallery",
+		summary:     "发布生成记录到画廊",
+		tag:         "gallery",
+		body:        request.PublicationReq{},
+		contentType: contentJson,
+		data:        response.ShareDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/gallery/:token",
+		summary: "作品详情",
+		tag:     "gallery",
+		params:  []param{path("token"), query("openId", false)},
+		data:    response.GalleryItemDto{},
+	},
+	{
+		method:  http.MethodDelete,
+		path:    "/api/gallery/:token",
+		summary: "取消发布",
+		tag:     "gallery",
+		params:  []param{path("token"), query("openId", true)},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/gallery/:token/images/:index",
+		summary: "作品图片",
+		tag:     "gallery",
+		params:  []param{path("token"), path("index")},
+		raw:     contentPng,
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/gallery/:token/like",
+		summary:     "点赞",
+		tag:         "gallery",
+		params:      []param{path("token")},
+		body:        request.LikeReq{},
+		contentType: contentJson,
+		data:        response.LikeDto{},
+	},
+	{
+		method:  http.MethodDelete,
+		path:    "/api/gallery/:token/like",
+		summary: "取消点赞",
+		tag:     "gallery",
+		params:  []param{path("token"), query("openId", true)},
+		data:    response.LikeDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/credits/packs",
+		summary: "次数包列表",
+		tag:     "credits",
+		data:    []response.CreditPackDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/credits/balance",
+		summary: "已购次数余额",
+		tag:     "credits",
+		params:  []param{query("openId", true)},
+		data:    0,
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/credits/redeem",
+		summary:     "兑换码兑换次数",
+		tag:         "credits",
+		body:        request.CouponRedeemReq{},
+		contentType: contentJson,
+		data:        response.RedeemDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/bonus/checkin",
+		summary: "今日签到状态",
+		tag:     "bonus",
+		params:  []param{query("openId", true)},
+		data:    response.CheckInDto{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/bonus/checkin",
+		summary:     "每日签到，奖励计入当天的每日额度",
+		tag:         "bonus",
+		body:        request.BonusReq{},
+		contentType: contentJson,
+		data:        response.CheckInDto{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/bonus/ads/nonce",
+		summary:     "展示激励视频前获取 nonce",
+		tag:         "bonus",
+		body:        request.BonusReq{},
+		contentType: contentJson,
+		data:        response.AdNonceDto{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/bonus/ads/complete",
+		summary:     "激励视频看完后凭 nonce 领取奖励",
+		tag:         "bonus",
+		body:        request.AdCompletionReq{},
+		contentType: contentJson,
+		data:        response.AdRewardDto{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/payments/orders",
+		summary:     "创建订单并下单，返回 wx.requestPayment 所需参数",
+		tag:         "payments",
+		body:        request.OrderCreationReq{},
+		contentType: contentJson,
+		data:        response.PaymentDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/payments/orders",
+		summary: "订单列表",
+		tag:     "payments",
+		params:  []param{query("openId", true)},
+		data:    []response.OrderDto{},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/payments/orders/:outTradeNo",
+		summary: "查询订单，未支付时会向微信支付确认最新状态",
+		tag:     "payments",
+		params:  []param{path("outTradeNo"), query("openId", true)},
+		data:    response.OrderDto{},
+	},
+	{
+		method:  http.MethodPost,
+		path:    "/api/payments/orders/:outTradeNo/close",
+		summary: "关闭未支付的订单",
+		tag:     "payments",
+		params:  []param{path("outTradeNo"), query("openId", true)},
+	},
+	{
+		method:  http.MethodGet,
+		path:    "/api/admin/media-checks",
+		summary: "未通过内容安全审核的图片，需携带 Authorization: Bearer <ADMIN_TOKEN>",
+		tag:     "admin",
+		params:  []param{header("Authorization", true), query("cursor", false), queryInt("limit", false)},
+		data:    response.FlaggedImagesDto{},
+	},
+	{
+		method:  http.MethodPost,
+		path:    "/api/admin/dailyLimits",
+		summary: "为用户追加当天的每日额度，需携带 Authorization: Bearer <ADMIN_TOKEN>",
+		tag:     "admin",
+		params:  []param{header("Authorization", true), query("openId", true), queryInt("number", true)},
+	},
+}
@@ -0,0 +1,119 @@
+package openapi
+
+import (
+	"mime/multipart"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+}
+
+var (
+	fileHeaderType = reflect.TypeOf(multipart.FileHeader{})
+	timeType       = reflect.TypeOf(time.Time{})
+)
+
+// schemaOf 通过反射从结构体生成 schema，tag 为 json 或 form，必填、取值范围与枚举取自 binding 约束，
+// 因此文档中的结构与实际绑定的结构体始终一致
+func schemaOf(t reflect.Type, tag string) *Schema {
+	if t == nil {
+		return &Schema{Nullable: true}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == fileHeaderType:
+		return &Schema{Type: "string", Format: "binary"}
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaOf(t.Elem(), tag)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), tag)}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		addFields(s, t, tag)
+		return s
+	default:
+		// any / interface{}
+		return &Schema{}
+	}
+}
+
+func addFields(s *Schema, t reflect.Type, tag string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			addFields(s, f.Type, tag)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop := schemaOf(f.Type, tag)
+		if applyBinding(prop, f.Tag.Get("binding")) {
+			s.Required = append(s.Required, name)
+		}
+		s.Properties[name] = prop
+	}
+}
+
+// applyBinding 将 validator 的约束翻译为 schema，返回字段是否必填
+func applyBinding(s *Schema, binding string) bool {
+	required := false
+	for _, rule := range strings.Split(binding, ",") {
+		key, val, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			required = true
+		case "gte", "min":
+			s.Minimum = parseNumber(val)
+		case "lte", "max":
+			s.Maximum = parseNumber(val)
+		case "oneof":
+			s.Enum = strings.Fields(val)
+		}
+	}
+	return required
+}
+
+func parseNumber(val string) *float64 {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
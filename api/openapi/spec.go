@@ -0,0 +1,170 @@
+package openapi
+
+import (
+	"reflect"
+	"strings"
+)
+
+const (
+	contentJson        string = "application/json"
+	contentMultipart   string = "multipart/form-data"
+	contentPng         string = "image/png"
+	contentImage       string = "image/*"
+	contentEventStream string = "text/event-stream"
+)
+
+type Document struct {
+	OpenAPI string                          `json:"openapi"`
+	Info    Info                            `json:"info"`
+	Paths   map[string]map[string]Operation `json:"paths"`
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Operation struct {
+	Summary     string              `json:"summary"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// param 描述一个 query 或 path 参数
+type param struct {
+	name     string
+	in       string
+	required bool
+	typ      string
+}
+
+// operation 描述一个接口，请求体与返回的 data 都直接引用实际使用的 go 类型
+type operation struct {
+	method      string
+	path        string // gin style path, e.g. /api/images/records/:id
+	summary     string
+	tag         string
+	params      []param
+	body        any    // request struct, nil if there is no body
+	contentType string // content type of the body
+	data        any    // type of RespBody.Data, nil if no data is returned
+	raw         string // content type of a non RespBody response, e.g. image/png
+}
+
+func query(name string, required bool) param {
+	return param{name: name, in: "query", required: required, typ: "string"}
+}
+
+func queryInt(name string, required bool) param {
+	return param{name: name, in: "query", required: required, typ: "integer"}
+}
+
+func path(name string) param {
+	return param{name: name, in: "path", required: true, typ: "string"}
+}
+
+func header(name string, required bool) param {
+	return param{name: name, in: "header", required: required, typ: "string"}
+}
+
+// Build 根据 operations 生成 openapi 3 文档
+func Build() Document {
+	doc := Document{
+		OpenAPI: "3.0.3",
+		Info:    Info{Title: "idraw-server", Version: "1.0.0"},
+		Paths:   map[string]map[string]Operation{},
+	}
+	for _, op := range operations {
+		p := openapiPath(op.path)
+		if doc.Paths[p] == nil {
+			doc.Paths[p] = map[string]Operation{}
+		}
+		doc.Paths[p][strings.ToLower(op.method)] = op.build()
+	}
+	return doc
+}
+
+func (op operation) build() Operation {
+	result := Operation{
+		Summary:   op.summary,
+		Tags:      []string{op.tag},
+		Responses: map[string]Response{},
+	}
+	for _, p := range op.params {
+		result.Parameters = append(result.Parameters, Parameter{
+			Name:     p.name,
+			In:       p.in,
+			Required: p.required,
+			Schema:   &Schema{Type: p.typ},
+		})
+	}
+	if op.body != nil {
+		tag := "json"
+		if op.contentType == contentMultipart {
+			tag = "form"
+		}
+		result.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]MediaType{
+				op.contentType: {Schema: schemaOf(reflect.TypeOf(op.body), tag)},
+			},
+		}
+	}
+	if op.raw != "" {
+		result.Responses["200"] = Response{
+			Description: "raw content",
+			Content:     map[string]MediaType{op.raw: {Schema: &Schema{Type: "string", Format: "binary"}}},
+		}
+	} else {
+		result.Responses["200"] = Response{
+			Description: "succeed",
+			Content:     map[string]MediaType{contentJson: {Schema: envelope(op.data)}},
+		}
+	}
+	result.Responses["default"] = Response{
+		Description: "failed, errCode carries the business code",
+		Content:     map[string]MediaType{contentJson: {Schema: envelope(nil)}},
+	}
+	return result
+}
+
+// envelope 生成 response.RespBody 的 schema，data 替换为具体类型
+func envelope(data any) *Schema {
+	s := schemaOf(reflect.TypeOf(respBody), "json")
+	s.Properties["data"] = schemaOf(reflect.TypeOf(data), "json")
+	return s
+}
+
+// openapiPath 将 gin 的 :param 与 *param 转换为 openapi 的 {param}
+func openapiPath(ginPath string) string {
+	segments := strings.Split(ginPath, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			segments[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
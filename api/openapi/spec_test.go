@@ -0,0 +1,447 @@
+package openapi
+
+import (
+	"bufio"
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	mainFile    = "../../main.go"
+	endpointDir = "../endpoint"
+	endpointPkg = "idraw-server/api/endpoint"
+)
+
+// infraRoutes 不需要出现在文档中的基础设施路由：探针、文档本身及微信、微信支付的回调
+var infraRoutes = map[string]bool{
+	"/ping":                true,
+	"/healthz":             true,
+	"/readyz":              true,
+	SpecPath:               true,
+	"/swagger/*any":        true,
+	"/api/payments/notify": true,
+	"/s/:token":            true,
+	"/api/wx/push":         true,
+	"/api/wx/callback":     true,
+}
+
+// route main.go 中注册的一个路由
+type route struct {
+	method  string
+	path    string
+	handler string // function name in the endpoint package, empty for inline handlers
+}
+
+// usage handler 实际读取的参数、绑定的请求体与返回的 data
+type usage struct {
+	query map[string]bool
+	path  map[string]bool
+	binds []types.Type
+	json  bool // whether the body is bound by ShouldBindJSON
+	data  []types.Type
+}
+
+// registeredRoutes 解析 main.go 得到注册的路由。service 包在 init 中校验环境变量，
+// 测试中无法直接构建 router，因此按源码还原 Group 前缀与路由
+func registeredRoutes(t *testing.T) []route {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), mainFile, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes := map[string]string{}
+	var routes []route
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			if len(n.Lhs) != 1 || len(n.Rhs) != 1 {
+				return true
+			}
+			call, ok := n.Rhs[0].(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			recv, method := selector(call.Fun)
+			if method != "Group" || len(call.Args) == 0 {
+				return true
+			}
+			if name, ok := n.Lhs[0].(*ast.Ident); ok {
+				prefixes[name.Name] = prefixes[recv] + routePath(t, call.Args[0])
+			}
+		case *ast.CallExpr:
+			recv, method := selector(n.Fun)
+			switch method {
+			case "GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS":
+			default:
+				return true
+			}
+			if len(n.Args) < 2 {
+				return true
+			}
+			r := route{method: method, path: prefixes[recv] + routePath(t, n.Args[0])}
+			if pkg, name := selector(n.Args[len(n.Args)-1]); pkg == "endpoint" {
+				r.handler = name
+			}
+			routes = append(routes, r)
+		}
+		return true
+	})
+	if len(routes) == 0 {
+		t.Fatal("no route is found in " + mainFile)
+	}
+	return routes
+}
+
+func selector(expr ast.Expr) (string, string) {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return "", ""
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", sel.Sel.Name
+	}
+	return x.Name, sel.Sel.Name
+}
+
+func routePath(t *testing.T, expr ast.Expr) string {
+	t.Helper()
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		p, err := strconv.Unquote(e.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	case *ast.SelectorExpr:
+		if pkg, name := selector(e); pkg == "openapi" && name == "SpecPath" {
+			return SpecPath
+		}
+	}
+	t.Fatalf("unsupported route path %#v in %s", expr, mainFile)
+	return ""
+}
+
+// handlerUsages 对 endpoint 包做类型检查，收集每个 handler 读取的参数及请求体、data 的类型
+func handlerUsages(t *testing.T) map[string]*usage {
+	t.Helper()
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, endpointDir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*ast.File
+	for _, f := range pkgs["endpoint"].Files {
+		files = append(files, f)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "gc", exportLookup(t))}
+	info := &types.Info{Types: map[ast.Expr]types.TypeAndValue{}}
+	if _, err = conf.Check(endpointPkg, fset, files, info); err != nil {
+		t.Fatal(err)
+	}
+	usages := map[string]*usage{}
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil || fn.Body == nil {
+				continue
+			}
+			u := &usage{query: map[string]bool{}, path: map[string]bool{}}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				recv, method := selector(call.Fun)
+				switch {
+				case recv == "response" && method == "Success" && len(call.Args) == 2:
+					u.data = append(u.data, info.TypeOf(call.Args[1]))
+				case len(call.Args) == 0:
+				case method == "Query" || method == "DefaultQuery" || method == "GetQuery":
+					u.query[stringArg(call)] = true
+				case method == "Param":
+					u.path[stringArg(call)] = true
+				case strings.HasPrefix(method, "ShouldBind"):
+					arg := call.Args[0]
+					if unary, ok := arg.(*ast.UnaryExpr); ok && unary.Op == token.AND {
+						arg = unary.X
+					}
+					u.binds = append(u.binds, info.TypeOf(arg))
+					u.json = method == "ShouldBindJSON"
+				}
+				return true
+			})
+			usages[fn.Name.Name] = u
+		}
+	}
+	return usages
+}
+
+func stringArg(call *ast.CallExpr) string {
+	if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+		s, _ := strconv.Unquote(lit.Value)
+		return s
+	}
+	return ""
+}
+
+// exportLookup 通过 go list 定位依赖的编译产物，供类型检查使用
+func exportLookup(t *testing.T) importer.Lookup {
+	t.Helper()
+	out, err := exec.Command("go", "list", "-export", "-deps", "-f", "{{.ImportPath}}={{.Export}}", endpointPkg).Output()
+	if err != nil {
+		t.Fatal("go list failed, the error is", err)
+	}
+	exports := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if pkg, file, ok := strings.Cut(scanner.Text(), "="); ok && file != "" {
+			exports[pkg] = file
+		}
+	}
+	return func(pkg string) (io.ReadCloser, error) {
+		file, ok := exports[pkg]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return os.Open(file)
+	}
+}
+
+// typeName 以 types.TypeString 的格式描述 reflect 类型，忽略指针以便与 handler 中的类型比较
+func typeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		return "[]" + typeName(t.Elem())
+	case reflect.Map:
+		return "map[" + typeName(t.Key()) + "]" + typeName(t.Elem())
+	}
+	return t.String()
+}
+
+func typeString(t types.Type) string {
+	for {
+		ptr, ok := t.(*types.Pointer)
+		if !ok {
+			return types.TypeString(t, nil)
+		}
+		t = ptr.Elem()
+	}
+}
+
+func findOperation(method, path string) (operation, bool) {
+	for _, op := range operations {
+		if op.method == method && op.path == path {
+			return op, true
+		}
+	}
+	return operation{}, false
+}
+
+func TestRoutesAreDocumented(t *testing.T) {
+	registered := map[string]bool{}
+	for _, r := range registeredRoutes(t) {
+		if !infraRoutes[r.path] {
+			registered[r.method+" "+r.path] = true
+		}
+	}
+	documented := map[string]bool{}
+	for _, op := range operations {
+		key := op.method + " " + op.path
+		if documented[key] {
+			t.Errorf("route %s is documented twice", key)
+		}
+		documented[key] = true
+	}
+	var problems []string
+	for key := range registered {
+		if !documented[key] {
+			problems = append(problems, "undocumented route "+key)
+		}
+	}
+	for key := range documented {
+		if !registered[key] {
+			problems = append(problems, "documented route is not registered "+key)
+		}
+	}
+	sort.Strings(problems)
+	for _, p := range problems {
+		t.Error(p)
+	}
+}
+
+func TestOperationsMatchHandlers(t *testing.T) {
+	usages := handlerUsages(t)
+	for _, r := range registeredRoutes(t) {
+		op, ok := findOperation(r.method, r.path)
+		if !ok || r.handler == "" {
+			continue
+		}
+		name := r.method + " " + r.path
+		u, ok := usages[r.handler]
+		if !ok {
+			t.Errorf("%s: handler endpoint.%s is not found", name, r.handler)
+			continue
+		}
+		documented := map[string]map[string]bool{"query": {}, "path": {}}
+		for _, p := range op.params {
+			if documented[p.in] != nil {
+				documented[p.in][p.name] = true
+			}
+		}
+		compareNames(t, name, "query", documented["query"], u.query)
+		compareNames(t, name, "path", documented["path"], u.path)
+		compareNames(t, name, "route path", documented["path"], routeParams(r.path))
+
+		switch {
+		case op.body == nil && len(u.binds) != 0:
+			t.Errorf("%s: handler binds %s but no body is documented", name, typeString(u.binds[0]))
+		case op.body != nil && len(u.binds) != 1:
+			t.Errorf("%s: body %s is documented but the handler binds %d bodies", name, typeName(reflect.TypeOf(op.body)), len(u.binds))
+		case op.body != nil:
+			if got, want := typeString(u.binds[0]), typeName(reflect.TypeOf(op.body)); got != want {
+				t.Errorf("%s: handler binds %s but the body is documented as %s", name, got, want)
+			}
+			if u.json != (op.contentType == contentJson) {
+				t.Errorf("%s: body is documented as %s but bound by ShouldBindJSON is %t", name, op.contentType, u.json)
+			}
+		}
+
+		if op.raw != "" {
+			continue
+		}
+		if len(u.data) == 0 {
+			t.Errorf("%s: handler never responds with response.Success", name)
+		}
+		for _, data := range u.data {
+			if basic, ok := data.(*types.Basic); ok && basic.Kind() == types.UntypedNil {
+				if op.data != nil {
+					t.Errorf("%s: handler responds with nil data but the data is documented as %s", name, typeName(reflect.TypeOf(op.data)))
+				}
+				continue
+			}
+			if op.data == nil {
+				t.Errorf("%s: handler responds with %s but no data is documented", name, typeString(data))
+				continue
+			}
+			if got, want := typeString(data), typeName(reflect.TypeOf(op.data)); got != want {
+				t.Errorf("%s: handler responds with %s but the data is documented as %s", name, got, want)
+			}
+		}
+	}
+}
+
+func compareNames(t *testing.T, route, in string, documented, actual map[string]bool) {
+	t.Helper()
+	for name := range actual {
+		if !documented[name] {
+			t.Errorf("%s: %s param %q is read but not documented", route, in, name)
+		}
+	}
+	for name := range documented {
+		if !actual[name] {
+			t.Errorf("%s: %s param %q is documented but never read", route, in, name)
+		}
+	}
+}
+
+func routeParams(path string) map[string]bool {
+	params := map[string]bool{}
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			params[seg[1:]] = true
+		}
+	}
+	return params
+}
+
+func TestSchemasFollowStructs(t *testing.T) {
+	doc := Build()
+	for _, op := range operations {
+		name := op.method + " " + op.path
+		built := doc.Paths[openapiPath(op.path)][strings.ToLower(op.method)]
+		for _, p := range built.Parameters {
+			if p.Schema == nil || p.Schema.Type == "" {
+				t.Errorf("%s: param %s has no type", name, p.Name)
+			}
+		}
+		if op.body == nil {
+			continue
+		}
+		tag := "json"
+		if op.contentType == contentMultipart {
+			tag = "form"
+		}
+		body := built.RequestBody.Content[op.contentType].Schema
+		checkStruct(t, name, reflect.TypeOf(op.body), tag, body)
+	}
+}
+
+// checkStruct 校验 schema 的字段、必填项与取值范围与结构体的 tag 一一对应
+func checkStruct(t *testing.T, route string, typ reflect.Type, tag string, s *Schema) {
+	t.Helper()
+	if s.Type != "object" {
+		t.Errorf("%s: schema of %s is %q, not object", route, typ, s.Type)
+		return
+	}
+	required := map[string]bool{}
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	fields := 0
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if !f.IsExported() || name == "-" || f.Anonymous {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields++
+		prop, ok := s.Properties[name]
+		if !ok {
+			t.Errorf("%s: field %s.%s is missing in the schema as %q", route, typ, f.Name, name)
+			continue
+		}
+		if prop.Type == "" {
+			t.Errorf("%s: field %s.%s has no type", route, typ, f.Name)
+		}
+		binding := f.Tag.Get("binding")
+		if want := strings.Contains(","+binding+",", ",required,"); required[name] != want {
+			t.Errorf("%s: field %s.%s required is %t, binding is %q", route, typ, f.Name, required[name], binding)
+		}
+		if strings.Contains(binding, "oneof=") && len(prop.Enum) == 0 {
+			t.Errorf("%s: field %s.%s has no enum, binding is %q", route, typ, f.Name, binding)
+		}
+		if (strings.Contains(binding, "min=") || strings.Contains(binding, "gte=")) && prop.Minimum == nil {
+			t.Errorf("%s: field %s.%s has no minimum, binding is %q", route, typ, f.Name, binding)
+		}
+		if (strings.Contains(binding, "max=") || strings.Contains(binding, "lte=")) && prop.Maximum == nil {
+			t.Errorf("%s: field %s.%s has no maximum, binding is %q", route, typ, f.Name, binding)
+		}
+	}
+	if fields == 0 {
+		t.Errorf("%s: body %s has no field", route, typ)
+	}
+}
@@ -12,7 +12,21 @@ type ImageGenerationReq struct {
 	User   string `json:"user" binding:"required"`
 	Prompt string `json:"prompt" binding:"required"`
 	N      int    `json:"n" binding:"gte=1,lte=10"`
-	Size   string `json:"size" binding:"required"`
+	// optional if a style is applied, the default size of the style is used then
+	Size string `json:"size" binding:"required_without=StyleId"`
+	// id of the style preset to apply
+	StyleId uint `json:"styleId,omitempty"`
+	// translate and expand the prompt with an llm before generating. The rewritten prompt is not in the response,
+	// it is sent with the STORED progress event and kept as enhancedPrompt of the record
+	Enhance bool `json:"enhance,omitempty"`
+	// how a prompt with {a|b} alternatives or __wildcard__ references is expanded, random if not specified
+	PromptMode string `json:"promptMode,omitempty" binding:"omitempty,oneof=random combinatorial"`
+	// url or b64_json, b64_json is used if not specified
+	ResponseFormat string `json:"response_format,omitempty" binding:"omitempty,oneof=url b64_json"`
+	// client generated uuid, used to subscribe the progress events of this generation
+	TaskId string `json:"taskId,omitempty" binding:"omitempty,uuid"`
+	// subscribe message templates the user accepted right before submitting, notified once generated
+	SubscribedTemplateIds []string `json:"subscribedTemplateIds,omitempty"`
 }
 
 type ImageVariationReq struct {
@@ -20,4 +34,16 @@ type ImageVariationReq struct {
 	User     string `form:"user" binding:"required"`
 	N        int    `form:"n" binding:"gte=1,lte=10"`
 	Size     string `form:"size" binding:"required"`
+	// url or b64_json, b64_json is used if not specified
+	ResponseFormat string `form:"responseFormat" binding:"omitempty,oneof=url b64_json"`
+	// client generated uuid, used to subscribe the progress events of this generation
+	TaskId string `form:"taskId" binding:"omitempty,uuid"`
+	// subscribe message templates the user accepted right before submitting, notified once generated
+	SubscribedTemplateIds []string `form:"subscribedTemplateIds"`
+}
+
+type PosterReq struct {
+	OpenId string `json:"openId" binding:"required"`
+	// index of the image in the record's output, 0 if not specified
+	Index int `json:"index" binding:"gte=0"`
 }
@@ -0,0 +1,11 @@
+package request
+
+type BonusReq struct {
+	OpenId string `json:"openId" binding:"required"`
+}
+
+type AdCompletionReq struct {
+	OpenId string `json:"openId" binding:"required"`
+	// nonce issued before the ad was shown
+	Nonce string `json:"nonce" binding:"required"`
+}
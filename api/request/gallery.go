@@ -0,0 +1,10 @@
+package request
+
+type PublicationReq struct {
+	OpenId   string `json:"openId" binding:"required"`
+	RecordId uint   `json:"recordId" binding:"required"`
+}
+
+type LikeReq struct {
+	OpenId string `json:"openId" binding:"required"`
+}
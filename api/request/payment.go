@@ -0,0 +1,11 @@
+package request
+
+type OrderCreationReq struct {
+	OpenId string `json:"openId" binding:"required"`
+	PackId string `json:"packId" binding:"required"`
+}
+
+type CouponRedeemReq struct {
+	OpenId string `json:"openId" binding:"required"`
+	Code   string `json:"code" binding:"required,max=32"`
+}
@@ -1,8 +1,42 @@
 package response
 
+import "time"
+
 type RecordDto struct {
-	Id     uint     `json:"id"`
-	Type   string   `json:"type"`
-	Input  string   `json:"input"`
-	Output []string `json:"output"`
+	Id             uint     `json:"id"`
+	Type           string   `json:"type"`
+	Input          string   `json:"input"`
+	Output         []string `json:"output"`                   // images that did not pass the review are left out
+	Status         string   `json:"status,omitempty"`         // REVIEWING, PASSED or BLOCKED, empty if not reviewed
+	Originals      []string `json:"originals,omitempty"`      // unwatermarked images, only kept for paying tiers
+	StyleId        uint     `json:"styleId,omitempty"`        // applied style preset
+	EnhancedPrompt string   `json:"enhancedPrompt,omitempty"` // input rewritten by the llm
+	Prompt         string   `json:"prompt,omitempty"`         // prompt sent to the provider if it differs from the input
+	Template       string   `json:"template,omitempty"`       // dynamic prompt the input was expanded from
+	BatchId        string   `json:"batchId,omitempty"`        // records of a combinatorial batch share the same id
+}
+
+type SimilarImageDto struct {
+	FileName      string `json:"fileName"`
+	Source        string `json:"source"`        // UPLOADED or GENERATED
+	Distance      int    `json:"distance"`      // hamming distance of the perceptual hashes, 0 to 64
+	DHashDistance int    `json:"dHashDistance"` // hamming distance of the difference hashes, 0 to 64
+	Identical     bool   `json:"identical"`     // whether the content is byte-for-byte identical
+}
+
+type FlaggedImageDto struct {
+	Id        uint      `json:"id"`
+	RecordId  uint      `json:"recordId"`
+	User      string    `json:"user"` // owner openId
+	FileName  string    `json:"fileName"`
+	Url       string    `json:"url"`    // signed url that bypasses the review status
+	Status    string    `json:"status"` // RISKY, REVIEW or FAILED
+	Label     int       `json:"label"`  // risk label of the check result
+	TraceId   string    `json:"traceId"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+type FlaggedImagesDto struct {
+	Items      []FlaggedImageDto `json:"items"`
+	NextCursor string            `json:"nextCursor"` // empty if there are no more items
 }
@@ -0,0 +1,18 @@
+package response
+
+type CheckInDto struct {
+	CheckedIn bool `json:"checkedIn"` // whether the user has checked in today
+	Repeated  bool `json:"repeated"`  // true if this request did not check in since it had been done today
+	Streak    int  `json:"streak"`    // consecutive days, 0 if the streak has been broken
+	Bonus     int  `json:"bonus"`     // bonus of today's check-in, or of the next one if not checked in yet
+}
+
+type AdNonceDto struct {
+	Nonce     string `json:"nonce"`
+	Remaining int    `json:"remaining"` // rewards left today
+}
+
+type AdRewardDto struct {
+	Bonus     int `json:"bonus"`
+	Remaining int `json:"remaining"` // rewards left today
+}
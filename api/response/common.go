@@ -1,14 +1,17 @@
 package response
 
 import (
-	"github.com/gin-gonic/gin"
+	"idraw-server/apperror"
 	"net/http"
+
+	"github.com/gin-gonic/gin"
 )
 
 type RespBody struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data any    `json:"data"`
+	Code    int    `json:"code"`
+	ErrCode string `json:"errCode,omitempty"` // stable business code, only set on failure
+	Msg     string `json:"msg"`
+	Data    any    `json:"data"`
 }
 
 func Success(c *gin.Context, data any) {
@@ -19,9 +22,14 @@ func Success(c *gin.Context, data any) {
 	})
 }
 
+// Fail 以业务码和本地化信息响应失败，err 不是 *apperror.Error 时按 statusCode 推断业务码，
+// 原始错误只写入 gin 的错误日志，不返回给客户端
 func Fail(c *gin.Context, statusCode int, err error) {
-	c.JSON(statusCode, RespBody{
-		Code: statusCode,
-		Msg:  err.Error(),
+	appErr := apperror.From(err, statusCode)
+	c.Error(err)
+	c.JSON(appErr.Status(), RespBody{
+		Code:    appErr.Status(),
+		ErrCode: appErr.Code,
+		Msg:     appErr.Message(apperror.Lang(c.GetHeader("Accept-Language"))),
 	})
 }
@@ -0,0 +1,29 @@
+package response
+
+import "time"
+
+type ShareDto struct {
+	Token    string `json:"token"`
+	ShareUrl string `json:"shareUrl"` // server-rendered share page
+}
+
+type GalleryItemDto struct {
+	Token       string    `json:"token"`
+	Type        string    `json:"type"`
+	Prompt      string    `json:"prompt"` // empty for variations
+	Images      []string  `json:"images"` // public image urls
+	Author      string    `json:"author"`
+	Likes       int       `json:"likes"`
+	Liked       bool      `json:"liked"` // whether the current user liked it
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+type GalleryPageDto struct {
+	Items      []GalleryItemDto `json:"items"`
+	NextCursor string           `json:"nextCursor"` // empty if there are no more items
+}
+
+type LikeDto struct {
+	Liked bool `json:"liked"`
+	Likes int  `json:"likes"`
+}
@@ -0,0 +1,12 @@
+package response
+
+type HealthDto struct {
+	Status string              `json:"status"`
+	Checks map[string]CheckDto `json:"checks,omitempty"`
+}
+
+type CheckDto struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
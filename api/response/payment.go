@@ -0,0 +1,40 @@
+package response
+
+type CreditPackDto struct {
+	Id      string `json:"id"`
+	Title   string `json:"title"`
+	Credits int    `json:"credits"`
+	Price   int    `json:"price"`          // in fen
+	Tier    string `json:"tier,omitempty"` // membership tier granted once paid
+	Days    int    `json:"days,omitempty"` // membership days of a tier pack
+}
+
+type OrderDto struct {
+	OutTradeNo string `json:"outTradeNo"`
+	PackId     string `json:"packId"`
+	Credits    int    `json:"credits"`
+	Amount     int    `json:"amount"` // in fen
+	Status     string `json:"status"` // CREATED, PAID or CLOSED
+	CreatedAt  int64  `json:"createdAt"`
+	PaidAt     int64  `json:"paidAt,omitempty"`
+}
+
+// PaymentDto 下单结果，payParams 直接传给 wx.requestPayment
+type PaymentDto struct {
+	Order     OrderDto     `json:"order"`
+	PayParams PayParamsDto `json:"payParams"`
+}
+
+type PayParamsDto struct {
+	TimeStamp string `json:"timeStamp"`
+	NonceStr  string `json:"nonceStr"`
+	Package   string `json:"package"`
+	SignType  string `json:"signType"`
+	PaySign   string `json:"paySign"`
+}
+
+// RedeemDto 兑换结果
+type RedeemDto struct {
+	Credits int `json:"credits"` // credits granted by the code
+	Balance int `json:"balance"` // purchased credits after redemption
+}
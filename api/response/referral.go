@@ -0,0 +1,15 @@
+package response
+
+type ReferralsDto struct {
+	InviteCode string        `json:"inviteCode"`
+	Rewarded   int           `json:"rewarded"` // referrals the inviter has been rewarded for
+	Referrals  []ReferralDto `json:"referrals"`
+}
+
+type ReferralDto struct {
+	Invitee    string `json:"invitee"` // masked openid of the invitee
+	NickName   string `json:"nickName"`
+	Status     string `json:"status"` // PENDING, REWARDED or CAPPED
+	CreatedAt  int64  `json:"createdAt"`
+	RewardedAt int64  `json:"rewardedAt,omitempty"`
+}
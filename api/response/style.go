@@ -0,0 +1,15 @@
+package response
+
+type StyleDto struct {
+	Id          uint   `json:"id"`
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	DefaultSize string `json:"defaultSize"`
+}
+
+// WildcardDto 动态描述中可引用的词表
+type WildcardDto struct {
+	Name    string   `json:"name"` // referenced as __name__
+	Count   int      `json:"count"`
+	Samples []string `json:"samples"`
+}
@@ -0,0 +1,13 @@
+package response
+
+type TaskEventDto struct {
+	TaskId   string   `json:"taskId"`
+	State    string   `json:"state"`              // ENHANCING, QUEUED, CALLING_PROVIDER, DOWNLOADING, STORED or FAILED
+	Position int      `json:"position,omitempty"` // position in the queue while QUEUED, starting from 1
+	Current  int      `json:"current,omitempty"`  // images stored so far while DOWNLOADING
+	Total    int      `json:"total,omitempty"`    // total images while DOWNLOADING
+	ErrCode  string   `json:"errCode,omitempty"`  // business code when FAILED
+	Output   []string `json:"output,omitempty"`   // generated image paths when STORED
+	Prompt   string   `json:"prompt,omitempty"`   // enhanced prompt when STORED, if enhancement was requested
+	Time     int64    `json:"time"`               // unix milli
+}
@@ -0,0 +1,15 @@
+package response
+
+// EntitlementsDto 用户当前会员等级下的额度与能力
+type EntitlementsDto struct {
+	Tier          string   `json:"tier"`                // free, member or pro
+	ExpiresAt     int64    `json:"expiresAt,omitempty"` // unix milli, empty for the free tier
+	DailyLimits   int      `json:"dailyLimits"`
+	MaxN          int      `json:"maxN"` // max images per generation
+	Sizes         []string `json:"sizes"`
+	Models        []string `json:"models"`
+	Priority      int      `json:"priority"`      // higher priority is served first when queuing
+	RetentionDays int      `json:"retentionDays"` // generated images are deleted after that, 0 means kept forever
+	Watermark     bool     `json:"watermark"`     // whether generated images carry the visible watermark
+	KeepOriginal  bool     `json:"keepOriginal"`  // whether the unwatermarked originals are kept
+}
@@ -0,0 +1,9 @@
+package response
+
+type WeChatLoginDto struct {
+	SessionKey string `json:"session_key"`
+	OpenId     string `json:"openid"`
+	UnionId    string `json:"unionid"`
+	ErrCode    int    `json:"errcode"`
+	ErrMsg     string `json:"errmsg"`
+}
@@ -0,0 +1,121 @@
+package apperror
+
+import (
+	"errors"
+	"net/http"
+)
+
+// stable business codes, the mini-program relies on them, never rename an existing one
+const (
+	CodeInvalidParams       string = "INVALID_PARAMS"
+	CodeInvalidSize         string = "INVALID_SIZE"
+	CodeUnauthorized        string = "UNAUTHORIZED"
+	CodeNotFound            string = "NOT_FOUND"
+	CodeTooManyRequests     string = "TOO_MANY_REQUESTS"
+	CodeQuotaExceeded       string = "QUOTA_EXCEEDED"
+	CodeNotEntitled         string = "NOT_ENTITLED"
+	CodeCouponInvalid       string = "COUPON_INVALID"
+	CodeCouponExpired       string = "COUPON_EXPIRED"
+	CodeCouponRedeemed      string = "COUPON_REDEEMED"
+	CodeBonusLimitReached   string = "BONUS_LIMIT_REACHED"
+	CodeAdNotVerified       string = "AD_NOT_VERIFIED"
+	CodeContentBlocked      string = "CONTENT_BLOCKED"
+	CodeImageReviewing      string = "IMAGE_REVIEWING"
+	CodeImageBlocked        string = "IMAGE_BLOCKED"
+	CodeProviderRejected    string = "PROVIDER_REJECTED"
+	CodeProviderRateLimited string = "PROVIDER_RATE_LIMITED"
+	CodeProviderTimeout     string = "PROVIDER_TIMEOUT"
+	CodeProviderUnavailable string = "PROVIDER_UNAVAILABLE"
+	CodeServiceUnavailable  string = "SERVICE_UNAVAILABLE"
+	CodeInternal            string = "INTERNAL_ERROR"
+)
+
+var statuses = map[string]int{
+	CodeInvalidParams:       http.StatusBadRequest,
+	CodeInvalidSize:         http.StatusBadRequest,
+	CodeUnauthorized:        http.StatusUnauthorized,
+	CodeNotFound:            http.StatusNotFound,
+	CodeTooManyRequests:     http.StatusTooManyRequests,
+	CodeQuotaExceeded:       http.StatusForbidden,
+	CodeNotEntitled:         http.StatusForbidden,
+	CodeCouponInvalid:       http.StatusBadRequest,
+	CodeCouponExpired:       http.StatusGone,
+	CodeCouponRedeemed:      http.StatusConflict,
+	CodeBonusLimitReached:   http.StatusForbidden,
+	CodeAdNotVerified:       http.StatusBadRequest,
+	CodeContentBlocked:      http.StatusUnprocessableEntity,
+	CodeImageReviewing:      http.StatusLocked,
+	CodeImageBlocked:        http.StatusUnavailableForLegalReasons,
+	CodeProviderRejected:    http.StatusBadGateway,
+	CodeProviderRateLimited: http.StatusTooManyRequests,
+	CodeProviderTimeout:     http.StatusGatewayTimeout,
+	CodeProviderUnavailable: http.StatusServiceUnavailable,
+	CodeServiceUnavailable:  http.StatusServiceUnavailable,
+	CodeInternal:            http.StatusInternalServerError,
+}
+
+// Error 带有稳定业务码的领域错误，Cause 只用于日志，不会返回给客户端；Detail 会附加在返回的提示之后，
+// 只能包含可以展示给用户的内容
+type Error struct {
+	Code   string
+	Cause  error
+	Detail string
+}
+
+func New(code string, cause error) *Error {
+	return &Error{Code: code, Cause: cause}
+}
+
+// WithDetail 创建带有展示给用户的补充信息的错误，例如不存在的词表名称
+func WithDetail(code string, cause error, detail string) *Error {
+	return &Error{Code: code, Cause: cause, Detail: detail}
+}
+
+func (e *Error) Error() string {
+	if e.Cause != nil {
+		return e.Code + ": " + e.Cause.Error()
+	}
+	return e.Code
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// Message 本地化的提示，带有 Detail 时附加在提示之后
+func (e *Error) Message(lang string) string {
+	if e.Detail == "" {
+		return Message(e.Code, lang)
+	}
+	return Message(e.Code, lang) + ": " + e.Detail
+}
+
+// Status 业务码对应的 http 状态码
+func (e *Error) Status() int {
+	if status, ok := statuses[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// From 从错误链中取出 *Error，取不到时按 fallbackStatus 推断一个业务码
+func From(err error, fallbackStatus int) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	switch fallbackStatus {
+	case http.StatusBadRequest:
+		return New(CodeInvalidParams, err)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return New(CodeUnauthorized, err)
+	case http.StatusNotFound:
+		return New(CodeNotFound, err)
+	case http.StatusTooManyRequests:
+		return New(CodeTooManyRequests, err)
+	case http.StatusServiceUnavailable:
+		return New(CodeServiceUnavailable, err)
+	default:
+		return New(CodeInternal, err)
+	}
+}
@@ -0,0 +1,118 @@
+package apperror
+
+import "golang.org/x/text/language"
+
+const (
+	langZh string = "zh-CN"
+	langEn string = "en"
+)
+
+var matcher = language.NewMatcher([]language.Tag{
+	language.SimplifiedChinese, // the first one is the fallback
+	language.English,
+})
+
+var messages = map[string]map[string]string{
+	CodeInvalidParams: {
+		langZh: "请求参数有误",
+		langEn: "Invalid request parameters",
+	},
+	CodeInvalidSize: {
+		langZh: "不支持的图片尺寸",
+		langEn: "Unsupported image size",
+	},
+	CodeUnauthorized: {
+		langZh: "登录已失效，请重新登录",
+		langEn: "Not logged in or the session has expired",
+	},
+	CodeNotFound: {
+		langZh: "请求的资源不存在",
+		langEn: "The requested resource does not exist",
+	},
+	CodeTooManyRequests: {
+		langZh: "请求过于频繁，请稍后再试",
+		langEn: "Too many requests, please try again later",
+	},
+	CodeQuotaExceeded: {
+		langZh: "今日生成次数已用完",
+		langEn: "You have used up today's generation quota",
+	},
+	CodeNotEntitled: {
+		langZh: "当前会员等级不支持该功能，升级后可使用",
+		langEn: "Your membership tier does not include this feature",
+	},
+	CodeCouponInvalid: {
+		langZh: "兑换码无效",
+		langEn: "Invalid redeem code",
+	},
+	CodeCouponExpired: {
+		langZh: "兑换码已过期或已被领完",
+		langEn: "The redeem code has expired or been used up",
+	},
+	CodeCouponRedeemed: {
+		langZh: "你已兑换过该活动的兑换码",
+		langEn: "You have already redeemed a code of this event",
+	},
+	CodeBonusLimitReached: {
+		langZh: "今日奖励次数已领完，明天再来吧",
+		langEn: "You have claimed all of today's rewards, come back tomorrow",
+	},
+	CodeAdNotVerified: {
+		langZh: "未能确认广告播放完成，请重新观看",
+		langEn: "The ad view could not be verified, please watch it again",
+	},
+	CodeContentBlocked: {
+		langZh: "描述内容不符合安全规范，请修改后重试",
+		langEn: "The content was blocked by the safety system, please revise it",
+	},
+	CodeImageReviewing: {
+		langZh: "图片正在审核中，请稍后查看",
+		langEn: "The image is under review, please check back later",
+	},
+	CodeImageBlocked: {
+		langZh: "图片未通过内容安全审核",
+		langEn: "The image did not pass the content safety review",
+	},
+	CodeProviderRejected: {
+		langZh: "图片服务拒绝了本次请求",
+		langEn: "The image service rejected the request",
+	},
+	CodeProviderRateLimited: {
+		langZh: "图片服务繁忙，请稍后再试",
+		langEn: "The image service is busy, please try again later",
+	},
+	CodeProviderTimeout: {
+		langZh: "图片服务响应超时，请稍后再试",
+		langEn: "The image service timed out, please try again later",
+	},
+	CodeProviderUnavailable: {
+		langZh: "图片服务暂不可用，请稍后再试",
+		langEn: "The image service is temporarily unavailable",
+	},
+	CodeServiceUnavailable: {
+		langZh: "服务暂不可用，请稍后再试",
+		langEn: "Service temporarily unavailable, please try again later",
+	},
+	CodeInternal: {
+		langZh: "服务器内部错误",
+		langEn: "Internal server error",
+	},
+}
+
+// Lang 根据 Accept-Language 选择消息语言，默认简体中文
+func Lang(acceptLanguage string) string {
+	tags, _, _ := language.ParseAcceptLanguage(acceptLanguage)
+	_, index, _ := matcher.Match(tags...)
+	if index == 1 {
+		return langEn
+	}
+	return langZh
+}
+
+// Message 返回业务码在指定语言下的提示信息
+func Message(code string, lang string) string {
+	if msgs, ok := messages[code]; ok {
+		return msgs[lang]
+	}
+	return messages[CodeInternal][lang]
+}
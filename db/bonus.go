@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrBonusLimitReached = errors.New("bonus limit of the period reached")
+
+// 签到与激励视频奖励均记入当天的每日额度，随每日额度一起过期
+type BonusMapper struct {
+}
+
+func NewBonusMapper() BonusMapper {
+	return BonusMapper{}
+}
+
+// CheckIn 记录签到并发放奖励，连续天数与奖励由调用方计算。当天已签到时返回已有的记录及 false
+func (mapper *BonusMapper) CheckIn(ctx context.Context, openId string, period string, streak int, bonus int) (CheckIn, bool, error) {
+	checkIn := CheckIn{}
+	created := false
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		result := tx.Where("uid = ? and period = ?", user.ID, period).Limit(1).Find(&checkIn)
+		if result.Error != nil || result.RowsAffected != 0 {
+			return result.Error
+		}
+		checkIn = CheckIn{Uid: user.ID, Period: period, Streak: streak, Bonus: bonus}
+		checkIn.CreatedTime = time.Now()
+		checkIn.ModifiedTime = checkIn.CreatedTime
+		if err := tx.Create(&checkIn).Error; err != nil {
+			return err
+		}
+		created = true
+		if bonus <= 0 {
+			return nil
+		}
+		key := "checkin-" + strconv.FormatUint(uint64(user.ID), 10) + "-" + period
+		return appendEntry(tx, &LedgerEntry{
+			Uid:     user.ID,
+			Kind:    LedgerGrant,
+			Bucket:  BucketDaily,
+			Period:  period,
+			Amount:  bonus,
+			RefType: RefCheckIn,
+			RefId:   strconv.FormatUint(uint64(checkIn.ID), 10),
+			Key:     &key,
+		})
+	})
+	return checkIn, created, err
+}
+
+// FetchLastCheckIn 用户最近一次签到，从未签到时返回零值
+func (mapper *BonusMapper) FetchLastCheckIn(ctx context.Context, openId string) (CheckIn, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return CheckIn{}, result.Error
+	}
+	checkIn := CheckIn{}
+	result := tx.Where("uid = ?", user.ID).Order("period desc").Limit(1).Find(&checkIn)
+	return checkIn, result.Error
+}
+
+// CountAdRewards 用户在 period 内已领取的激励视频奖励次数
+func (mapper *BonusMapper) CountAdRewards(ctx context.Context, openId string, period string) (int, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return 0, result.Error
+	}
+	return countAdRewards(tx, user.ID, period)
+}
+
+func countAdRewards(tx *gorm.DB, uid uint, period string) (int, error) {
+	var count int64
+	result := tx.Model(&LedgerEntry{}).
+		Where("uid = ? and ref_type = ? and period = ? and kind = ?", uid, RefAd, period, LedgerGrant).
+		Count(&count)
+	return int(count), result.Error
+}
+
+// RewardAd 为一次看完的激励视频发放奖励，nonce 保证同一次观看只发放一次，返回 period 内剩余的可领取次数
+func (mapper *BonusMapper) RewardAd(ctx context.Context, openId string, period string, nonce string, amount int, dailyLimit int) (int, error) {
+	remaining := 0
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		count, err := countAdRewards(tx, user.ID, period)
+		if err != nil {
+			return err
+		}
+		if count >= dailyLimit {
+			return ErrBonusLimitReached
+		}
+		key := "ad-" + nonce
+		if err := appendEntry(tx, &LedgerEntry{
+			Uid:     user.ID,
+			Kind:    LedgerGrant,
+			Bucket:  BucketDaily,
+			Period:  period,
+			Amount:  amount,
+			RefType: RefAd,
+			RefId:   nonce,
+			Key:     &key,
+		}); err != nil {
+			return err
+		}
+		remaining = dailyLimit - count - 1
+		return nil
+	})
+	return remaining, err
+}
@@ -10,6 +10,9 @@ import (
 
 var dbInstance *gorm.DB
 
+// ErrRecordNotFound 查询不到记录时返回的错误，调用方应使用 errors.Is 判断
+var ErrRecordNotFound = gorm.ErrRecordNotFound
+
 func init() {
 	log.Println("validating db connections env injections")
 	dbPath := os.Getenv("SQLITE_DB_PATH")
@@ -22,4 +25,14 @@ func init() {
 	if err != nil {
 		log.Fatalln("open sqlite failed")
 	}
+	registerTracingCallbacks(dbInstance)
+	if err = dbInstance.AutoMigrate(&User{}, &Record{}, &Task{}, &Order{}, &LedgerEntry{}, &Referral{},
+		&CouponBatch{}, &Coupon{}, &CouponRedemption{}, &CheckIn{}, &Style{}, &Wildcard{},
+		&Publication{}, &Like{}, &Blob{}, &ImageFile{},
+		&MediaCheck{}, &Subscription{}, &Notification{}); err != nil {
+		log.Fatalln("migrate sqlite failed, the error is", err)
+	}
+	if err = backfillPublishedTime(dbInstance); err != nil {
+		log.Fatalln("backfill the published time failed, the error is", err)
+	}
 }
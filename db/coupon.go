@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrCouponNotFound = errors.New("coupon not found")
+	ErrCouponExpired  = errors.New("coupon expired")
+	ErrCouponUsedUp   = errors.New("coupon used up")
+	ErrCouponRedeemed = errors.New("coupon batch already redeemed by the user")
+)
+
+// CouponBatchReport 批次的兑换统计
+type CouponBatchReport struct {
+	CouponBatch
+	Codes      int // codes in the batch
+	Redeemed   int // total redemptions
+	UsedUpCode int // codes that reached max uses
+}
+
+type CouponMapper struct {
+}
+
+func NewCouponMapper() CouponMapper {
+	return CouponMapper{}
+}
+
+// MintBatch 创建批次及其兑换码
+func (mapper *CouponMapper) MintBatch(ctx context.Context, batch CouponBatch, codes []string) (CouponBatch, error) {
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		batch.CreatedTime = time.Now()
+		batch.ModifiedTime = batch.CreatedTime
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+		coupons := make([]Coupon, len(codes))
+		for i, code := range codes {
+			coupons[i] = Coupon{BatchId: batch.ID, Code: code}
+			coupons[i].CreatedTime = batch.CreatedTime
+			coupons[i].ModifiedTime = batch.CreatedTime
+		}
+		return tx.CreateInBatches(coupons, 500).Error
+	})
+	return batch, err
+}
+
+// Redeem 在同一事务中校验兑换码、记录兑换并记入已购次数，返回批次信息
+func (mapper *CouponMapper) Redeem(ctx context.Context, openId string, code string) (CouponBatch, error) {
+	batch := CouponBatch{}
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		coupon := Coupon{}
+		if result := tx.Where("code = ?", code).Limit(1).Find(&coupon); result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return ErrCouponNotFound
+		}
+		if result := tx.First(&batch, coupon.BatchId); result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		if !batch.ExpiredTime.After(now) {
+			return ErrCouponExpired
+		}
+		var count int64
+		if result := tx.Model(&CouponRedemption{}).Where("batch_id = ? and uid = ?", batch.ID, user.ID).Count(&count); result.Error != nil {
+			return result.Error
+		} else if count > 0 {
+			return ErrCouponRedeemed
+		}
+		// the uses condition keeps concurrent redemptions from exceeding max uses
+		result := tx.Model(&Coupon{}).Where("id = ? and uses < ?", coupon.ID, batch.MaxUses).
+			Updates(map[string]any{"uses": gorm.Expr("uses + 1"), "modified_time": now})
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return ErrCouponUsedUp
+		}
+		redemption := CouponRedemption{BatchId: batch.ID, Uid: user.ID, CouponId: coupon.ID}
+		redemption.CreatedTime = now
+		redemption.ModifiedTime = now
+		if err := tx.Create(&redemption).Error; err != nil {
+			return err
+		}
+		key := "coupon-" + strconv.FormatUint(uint64(redemption.ID), 10)
+		return appendEntry(tx, &LedgerEntry{
+			Uid:     user.ID,
+			Kind:    LedgerGrant,
+			Bucket:  BucketPaid,
+			Amount:  batch.Credits,
+			RefType: RefCoupon,
+			RefId:   code,
+			Key:     &key,
+		})
+	})
+	return batch, err
+}
+
+// Report 统计所有批次的兑换情况，按创建时间倒序
+func (mapper *CouponMapper) Report(ctx context.Context) ([]CouponBatchReport, error) {
+	reports := []CouponBatchReport{}
+	result := dbInstance.WithContext(ctx).Model(&CouponBatch{}).
+		Select("coupon_batches.*, count(coupons.id) as codes, coalesce(sum(coupons.uses), 0) as redeemed, " +
+			"coalesce(sum(case when coupons.uses >= coupon_batches.max_uses then 1 else 0 end), 0) as used_up_code").
+		Joins("left join coupons on coupons.batch_id = coupon_batches.id").
+		Group("coupon_batches.id").
+		Order("coupon_batches.created_time desc").
+		Scan(&reports)
+	return reports, result.Error
+}
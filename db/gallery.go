@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PublicationView 画廊中的一项，带有生成记录及作者信息
+type PublicationView struct {
+	Publication
+	Type     string // PROMPT or VARIATION
+	Input    string // prompt text or variation origin image path
+	Output   string // generated image paths in json
+	NickName string // author nickname
+	Score    int    // likes within the trending window, only set by FetchTrending
+}
+
+type GalleryMapper struct {
+}
+
+func NewGalleryMapper() GalleryMapper {
+	return GalleryMapper{}
+}
+
+func publicationViews(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&Publication{}).
+		Select("publications.*, records.type, records.input, records.output, users.nick_name").
+		Joins("join records on records.id = publications.record_id").
+		Joins("left join users on users.id = publications.uid").
+		Where("publications.published = ?", true)
+}
+
+// Publish 发布用户自己的生成记录，重新发布时更换 token 使旧链接失效，已发布时直接返回
+func (mapper *GalleryMapper) Publish(ctx context.Context, openId string, recordId uint, token string) (Publication, error) {
+	publication := Publication{}
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		record := Record{}
+		if result := tx.Where("id = ? and uid = ?", recordId, user.ID).First(&record); result.Error != nil {
+			return result.Error
+		}
+		result := tx.Where("record_id = ?", record.ID).Limit(1).Find(&publication)
+		if result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		if result.RowsAffected == 0 {
+			publication = Publication{RecordId: record.ID, Uid: user.ID, Token: token, Published: true, PublishedTime: now}
+			publication.CreatedTime = now
+			publication.ModifiedTime = now
+			return tx.Create(&publication).Error
+		}
+		if publication.Published {
+			return nil
+		}
+		publication.Token = token
+		publication.Published = true
+		publication.PublishedTime = now
+		publication.ModifiedTime = now
+		return tx.Save(&publication).Error
+	})
+	return publication, err
+}
+
+// Unpublish 取消发布，返回是否找到用户自己的该作品
+func (mapper *GalleryMapper) Unpublish(ctx context.Context, openId string, token string) (bool, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return false, result.Error
+	}
+	result := tx.Model(&Publication{}).Where("token = ? and uid = ? and published = ?", token, user.ID, true).
+		Updates(map[string]any{"published": false, "modified_time": time.Now()})
+	return result.RowsAffected != 0, result.Error
+}
+
+// FetchByToken 查询已发布的作品
+func (mapper *GalleryMapper) FetchByToken(ctx context.Context, token string) (PublicationView, error) {
+	view := PublicationView{}
+	result := publicationViews(dbInstance.WithContext(ctx)).Where("publications.token = ?", token).Limit(1).Scan(&view)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return view, ErrRecordNotFound
+	}
+	return view, result.Error
+}
+
+// FetchLatest 按最近一次发布的时间倒序分页，after 为上一页最后一项，首页传 nil
+func (mapper *GalleryMapper) FetchLatest(ctx context.Context, after *PublicationView, limit int) ([]PublicationView, error) {
+	tx := publicationViews(dbInstance.WithContext(ctx))
+	if after != nil {
+		tx = tx.Where("publications.published_time < ? or (publications.published_time = ? and publications.id < ?)",
+			after.PublishedTime, after.PublishedTime, after.ID)
+	}
+	views := []PublicationView{}
+	result := tx.Order("publications.published_time desc, publications.id desc").Limit(limit).Scan(&views)
+	return views, result.Error
+}
+
+// backfillPublishedTime 为新增 published_time 字段之前发布的作品补上发布时间
+func backfillPublishedTime(tx *gorm.DB) error {
+	return tx.Model(&Publication{}).Where("published_time is null").
+		Update("published_time", gorm.Expr("modified_time")).Error
+}
+
+// FetchTrending 按 since 之后的点赞数倒序分页，after 为上一页最后一项，首页传 nil
+func (mapper *GalleryMapper) FetchTrending(ctx context.Context, since time.Time, after *PublicationView, limit int) ([]PublicationView, error) {
+	tx := dbInstance.WithContext(ctx)
+	scored := publicationViews(tx).
+		Select("publications.*, records.type, records.input, records.output, users.nick_name, "+
+			"(select count(*) from likes where likes.publication_id = publications.id and likes.created_time >= ?) as score", since)
+	query := tx.Table("(?) as t", scored)
+	if after != nil {
+		query = query.Where("score < ? or (score = ? and id < ?)", after.Score, after.Score, after.ID)
+	}
+	views := []PublicationView{}
+	result := query.Order("score desc, id desc").Limit(limit).Scan(&views)
+	return views, result.Error
+}
+
+// Like 点赞，已点赞时返回 false
+func (mapper *GalleryMapper) Like(ctx context.Context, openId string, token string) (bool, error) {
+	return mapper.toggleLike(ctx, openId, token, true)
+}
+
+// Unlike 取消点赞，未点赞时返回 false
+func (mapper *GalleryMapper) Unlike(ctx context.Context, openId string, token string) (bool, error) {
+	return mapper.toggleLike(ctx, openId, token, false)
+}
+
+func (mapper *GalleryMapper) toggleLike(ctx context.Context, openId string, token string, like bool) (bool, error) {
+	changed := false
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		publication := Publication{}
+		if result := tx.Where("token = ? and published = ?", token, true).First(&publication); result.Error != nil {
+			return result.Error
+		}
+		var result *gorm.DB
+		delta := 1
+		if like {
+			record := Like{PublicationId: publication.ID, Uid: user.ID}
+			record.CreatedTime = time.Now()
+			record.ModifiedTime = record.CreatedTime
+			result = tx.Where(Like{PublicationId: publication.ID, Uid: user.ID}).FirstOrCreate(&record)
+		} else {
+			delta = -1
+			result = tx.Where("publication_id = ? and uid = ?", publication.ID, user.ID).Delete(&Like{})
+		}
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		changed = true
+		return tx.Model(&Publication{}).Where("id = ?", publication.ID).
+			Update("likes", gorm.Expr("likes + ?", delta)).Error
+	})
+	return changed, err
+}
+
+// FetchLikedIds 用户点赞过的作品 id
+func (mapper *GalleryMapper) FetchLikedIds(ctx context.Context, openId string, publicationIds []uint) (map[uint]bool, error) {
+	liked := map[uint]bool{}
+	if len(publicationIds) == 0 {
+		return liked, nil
+	}
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return liked, result.Error
+	}
+	ids := []uint{}
+	result := tx.Model(&Like{}).Where("uid = ? and publication_id in ?", user.ID, publicationIds).Pluck("publication_id", &ids)
+	for _, id := range ids {
+		liked[id] = true
+	}
+	return liked, result.Error
+}
@@ -0,0 +1,9 @@
+package db
+
+import "context"
+
+// Ping 执行一次最简单的查询，用于就绪检查
+func Ping(ctx context.Context) error {
+	var one int
+	return dbInstance.WithContext(ctx).Raw("select 1").Scan(&one).Error
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SourceUploaded  = "UPLOADED"
+	SourceGenerated = "GENERATED"
+)
+
+type ImageMapper struct {
+}
+
+func NewImageMapper() ImageMapper {
+	return ImageMapper{}
+}
+
+// SaveUpload 将上传的路径指向内容为 file.Sha256 的 blob，blob 不存在时以 blobPath 创建，返回 blob 及其是否为新建。
+// 路径原先指向其他内容时释放对原 blob 的引用
+func (mapper *ImageMapper) SaveUpload(ctx context.Context, openId string, file ImageFile, blobPath string) (Blob, bool, error) {
+	blob := Blob{}
+	created := false
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		result := tx.Where("sha256 = ?", file.Sha256).Limit(1).Find(&blob)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			blob = Blob{Sha256: file.Sha256, Path: blobPath}
+			blob.CreatedTime = now
+			blob.ModifiedTime = now
+			if err := tx.Create(&blob).Error; err != nil {
+				return err
+			}
+			created = true
+		}
+		existing := ImageFile{}
+		result = tx.Where("path = ?", file.Path).Limit(1).Find(&existing)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 0 && existing.BlobId == blob.ID {
+			return nil
+		}
+		if result.RowsAffected != 0 && existing.BlobId != 0 {
+			if err := release(tx, existing.BlobId); err != nil {
+				return err
+			}
+		}
+		file.ID = existing.ID
+		file.CreatedTime = existing.CreatedTime
+		if file.ID == 0 {
+			file.CreatedTime = now
+		}
+		file.ModifiedTime = now
+		file.Uid = user.ID
+		file.Source = SourceUploaded
+		file.BlobId = blob.ID
+		if err := tx.Save(&file).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Blob{}).Where("id = ?", blob.ID).
+			Updates(map[string]any{"ref_count": gorm.Expr("ref_count + 1"), "modified_time": now}).Error
+	})
+	return blob, created, err
+}
+
+func release(tx *gorm.DB, blobId uint) error {
+	return tx.Model(&Blob{}).Where("id = ?", blobId).
+		Updates(map[string]any{"ref_count": gorm.Expr("ref_count - 1"), "modified_time": time.Now()}).Error
+}
+
+// SaveGenerated 记录生成图片的哈希，生成的图片存放在自己的路径下
+func (mapper *ImageMapper) SaveGenerated(ctx context.Context, openId string, file ImageFile) error {
+	return dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		file.Uid = user.ID
+		file.Source = SourceGenerated
+		file.CreatedTime = time.Now()
+		file.ModifiedTime = file.CreatedTime
+		return tx.Create(&file).Error
+	})
+}
+
+// ResolvePath 路径实际存放内容的位置，未记录的路径按原路径存放
+func (mapper *ImageMapper) ResolvePath(ctx context.Context, path string) (string, error) {
+	var blobPath string
+	result := dbInstance.WithContext(ctx).Model(&ImageFile{}).
+		Select("blobs.path").
+		Joins("join blobs on blobs.id = image_files.blob_id").
+		Where("image_files.path = ?", path).
+		Limit(1).Scan(&blobPath)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return path, result.Error
+	}
+	return blobPath, nil
+}
+
+// FetchByPath 查询路径的哈希记录
+func (mapper *ImageMapper) FetchByPath(ctx context.Context, path string) (ImageFile, error) {
+	file := ImageFile{}
+	result := dbInstance.WithContext(ctx).Where("path = ?", path).First(&file)
+	return file, result.Error
+}
+
+// FetchByUser 用户所有图片的哈希记录
+func (mapper *ImageMapper) FetchByUser(ctx context.Context, uid uint) ([]ImageFile, error) {
+	files := []ImageFile{}
+	result := dbInstance.WithContext(ctx).Where("uid = ?", uid).Find(&files)
+	return files, result.Error
+}
+
+// DeleteByPaths 删除路径的哈希记录并释放对 blob 的引用
+func (mapper *ImageMapper) DeleteByPaths(ctx context.Context, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		files := []ImageFile{}
+		if err := tx.Where("path in ?", paths).Find(&files).Error; err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.BlobId != 0 {
+				if err := release(tx, f.BlobId); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Where("path in ?", paths).Delete(&ImageFile{}).Error
+	})
+}
+
+// PurgeBlob 删除在 before 之前就已不再被引用的 blob，返回是否删除，删除后由调用方删除文件
+func (mapper *ImageMapper) PurgeBlob(ctx context.Context, blob Blob, before time.Time) (bool, error) {
+	result := dbInstance.WithContext(ctx).Where("id = ? and ref_count <= 0 and modified_time < ?", blob.ID, before).Delete(&Blob{})
+	return result.RowsAffected != 0, result.Error
+}
+
+// FetchUnreferencedBlobs 查询在 before 之前就已不再被引用的 blob
+func (mapper *ImageMapper) FetchUnreferencedBlobs(ctx context.Context, before time.Time) ([]Blob, error) {
+	blobs := []Blob{}
+	result := dbInstance.WithContext(ctx).Where("ref_count <= 0 and modified_time < ?", before).Find(&blobs)
+	return blobs, result.Error
+}
@@ -0,0 +1,302 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	LedgerGrant    string = "GRANT"
+	LedgerPurchase string = "PURCHASE"
+	LedgerConsume  string = "CONSUME"
+	LedgerRefund   string = "REFUND"
+	LedgerExpire   string = "EXPIRE"
+	BucketDaily    string = "DAILY"
+	BucketPaid     string = "PAID"
+	RefOrder       string = "ORDER"
+	RefRecord      string = "RECORD"
+	RefGeneration  string = "GENERATION" // quota reserved before calling the provider, moved to RECORD once the record is saved
+	RefAdmin       string = "ADMIN"
+	RefReferral    string = "REFERRAL"
+	RefCoupon      string = "COUPON"
+	RefCheckIn     string = "CHECKIN"
+	RefAd          string = "AD"
+)
+
+// Balance 由流水汇总得出的用户额度
+type Balance struct {
+	DailyGranted  int // granted daily quota in the current period, expiries deducted
+	DailyConsumed int // consumed daily quota in the current period, refunds deducted
+	Paid          int // remaining purchased credits
+}
+
+func (b Balance) DailyRemaining() int {
+	return b.DailyGranted - b.DailyConsumed
+}
+
+// Fields 按缓存中的顺序返回各项额度：每日已发放、每日已使用、已购余额
+func (b Balance) Fields() []int {
+	return []int{b.DailyGranted, b.DailyConsumed, b.Paid}
+}
+
+// Drifted 对比按 Fields 顺序缓存的值，返回与流水不一致的下标，缺失（nil）的缓存会在读取时重建，不算作不一致
+func (b Balance) Drifted(cached []*string) []int {
+	drifted := []int{}
+	for i, expected := range b.Fields() {
+		if i < len(cached) && cached[i] != nil && *cached[i] != strconv.Itoa(expected) {
+			drifted = append(drifted, i)
+		}
+	}
+	return drifted
+}
+
+type LedgerMapper struct {
+}
+
+func NewLedgerMapper() LedgerMapper {
+	return LedgerMapper{}
+}
+
+// appendEntry 追加一条流水，带有幂等键且已存在时静默忽略
+func appendEntry(tx *gorm.DB, entry *LedgerEntry) error {
+	entry.CreatedTime = time.Now()
+	entry.ModifiedTime = entry.CreatedTime
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(entry).Error
+}
+
+// Append 为用户追加一条流水
+func (mapper *LedgerMapper) Append(ctx context.Context, openId string, entry LedgerEntry) error {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return result.Error
+	}
+	entry.Uid = user.ID
+	return appendEntry(tx, &entry)
+}
+
+// EnsureDailyGrant 确保用户在 period 内已获得每日额度，同一周期只会发放一次
+func (mapper *LedgerMapper) EnsureDailyGrant(ctx context.Context, openId string, period string, amount int) error {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return result.Error
+	}
+	return ensureDailyGrant(tx, user.ID, period, amount)
+}
+
+func ensureDailyGrant(tx *gorm.DB, uid uint, period string, amount int) error {
+	key := "daily-" + strconv.FormatUint(uint64(uid), 10) + "-" + period
+	return appendEntry(tx, &LedgerEntry{
+		Uid:    uid,
+		Kind:   LedgerGrant,
+		Bucket: BucketDaily,
+		Period: period,
+		Amount: amount,
+		Key:    &key,
+	})
+}
+
+// FetchBalance 汇总用户在 period 内的每日额度与已购次数余额
+func (mapper *LedgerMapper) FetchBalance(ctx context.Context, openId string, period string) (Balance, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return Balance{}, result.Error
+	}
+	return fetchBalance(tx, user.ID, period)
+}
+
+func fetchBalance(tx *gorm.DB, uid uint, period string) (Balance, error) {
+	type row struct {
+		Bucket string
+		Kind   string
+		Total  int
+	}
+	rows := []row{}
+	result := tx.Model(&LedgerEntry{}).
+		Select("bucket, kind, sum(amount) as total").
+		Where("uid = ? and (bucket = ? or (bucket = ? and period = ?))", uid, BucketPaid, BucketDaily, period).
+		Group("bucket, kind").
+		Scan(&rows)
+	if result.Error != nil {
+		return Balance{}, result.Error
+	}
+	balance := Balance{}
+	for _, r := range rows {
+		switch {
+		case r.Bucket == BucketPaid:
+			balance.Paid += r.Total
+		case r.Kind == LedgerConsume || r.Kind == LedgerRefund:
+			balance.DailyConsumed -= r.Total
+		default:
+			// expired quota is deducted from the granted amount
+			balance.DailyGranted += r.Total
+		}
+	}
+	return balance, nil
+}
+
+// Consume 在同一事务中计算余额并扣减一次额度，优先使用每日额度，返回扣减的额度类型，余额不足时返回空字符串。
+// 同一 refType/refId 只会扣减一次，重复调用返回首次扣减的额度类型
+func (mapper *LedgerMapper) Consume(ctx context.Context, openId string, period string, refType string, refId string) (string, error) {
+	bucket := ""
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		key := "consume-" + strconv.FormatUint(uint64(user.ID), 10) + "-" + refType + "-" + refId
+		consumed := LedgerEntry{}
+		if result := tx.Where(&LedgerEntry{Key: &key}).Limit(1).Find(&consumed); result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected > 0 {
+			bucket = consumed.Bucket
+			return nil
+		}
+		balance, err := fetchBalance(tx, user.ID, period)
+		if err != nil {
+			return err
+		}
+		entry := LedgerEntry{Uid: user.ID, Kind: LedgerConsume, Amount: -1, RefType: refType, RefId: refId, Key: &key}
+		switch {
+		case balance.DailyRemaining() > 0:
+			entry.Bucket = BucketDaily
+			entry.Period = period
+		case balance.Paid > 0:
+			entry.Bucket = BucketPaid
+		default:
+			return nil
+		}
+		if err := appendEntry(tx, &entry); err != nil {
+			return err
+		}
+		bucket = entry.Bucket
+		return nil
+	})
+	return bucket, err
+}
+
+// Refund 退还一次因 refType/refId 产生的扣减，按原扣减的额度类型退回，重复调用只会退还一次
+func (mapper *LedgerMapper) Refund(ctx context.Context, openId string, refType string, refId string) (bool, error) {
+	refunded := false
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		consumed := LedgerEntry{}
+		result := tx.Where("uid = ? and kind = ? and ref_type = ? and ref_id = ?", user.ID, LedgerConsume, refType, refId).First(&consumed)
+		if result.Error != nil {
+			return result.Error
+		}
+		key := "refund-" + refType + "-" + refId
+		entry := LedgerEntry{
+			Uid:     user.ID,
+			Kind:    LedgerRefund,
+			Bucket:  consumed.Bucket,
+			Period:  consumed.Period,
+			Amount:  -consumed.Amount,
+			RefType: refType,
+			RefId:   refId,
+			Key:     &key,
+		}
+		if err := appendEntry(tx, &entry); err != nil {
+			return err
+		}
+		refunded = entry.ID != 0
+		return nil
+	})
+	return refunded, err
+}
+
+// RefundBlockedImage 按未通过审核的图片比例退还记录的扣减，未通过的图片不计费：
+// 记录累计退还 consumed × blocked / N 并向上取整，因此任意一张图片未通过都至少退还一次，全部未通过时恰好退还整次扣减。
+// 每张图片以审核条目 id 作为幂等键，返回图片所属的用户及本次退还的额度
+func (mapper *LedgerMapper) RefundBlockedImage(ctx context.Context, checkId uint) (uint, int, error) {
+	uid, refunded := uint(0), 0
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		check := MediaCheck{}
+		if err := tx.First(&check, checkId).Error; err != nil {
+			return err
+		}
+		uid = check.Uid
+		checks := []MediaCheck{}
+		if err := tx.Where("record_id = ?", check.RecordId).Find(&checks).Error; err != nil {
+			return err
+		}
+		blocked := 0
+		for _, c := range checks {
+			if c.Status != CheckPass && c.Status != CheckReviewing {
+				blocked++
+			}
+		}
+		refId := strconv.FormatUint(uint64(check.RecordId), 10)
+		consumed := LedgerEntry{}
+		result := tx.Where("uid = ? and kind = ? and ref_type = ? and ref_id = ?", uid, LedgerConsume, RefRecord, refId).First(&consumed)
+		if result.Error != nil {
+			return result.Error
+		}
+		var total int
+		result = tx.Model(&LedgerEntry{}).Select("coalesce(sum(amount), 0)").
+			Where("uid = ? and kind = ? and ref_type = ? and ref_id = ?", uid, LedgerRefund, RefRecord, refId).Scan(&total)
+		if result.Error != nil {
+			return result.Error
+		}
+		n := len(checks)
+		due := (-consumed.Amount*blocked+n-1)/n - total
+		if due <= 0 {
+			return nil
+		}
+		key := "refund-check-" + strconv.FormatUint(uint64(check.ID), 10)
+		entry := LedgerEntry{
+			Uid:     uid,
+			Kind:    LedgerRefund,
+			Bucket:  consumed.Bucket,
+			Period:  consumed.Period,
+			Amount:  due,
+			RefType: RefRecord,
+			RefId:   refId,
+			Key:     &key,
+		}
+		if err := appendEntry(tx, &entry); err != nil {
+			return err
+		}
+		if entry.ID != 0 {
+			refunded = due
+		}
+		return nil
+	})
+	return uid, refunded, err
+}
+
+// ExpireDailyPeriod 为 period 内每日额度仍有剩余的用户记录过期流水，重复调用是安全的
+func (mapper *LedgerMapper) ExpireDailyPeriod(ctx context.Context, period string) (int, error) {
+	type row struct {
+		Uid   uint
+		Total int
+	}
+	rows := []row{}
+	tx := dbInstance.WithContext(ctx)
+	result := tx.Model(&LedgerEntry{}).
+		Select("uid, sum(amount) as total").
+		Where("bucket = ? and period = ?", BucketDaily, period).
+		Group("uid").
+		Having("sum(amount) > 0").
+		Scan(&rows)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	for _, r := range rows {
+		key := "expire-" + period + "-" + strconv.FormatUint(uint64(r.Uid), 10)
+		entry := LedgerEntry{Uid: r.Uid, Kind: LedgerExpire, Bucket: BucketDaily, Period: period, Amount: -r.Total, Key: &key}
+		if err := appendEntry(tx, &entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
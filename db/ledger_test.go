@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// the tests run against a shared in-memory sqlite, the env is set before init opens the connection
+var _ = os.Setenv("SQLITE_DB_PATH", "file::memory:?cache=shared")
+
+func newTestUser(t *testing.T) string {
+	t.Helper()
+	openId := "open-id-" + t.Name()
+	if err := dbInstance.Create(&User{OpenId: openId}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return openId
+}
+
+func fetchTestBalance(t *testing.T, openId string, period string) Balance {
+	t.Helper()
+	mapper := NewLedgerMapper()
+	balance, err := mapper.FetchBalance(context.Background(), openId, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestEnsureDailyGrant(t *testing.T) {
+	ctx := context.Background()
+	mapper := NewLedgerMapper()
+	openId := newTestUser(t)
+	for i := 0; i < 2; i++ {
+		if err := mapper.EnsureDailyGrant(ctx, openId, "2026-01-01", 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance := fetchTestBalance(t, openId, "2026-01-01"); balance != (Balance{DailyGranted: 5}) {
+		t.Fatalf("daily quota is granted more than once, balance: %+v", balance)
+	}
+	// a new period has its own grant, the previous one does not count
+	if err := mapper.EnsureDailyGrant(ctx, openId, "2026-01-02", 3); err != nil {
+		t.Fatal(err)
+	}
+	if balance := fetchTestBalance(t, openId, "2026-01-02"); balance != (Balance{DailyGranted: 3}) {
+		t.Fatalf("unexpected balance of the next period %+v", balance)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	ctx := context.Background()
+	mapper := NewLedgerMapper()
+	openId := newTestUser(t)
+	const period = "2026-01-03"
+	if err := mapper.EnsureDailyGrant(ctx, openId, period, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := mapper.Append(ctx, openId, LedgerEntry{Kind: LedgerPurchase, Bucket: BucketPaid, Amount: 1, RefType: RefOrder, RefId: "order-1"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		refId  string
+		bucket string
+	}{
+		{refId: "r1", bucket: BucketDaily},
+		{refId: "r1", bucket: BucketDaily}, // repeated, not consumed again
+		{refId: "r2", bucket: BucketPaid},
+		{refId: "r3", bucket: ""},
+	}
+	for _, tt := range tests {
+		bucket, err := mapper.Consume(ctx, openId, period, RefGeneration, tt.refId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bucket != tt.bucket {
+			t.Fatalf("consume %s from %q, want %q", tt.refId, bucket, tt.bucket)
+		}
+	}
+	if balance := fetchTestBalance(t, openId, period); balance != (Balance{DailyGranted: 1, DailyConsumed: 1}) {
+		t.Fatalf("unexpected balance after consuming %+v", balance)
+	}
+	if _, err := mapper.Consume(ctx, "unknown-open-id", period, RefGeneration, "r4"); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("consume for an unknown user, the error is %v", err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	ctx := context.Background()
+	mapper := NewLedgerMapper()
+	openId := newTestUser(t)
+	const period = "2026-01-04"
+	if err := mapper.EnsureDailyGrant(ctx, openId, period, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mapper.Consume(ctx, openId, period, RefGeneration, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		refunded, err := mapper.Refund(ctx, openId, RefGeneration, "r1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refunded != want {
+			t.Fatalf("refund #%d returns %t, want %t", i, refunded, want)
+		}
+	}
+	if balance := fetchTestBalance(t, openId, period); balance.DailyRemaining() != 2 {
+		t.Fatalf("unexpected balance after refunding %+v", balance)
+	}
+	if _, err := mapper.Refund(ctx, openId, RefGeneration, "never-consumed"); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("refund a consumption that does not exist, the error is %v", err)
+	}
+}
+
+func TestExpireDailyPeriod(t *testing.T) {
+	ctx := context.Background()
+	mapper := NewLedgerMapper()
+	openId := newTestUser(t)
+	const period = "2026-01-05"
+	if err := mapper.EnsureDailyGrant(ctx, openId, period, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := mapper.Append(ctx, openId, LedgerEntry{Kind: LedgerPurchase, Bucket: BucketPaid, Amount: 2, RefType: RefOrder, RefId: "order-2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, refId := range []string{"r1", "r2"} {
+		if _, err := mapper.Consume(ctx, openId, period, RefGeneration, refId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, want := range []int{1, 0} {
+		expired, err := mapper.ExpireDailyPeriod(ctx, period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired != want {
+			t.Fatalf("expire #%d affects %d users, want %d", i, expired, want)
+		}
+	}
+	// only the unused daily quota expires, the purchased credits are kept
+	if balance := fetchTestBalance(t, openId, period); balance != (Balance{DailyGranted: 2, DailyConsumed: 2, Paid: 2}) {
+		t.Fatalf("unexpected balance after expiring %+v", balance)
+	}
+}
+
+func TestRefundBlockedImage(t *testing.T) {
+	ctx := context.Background()
+	mapper := NewLedgerMapper()
+	checkMapper := NewMediaCheckMapper()
+	recordMapper := NewRecordMapper()
+	openId := newTestUser(t)
+	const period = "2026-01-06"
+	if err := mapper.EnsureDailyGrant(ctx, openId, period, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mapper.Consume(ctx, openId, period, RefGeneration, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"/" + t.Name() + "-0.png", "/" + t.Name() + "-1.png"}
+	recordId, err := recordMapper.Insert(ctx, openId, Record{Status: RecordReviewing}, "r1", paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks, err := checkMapper.FetchByRecords(ctx, []uint{recordId})
+	if err != nil || len(checks) != len(paths) {
+		t.Fatalf("checks are not created with the record, checks: %v, the error is %v", checks, err)
+	}
+	// the first blocked image is refunded rounding up, the second one has nothing left to refund
+	for i, want := range []int{1, 0} {
+		if err := checkMapper.Resolve(ctx, checks[i].ID, CheckRisky, 100); err != nil {
+			t.Fatal(err)
+		}
+		for _, repeated := range []bool{false, true} {
+			_, refunded, err := mapper.RefundBlockedImage(ctx, checks[i].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repeated {
+				want = 0
+			}
+			if refunded != want {
+				t.Fatalf("refund of blocked image #%d (repeated: %t) is %d, want %d", i, repeated, refunded, want)
+			}
+		}
+	}
+	if balance := fetchTestBalance(t, openId, period); balance.DailyRemaining() != 1 {
+		t.Fatalf("more than the consumption is refunded, balance: %+v", balance)
+	}
+}
+
+func TestBalanceDrifted(t *testing.T) {
+	str := func(s string) *string { return &s }
+	balance := Balance{DailyGranted: 5, DailyConsumed: 2, Paid: 1}
+	tests := []struct {
+		name   string
+		cached []*string
+		want   []int
+	}{
+		{name: "in sync", cached: []*string{str("5"), str("2"), str("1")}, want: []int{}},
+		{name: "missing", cached: []*string{nil, nil, nil}, want: []int{}},
+		{name: "stale usage", cached: []*string{str("5"), str("1"), nil}, want: []int{1}},
+		{name: "stale credits", cached: []*string{str("5"), str("2"), str("3")}, want: []int{2}},
+		{name: "corrupted", cached: []*string{str("five"), str("2"), str("1")}, want: []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := balance.Drifted(tt.cached); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("drifted fields are %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBalanceDriftedAfterLedgerChange(t *testing.T) {
+	ctx := context.Background()
+	mapper := NewLedgerMapper()
+	openId := newTestUser(t)
+	const period = "2026-01-07"
+	if err := mapper.EnsureDailyGrant(ctx, openId, period, 3); err != nil {
+		t.Fatal(err)
+	}
+	// cache the balance, then change the ledger without invalidating it
+	cached := []*string{}
+	for _, v := range fetchTestBalance(t, openId, period).Fields() {
+		s := strconv.Itoa(v)
+		cached = append(cached, &s)
+	}
+	if _, err := mapper.Consume(ctx, openId, period, RefGeneration, "r1"); err != nil {
+		t.Fatal(err)
+	}
+	if drifted := fetchTestBalance(t, openId, period).Drifted(cached); !reflect.DeepEqual(drifted, []int{1}) {
+		t.Fatalf("drifted fields are %v, want the daily usage", drifted)
+	}
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// record review status
+const (
+	RecordReviewing = "REVIEWING"
+	RecordPassed    = "PASSED"
+	RecordBlocked   = "BLOCKED"
+)
+
+// media check status, only PASS is visible to the users
+const (
+	CheckReviewing = "REVIEWING"
+	CheckPass      = "PASS"
+	CheckRisky     = "RISKY"
+	CheckReview    = "REVIEW" // the check suggests a manual review
+	CheckFailed    = "FAILED" // failed to get a result after retries
+)
+
+type MediaCheckMapper struct {
+}
+
+func NewMediaCheckMapper() MediaCheckMapper {
+	return MediaCheckMapper{}
+}
+
+// createMediaChecks 在保存记录的事务中为记录的每张图片创建待审核的条目
+func createMediaChecks(tx *gorm.DB, record Record, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	checks := make([]MediaCheck, len(paths))
+	for i, p := range paths {
+		checks[i] = MediaCheck{RecordId: record.ID, Uid: record.Uid, Path: p, Status: CheckReviewing}
+		checks[i].CreatedTime = record.CreatedTime
+		checks[i].ModifiedTime = record.CreatedTime
+	}
+	return tx.Create(&checks).Error
+}
+
+// Submitted 记录一次提交，traceId 为空表示提交失败
+func (mapper *MediaCheckMapper) Submitted(ctx context.Context, id uint, traceId string) error {
+	return dbInstance.WithContext(ctx).Model(&MediaCheck{}).Where("id = ?", id).Updates(map[string]any{
+		"trace_id":      traceId,
+		"attempts":      gorm.Expr("attempts + 1"),
+		"modified_time": time.Now(),
+	}).Error
+}
+
+// FetchByPath 查询图片的审核条目
+func (mapper *MediaCheckMapper) FetchByPath(ctx context.Context, path string) (MediaCheck, error) {
+	check := MediaCheck{}
+	result := dbInstance.WithContext(ctx).Where("path = ?", path).First(&check)
+	return check, result.Error
+}
+
+// FetchByRecords 查询记录的所有审核条目
+func (mapper *MediaCheckMapper) FetchByRecords(ctx context.Context, recordIds []uint) ([]MediaCheck, error) {
+	checks := []MediaCheck{}
+	if len(recordIds) == 0 {
+		return checks, nil
+	}
+	result := dbInstance.WithContext(ctx).Where("record_id in ?", recordIds).Find(&checks)
+	return checks, result.Error
+}
+
+// FetchStale 查询在 before 之后未再提交且仍在审核中的条目，用于重新提交
+func (mapper *MediaCheckMapper) FetchStale(ctx context.Context, before time.Time) ([]MediaCheck, error) {
+	checks := []MediaCheck{}
+	result := dbInstance.WithContext(ctx).Where("status = ? and modified_time < ?", CheckReviewing, before).Find(&checks)
+	return checks, result.Error
+}
+
+// FetchFlagged 未通过审核的条目，按 id 倒序分页，beforeId 为 0 时从最新开始
+func (mapper *MediaCheckMapper) FetchFlagged(ctx context.Context, beforeId uint, limit int) ([]MediaCheck, error) {
+	tx := dbInstance.WithContext(ctx).Where("status in ?", []string{CheckRisky, CheckReview, CheckFailed})
+	if beforeId != 0 {
+		tx = tx.Where("id < ?", beforeId)
+	}
+	checks := []MediaCheck{}
+	result := tx.Order("id desc").Limit(limit).Find(&checks)
+	return checks, result.Error
+}
+
+// Resolve 写入审核结果，记录的所有图片都有结果后更新记录的状态，重复的结果会被忽略
+func (mapper *MediaCheckMapper) Resolve(ctx context.Context, id uint, status string, label int) error {
+	return dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&MediaCheck{}).Where("id = ? and status = ?", id, CheckReviewing).
+			Updates(map[string]any{"status": status, "label": label, "modified_time": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		check := MediaCheck{}
+		if err := tx.First(&check, id).Error; err != nil {
+			return err
+		}
+		checks := []MediaCheck{}
+		if err := tx.Where("record_id = ?", check.RecordId).Find(&checks).Error; err != nil {
+			return err
+		}
+		recordStatus := RecordPassed
+		for _, c := range checks {
+			switch c.Status {
+			case CheckReviewing:
+				return nil
+			case CheckPass:
+			default:
+				recordStatus = RecordBlocked
+			}
+		}
+		return tx.Model(&Record{}).Where("id = ? and status = ?", check.RecordId, RecordReviewing).
+			Updates(map[string]any{"status": recordStatus, "modified_time": time.Now()}).Error
+	})
+}
+
+// FetchByTraceId 按异步审核的 trace id 查询条目
+func (mapper *MediaCheckMapper) FetchByTraceId(ctx context.Context, traceId string) (MediaCheck, error) {
+	check := MediaCheck{}
+	result := dbInstance.WithContext(ctx).Where("trace_id = ?", traceId).First(&check)
+	return check, result.Error
+}
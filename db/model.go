@@ -12,18 +12,30 @@ type Model struct {
 
 type User struct {
 	Model
-	OpenId     string    // wechat user unique id
-	NickName   string    // nickname
-	LastSeen   time.Time // last seen time
-	LoginTimes uint      // login times
+	OpenId          string    // wechat user unique id
+	NickName        string    // nickname
+	LastSeen        time.Time // last seen time
+	LoginTimes      uint      // login times
+	Tier            string    // membership tier, free if empty or expired
+	TierExpiredTime time.Time // membership expired time
+	InviteCode      *string   `gorm:"uniqueIndex"` // invite code shared to others, nil for users who have not logged in since
+	UnionId         *string   `gorm:"uniqueIndex"` // wechat open platform union id, nil if the mini program is not bound or not logged in since
 }
 
 type Record struct {
 	Model
-	Uid    uint   // user id
-	Type   string // PROMPT or VARIATION
-	Input  string // prompt text or variation origin image path
-	Output string // generated image path
+	Uid            uint   // user id
+	Type           string // PROMPT or VARIATION
+	Input          string // prompt text or variation origin image path
+	Output         string // generated image path
+	Original       string // unwatermarked image paths in json, empty if not kept
+	StyleId        uint   // applied style preset, 0 if none
+	EnhancedPrompt string // input rewritten by the llm, empty if not enhanced
+	Prompt         string // prompt actually sent to the provider, empty if it equals the input
+	Template       string // dynamic prompt the input was expanded from, empty if none
+	BatchId        string `gorm:"index"` // shared by the records of a combinatorial batch, empty if none
+	Status         string // REVIEWING, PASSED or BLOCKED, empty if not reviewed
+	Tier           string // membership tier of the user when generated, decides how long the record is kept
 }
 
 type Task struct {
@@ -34,3 +46,163 @@ type Task struct {
 	Status string // task status, PENDING, RUNNING, SUCCEED, FAILED
 	ErrMsg string // error message
 }
+
+type Order struct {
+	Model
+	Uid           uint      // user id
+	OutTradeNo    string    `gorm:"uniqueIndex"` // merchant order number sent to wechat pay
+	PackId        string    // credit pack id
+	Credits       int       // credits granted once paid
+	Tier          string    // membership tier granted once paid, empty for a credit pack
+	Days          int       // membership days granted once paid
+	Amount        int       // price in fen
+	Status        string    // CREATED, PAID or CLOSED
+	PrepayId      string    // wechat pay prepay id
+	TransactionId string    // wechat pay transaction id, set once paid
+	PaidTime      time.Time // paid time
+}
+
+// LedgerEntry 额度流水，只追加不修改，用户的所有额度均由流水汇总得出
+type LedgerEntry struct {
+	Model
+	Uid     uint    `gorm:"index:idx_ledger_uid_bucket"` // user id
+	Kind    string  // GRANT, PURCHASE, CONSUME, REFUND or EXPIRE
+	Bucket  string  `gorm:"index:idx_ledger_uid_bucket"` // DAILY for the daily quota, PAID for purchased credits
+	Period  string  // quota period (yyyy-MM-dd) of a DAILY entry, empty for PAID entries
+	Amount  int     // positive for grant, purchase and refund, negative for consume and expire
+	RefType string  // ORDER, RECORD, ADMIN ...
+	RefId   string  // id of the referenced object
+	Key     *string `gorm:"uniqueIndex"` // idempotency key, nil if the entry is not idempotent
+}
+
+// Referral 邀请关系，每个用户只能被邀请一次
+type Referral struct {
+	Model
+	InviterUid   uint      `gorm:"index"`       // inviter user id
+	InviteeUid   uint      `gorm:"uniqueIndex"` // invitee user id
+	Status       string    // PENDING until the invitee completes the first generation, then REWARDED or CAPPED
+	RewardedTime time.Time // rewarded time
+}
+
+// CouponBatch 一批兑换码，批次内的兑换码面额与期限相同
+type CouponBatch struct {
+	Model
+	Name        string    // batch name, usually the event name
+	Credits     int       // credits granted per redemption
+	MaxUses     int       // max redemptions of each code
+	ExpiredTime time.Time // codes can not be redeemed after that
+}
+
+type Coupon struct {
+	Model
+	BatchId uint   `gorm:"index"`       // coupon batch id
+	Code    string `gorm:"uniqueIndex"` // redeem code
+	Uses    int    // redemption count
+}
+
+// CouponRedemption 兑换记录，同一用户在同一批次内只能兑换一次
+type CouponRedemption struct {
+	Model
+	BatchId  uint `gorm:"uniqueIndex:idx_redemption_batch_uid"` // coupon batch id
+	Uid      uint `gorm:"uniqueIndex:idx_redemption_batch_uid"` // user id
+	CouponId uint // coupon id
+}
+
+// CheckIn 每日签到记录
+type CheckIn struct {
+	Model
+	Uid    uint   `gorm:"uniqueIndex:idx_check_in_uid_period"` // user id
+	Period string `gorm:"uniqueIndex:idx_check_in_uid_period"` // quota period (yyyy-MM-dd) of the check-in
+	Streak int    // consecutive days including this one
+	Bonus  int    // bonus generations granted for this check-in
+}
+
+// Style 风格预设，生成时将用户的描述套入 PromptTemplate
+type Style struct {
+	Model
+	Name           string `gorm:"uniqueIndex"` // unique slug, e.g. anime
+	Title          string // display title
+	PromptTemplate string // template with a {prompt} placeholder
+	NegativePrompt string // things to avoid, appended to the prompt since the provider has no such parameter
+	DefaultSize    string // size used when the request omits it
+	Sort           int    // display order, ascending
+	Enabled        bool   // disabled styles are hidden and can not be applied
+}
+
+// Wildcard 动态描述中 __name__ 引用的词表
+type Wildcard struct {
+	Model
+	Name  string `gorm:"uniqueIndex"` // referenced as __name__
+	Words string // one word or phrase per line
+}
+
+// Publication 发布到公开画廊的生成记录，通过不可猜测的 Token 访问
+type Publication struct {
+	Model
+	RecordId  uint   `gorm:"uniqueIndex"` // record id
+	Uid       uint   `gorm:"index"`       // owner user id
+	Token     string `gorm:"uniqueIndex"` // share token, rotated on every publish
+	Likes     int    // like count
+	Published bool   `gorm:"index"` // false once unpublished
+	// PublishedTime 最近一次发布的时间，最新列表按其排序，重新发布的作品回到列表顶部
+	PublishedTime time.Time `gorm:"index"`
+}
+
+// Like 点赞记录，同一用户对同一作品只能点赞一次
+type Like struct {
+	Model
+	PublicationId uint `gorm:"uniqueIndex:idx_like_publication_uid"` // publication id
+	Uid           uint `gorm:"uniqueIndex:idx_like_publication_uid"` // user id
+}
+
+// Blob 按内容去重存储的文件，相同内容的多个路径引用同一份文件
+type Blob struct {
+	Model
+	Sha256   string `gorm:"uniqueIndex"` // content hash
+	Path     string // relative path of the stored file
+	RefCount int    // number of image files referencing it, purged some time after dropping to 0
+}
+
+// ImageFile 图片路径及其内容哈希与感知哈希
+type ImageFile struct {
+	Model
+	Path   string `gorm:"uniqueIndex"` // relative path exposed to the clients
+	Uid    uint   `gorm:"index"`       // owner user id
+	Source string // UPLOADED or GENERATED
+	BlobId uint   `gorm:"index"` // referenced blob, 0 if the file is stored at Path
+	Sha256 string // content hash
+	PHash  int64  // perceptual hash, stored as int64 since sqlite has no unsigned integers
+	DHash  int64  // difference hash
+}
+
+// MediaCheck 生成图片的内容安全审核，每张图片一条
+type MediaCheck struct {
+	Model
+	RecordId uint   `gorm:"index"` // record id
+	Uid      uint   // owner user id
+	Path     string `gorm:"uniqueIndex"` // generated image path
+	TraceId  string `gorm:"index"`       // trace id of the async check, empty if not submitted yet
+	Status   string `gorm:"index"`       // REVIEWING, PASS, RISKY, REVIEW or FAILED
+	Label    int    // risk label of the check result
+	Attempts int    // submission attempts
+}
+
+// Subscription 用户接受的一次性订阅消息，每接受一次可以发送一条
+type Subscription struct {
+	Model
+	Uid        uint   `gorm:"uniqueIndex:idx_subscription_uid_template"` // user id
+	TemplateId string `gorm:"uniqueIndex:idx_subscription_uid_template"` // subscribe message template id
+	Remaining  int    // accepted but not yet consumed
+}
+
+// Notification 消耗一次订阅后发送的订阅消息，发送失败时稍后重试
+type Notification struct {
+	Model
+	Uid        uint      `gorm:"index"` // user id
+	TemplateId string    // subscribe message template id
+	Payload    string    // subscribeMessage.send request body in json
+	Status     string    `gorm:"index"` // PENDING, SENT or FAILED
+	Attempts   int       // send attempts
+	ErrMsg     string    // error of the last attempt
+	NextTime   time.Time // next attempt time of a pending notification
+}
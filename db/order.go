@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	OrderCreated string = "CREATED"
+	OrderPaid    string = "PAID"
+	OrderClosed  string = "CLOSED"
+)
+
+// ErrUserModified 计算会员开通结果后用户的等级发生了变化，需重新计算
+var ErrUserModified = errors.New("membership of the user is modified concurrently")
+
+// MembershipGrant 会员订单支付后开通或续期的结果，由 service 根据用户当前的等级计算
+type MembershipGrant struct {
+	FromTier        string    // tier of the user when the grant is computed
+	FromExpiredTime time.Time // tier expired time of the user when the grant is computed
+	Tier            string
+	ExpiredTime     time.Time
+	Period          string // current quota period
+	DailyLimits     int    // daily quota of the current period granted before switching the tier
+	Bonus           int    // extra daily quota of the current period for the upgrade
+}
+
+type OrderMapper struct {
+}
+
+func NewOrderMapper() OrderMapper {
+	return OrderMapper{}
+}
+
+func (mapper *OrderMapper) Insert(ctx context.Context, openId string, order Order) (Order, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
+		log.Printf("failed to find the user, the error is %s", result.Error)
+		return order, result.Error
+	}
+	order.Uid = user.ID
+	order.Status = OrderCreated
+	order.CreatedTime = time.Now()
+	order.ModifiedTime = time.Now()
+	if result := tx.Create(&order); result.RowsAffected == 0 {
+		log.Println("create order failed, the error is: ", result.Error)
+		return order, result.Error
+	}
+	return order, nil
+}
+
+func (mapper *OrderMapper) FetchByOutTradeNo(ctx context.Context, outTradeNo string) (Order, error) {
+	order := Order{}
+	result := dbInstance.WithContext(ctx).Where("out_trade_no = ?", outTradeNo).First(&order)
+	return order, result.Error
+}
+
+// FetchByUser 查询用户的订单，按创建时间倒序
+func (mapper *OrderMapper) FetchByUser(ctx context.Context, openId string) ([]Order, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
+		return []Order{}, result.Error
+	}
+	orders := []Order{}
+	result := tx.Where("uid = ?", user.ID).Order("created_time desc").Find(&orders)
+	return orders, result.Error
+}
+
+func (mapper *OrderMapper) UpdatePrepayId(ctx context.Context, id uint, prepayId string) error {
+	return dbInstance.WithContext(ctx).Model(&Order{}).Where("id = ?", id).
+		Updates(map[string]any{"prepay_id": prepayId, "modified_time": time.Now()}).Error
+}
+
+// MarkPaid 将订单置为已支付并在同一事务中记入购买流水、开通会员，只有从 CREATED 状态的转换才会入账，
+// 因此重复的回调或查单都不会重复入账，返回本次调用是否实际入账。grant 为 nil 表示不开通会员，
+// 用户的等级在计算 grant 后发生变化时返回 ErrUserModified，整个事务回滚
+func (mapper *OrderMapper) MarkPaid(ctx context.Context, outTradeNo string, transactionId string, grant *MembershipGrant) (bool, error) {
+	credited := false
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		order := Order{}
+		if result := tx.Where("out_trade_no = ?", outTradeNo).First(&order); result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		// a closed order can still be paid if the close request raced with the payment
+		result := tx.Model(&Order{}).
+			Where("id = ? and status <> ?", order.ID, OrderPaid).
+			Updates(map[string]any{"status": OrderPaid, "transaction_id": transactionId, "paid_time": now, "modified_time": now})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		key := "purchase-" + order.OutTradeNo
+		entry := LedgerEntry{
+			Uid:     order.Uid,
+			Kind:    LedgerPurchase,
+			Bucket:  BucketPaid,
+			Amount:  order.Credits,
+			RefType: RefOrder,
+			RefId:   order.OutTradeNo,
+			Key:     &key,
+		}
+		if err := appendEntry(tx, &entry); err != nil {
+			return err
+		}
+		if grant != nil {
+			if err := applyMembershipGrant(tx, order, *grant); err != nil {
+				return err
+			}
+		}
+		credited = true
+		return nil
+	})
+	return credited, err
+}
+
+func applyMembershipGrant(tx *gorm.DB, order Order, grant MembershipGrant) error {
+	user := User{}
+	if result := tx.Where("id = ?", order.Uid).First(&user); result.Error != nil {
+		return result.Error
+	}
+	if user.Tier != grant.FromTier || !user.TierExpiredTime.Equal(grant.FromExpiredTime) {
+		return ErrUserModified
+	}
+	// settle today's grant with the current tier before switching
+	if err := ensureDailyGrant(tx, user.ID, grant.Period, grant.DailyLimits); err != nil {
+		return err
+	}
+	result := tx.Model(&User{}).Where("id = ?", user.ID).Updates(map[string]any{
+		"tier":              grant.Tier,
+		"tier_expired_time": grant.ExpiredTime,
+		"modified_time":     time.Now(),
+	})
+	if result.Error != nil || grant.Bonus <= 0 {
+		return result.Error
+	}
+	key := "tier-" + order.OutTradeNo
+	return appendEntry(tx, &LedgerEntry{
+		Uid:     user.ID,
+		Kind:    LedgerGrant,
+		Bucket:  BucketDaily,
+		Period:  grant.Period,
+		Amount:  grant.Bonus,
+		RefType: RefOrder,
+		RefId:   order.OutTradeNo,
+		Key:     &key,
+	})
+}
+
+// MarkClosed 关闭未支付的订单
+func (mapper *OrderMapper) MarkClosed(ctx context.Context, outTradeNo string) error {
+	return dbInstance.WithContext(ctx).Model(&Order{}).
+		Where("out_trade_no = ? and status = ?", outTradeNo, OrderCreated).
+		Updates(map[string]any{"status": OrderClosed, "modified_time": time.Now()}).Error
+}
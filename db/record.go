@@ -1,8 +1,12 @@
 package db
 
 import (
+	"context"
 	"log"
+	"strconv"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type RecordMapper struct {
@@ -12,45 +16,84 @@ func NewRecordMapper() RecordMapper {
 	return RecordMapper{}
 }
 
-func (mapper *RecordMapper) Insert(openId string, calledType string, input string, output string) (uint, error) {
-	user := User{}
-	if result := dbInstance.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
-		log.Printf("failed to find the user, the error is %s, skip recording", result.Error)
-		return 0, result.Error
-	}
-	record := Record{
-		Uid:    user.ID,
-		Type:   calledType,
-		Input:  input,
-		Output: output,
-	}
-	record.CreatedTime = time.Now()
-	record.ModifiedTime = time.Now()
-	if result := dbInstance.Create(&record); result.RowsAffected == 0 {
-		log.Println("create record failed, the error is: ", result.Error)
-		return 0, result.Error
+// Insert 保存生成记录，并在同一事务中为 checkPaths 创建待审核的条目；
+// reservationId 不为空时将生成前预扣的额度转为记录的扣减
+func (mapper *RecordMapper) Insert(ctx context.Context, openId string, record Record, reservationId string, checkPaths []string) (uint, error) {
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
+			log.Printf("failed to find the user, the error is %s, skip recording", result.Error)
+			return result.Error
+		}
+		record.Uid = user.ID
+		record.CreatedTime = time.Now()
+		record.ModifiedTime = time.Now()
+		if result := tx.Create(&record); result.RowsAffected == 0 {
+			log.Println("create record failed, the error is: ", result.Error)
+			return result.Error
+		}
+		if err := createMediaChecks(tx, record, checkPaths); err != nil {
+			return err
+		}
+		if reservationId == "" {
+			return nil
+		}
+		return tx.Model(&LedgerEntry{}).
+			Where("uid = ? and kind = ? and ref_type = ? and ref_id = ?", user.ID, LedgerConsume, RefGeneration, reservationId).
+			Updates(map[string]any{"ref_type": RefRecord, "ref_id": strconv.FormatUint(uint64(record.ID), 10), "modified_time": time.Now()}).Error
+	})
+	if err != nil {
+		return 0, err
 	}
 	return record.ID, nil
 }
 
-func (mapper *RecordMapper) FetchCountByUser(openId string) (int, error) {
+func (mapper *RecordMapper) FetchCountByUser(ctx context.Context, openId string) (int, error) {
+	tx := dbInstance.WithContext(ctx)
 	user := User{}
-	if result := dbInstance.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
+	if result := tx.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
 		log.Printf("failed to find the user, the error is %s", result.Error)
 		return 0, result.Error
 	}
 	records := []Record{}
-	result := dbInstance.Where("uid = ?", user.ID).Find(&records)
+	result := tx.Where("uid = ?", user.ID).Find(&records)
 	return len(records), result.Error
 }
 
-func (mapper *RecordMapper) FetchByUserAndType(openId string, calledType string) ([]Record, error) {
+func (mapper *RecordMapper) FetchByUserAndType(ctx context.Context, openId string, calledType string) ([]Record, error) {
+	tx := dbInstance.WithContext(ctx)
 	user := User{}
-	if result := dbInstance.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
+	if result := tx.Where("open_id = ?", openId).First(&user); result.RowsAffected == 0 {
 		log.Printf("failed to find the user, the error is %s", result.Error)
 		return []Record{}, result.Error
 	}
 	records := []Record{}
-	result := dbInstance.Where("uid = ? and type = ?", user.ID, calledType).Order("modified_time desc").Find(&records)
+	result := tx.Where("uid = ? and type = ?", user.ID, calledType).Order("modified_time desc").Find(&records)
 	return records, result.Error
 }
+
+// FetchByUserAndId 查询用户自己的一条记录
+func (mapper *RecordMapper) FetchByUserAndId(ctx context.Context, openId string, id uint) (Record, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return Record{}, result.Error
+	}
+	record := Record{}
+	result := tx.Where("id = ? and uid = ?", id, user.ID).First(&record)
+	return record, result.Error
+}
+
+// FetchCreatedBefore 查询用户在 before 之前生成的记录，用于清理超出保存期限的图片
+func (mapper *RecordMapper) FetchCreatedBefore(ctx context.Context, uid uint, before time.Time) ([]Record, error) {
+	records := []Record{}
+	result := dbInstance.WithContext(ctx).Where("uid = ? and created_time < ?", uid, before).Find(&records)
+	return records, result.Error
+}
+
+func (mapper *RecordMapper) DeleteByIds(ctx context.Context, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return dbInstance.WithContext(ctx).Delete(&Record{}, ids).Error
+}
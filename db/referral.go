@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ReferralPending  string = "PENDING"
+	ReferralRewarded string = "REWARDED"
+	ReferralCapped   string = "CAPPED"
+)
+
+// ReferralReward 邀请奖励的配置，额度记入已购次数，不随每日额度过期
+type ReferralReward struct {
+	Inviter    int // credits granted to the inviter
+	Invitee    int // credits granted to the invitee
+	MaxRewards int // max rewarded referrals per inviter, the inviter gets nothing beyond it
+}
+
+// ReferralView 邀请列表中的一项
+type ReferralView struct {
+	Referral
+	InviteeOpenId   string
+	InviteeNickName string
+}
+
+type ReferralMapper struct {
+}
+
+func NewReferralMapper() ReferralMapper {
+	return ReferralMapper{}
+}
+
+// Reward 被邀请人完成首次生成后为双方发放奖励，返回本次结算的邀请关系，已结算或没有邀请关系时返回 nil
+func (mapper *ReferralMapper) Reward(ctx context.Context, inviteeOpenId string, reward ReferralReward) (*Referral, error) {
+	var rewarded *Referral
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		invitee := User{}
+		if result := tx.Where("open_id = ?", inviteeOpenId).First(&invitee); result.Error != nil {
+			return result.Error
+		}
+		referral := Referral{}
+		result := tx.Where("invitee_uid = ? and status = ?", invitee.ID, ReferralPending).Limit(1).Find(&referral)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		var count int64
+		if result := tx.Model(&Referral{}).Where("inviter_uid = ? and status = ?", referral.InviterUid, ReferralRewarded).Count(&count); result.Error != nil {
+			return result.Error
+		}
+		status := ReferralRewarded
+		if reward.MaxRewards > 0 && int(count) >= reward.MaxRewards {
+			status = ReferralCapped
+		}
+		now := time.Now()
+		// the status condition guards against a concurrent reward of the same referral
+		result = tx.Model(&Referral{}).Where("id = ? and status = ?", referral.ID, ReferralPending).
+			Updates(map[string]any{"status": status, "rewarded_time": now, "modified_time": now})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		refId := strconv.FormatUint(uint64(referral.ID), 10)
+		if status == ReferralRewarded && reward.Inviter > 0 {
+			if err := appendReferralReward(tx, referral.InviterUid, reward.Inviter, refId, "inviter"); err != nil {
+				return err
+			}
+		}
+		if reward.Invitee > 0 {
+			if err := appendReferralReward(tx, referral.InviteeUid, reward.Invitee, refId, "invitee"); err != nil {
+				return err
+			}
+		}
+		referral.Status = status
+		rewarded = &referral
+		return nil
+	})
+	return rewarded, err
+}
+
+func appendReferralReward(tx *gorm.DB, uid uint, amount int, refId string, side string) error {
+	key := "referral-" + refId + "-" + side
+	return appendEntry(tx, &LedgerEntry{
+		Uid:     uid,
+		Kind:    LedgerGrant,
+		Bucket:  BucketPaid,
+		Amount:  amount,
+		RefType: RefReferral,
+		RefId:   refId,
+		Key:     &key,
+	})
+}
+
+// FetchByInviter 查询用户邀请的所有人，按邀请时间倒序
+func (mapper *ReferralMapper) FetchByInviter(ctx context.Context, openId string) ([]ReferralView, error) {
+	tx := dbInstance.WithContext(ctx)
+	user := User{}
+	if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+		return []ReferralView{}, result.Error
+	}
+	views := []ReferralView{}
+	result := tx.Model(&Referral{}).
+		Select("referrals.*, users.open_id as invitee_open_id, users.nick_name as invitee_nick_name").
+		Joins("left join users on users.id = referrals.invitee_uid").
+		Where("referrals.inviter_uid = ?", user.ID).
+		Order("referrals.created_time desc").
+		Scan(&views)
+	return views, result.Error
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+type StyleMapper struct {
+}
+
+func NewStyleMapper() StyleMapper {
+	return StyleMapper{}
+}
+
+// FetchAll 查询所有风格，enabledOnly 为 true 时只返回已启用的，按 Sort 升序
+func (mapper *StyleMapper) FetchAll(ctx context.Context, enabledOnly bool) ([]Style, error) {
+	tx := dbInstance.WithContext(ctx)
+	if enabledOnly {
+		tx = tx.Where("enabled = ?", true)
+	}
+	styles := []Style{}
+	result := tx.Order("sort, id").Find(&styles)
+	return styles, result.Error
+}
+
+func (mapper *StyleMapper) FetchById(ctx context.Context, id uint) (Style, error) {
+	style := Style{}
+	result := dbInstance.WithContext(ctx).First(&style, id)
+	return style, result.Error
+}
+
+// Save 按 Name 新增或更新风格
+func (mapper *StyleMapper) Save(ctx context.Context, style Style) (Style, error) {
+	now := time.Now()
+	style.CreatedTime = now
+	style.ModifiedTime = now
+	result := dbInstance.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"title", "prompt_template", "negative_prompt", "default_size", "sort", "enabled", "modified_time"}),
+	}).Create(&style)
+	if result.Error != nil {
+		return style, result.Error
+	}
+	err := dbInstance.WithContext(ctx).Where("name = ?", style.Name).First(&style).Error
+	return style, err
+}
+
+// SetEnabled 启用或停用风格，返回是否找到该风格
+func (mapper *StyleMapper) SetEnabled(ctx context.Context, name string, enabled bool) (bool, error) {
+	result := dbInstance.WithContext(ctx).Model(&Style{}).Where("name = ?", name).
+		Updates(map[string]any{"enabled": enabled, "modified_time": time.Now()})
+	return result.RowsAffected != 0, result.Error
+}
+
+// SeedIfEmpty 风格表为空时写入初始风格
+func (mapper *StyleMapper) SeedIfEmpty(ctx context.Context, styles []Style) error {
+	var count int64
+	tx := dbInstance.WithContext(ctx)
+	if result := tx.Model(&Style{}).Count(&count); result.Error != nil || count > 0 {
+		return result.Error
+	}
+	now := time.Now()
+	for i := range styles {
+		styles[i].CreatedTime = now
+		styles[i].ModifiedTime = now
+	}
+	return tx.Create(&styles).Error
+}
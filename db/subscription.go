@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// notification status
+const (
+	NotificationPending = "PENDING"
+	NotificationSent    = "SENT"
+	NotificationFailed  = "FAILED"
+)
+
+type SubscriptionMapper struct {
+}
+
+func NewSubscriptionMapper() SubscriptionMapper {
+	return SubscriptionMapper{}
+}
+
+// Accept 记录用户接受了一次模板的订阅
+func (mapper *SubscriptionMapper) Accept(ctx context.Context, openId string, templateId string) error {
+	return dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		if result := tx.Where("open_id = ?", openId).First(&user); result.Error != nil {
+			return result.Error
+		}
+		now := time.Now()
+		result := tx.Model(&Subscription{}).Where("uid = ? and template_id = ?", user.ID, templateId).
+			Updates(map[string]any{"remaining": gorm.Expr("remaining + 1"), "modified_time": now})
+		if result.Error != nil || result.RowsAffected != 0 {
+			return result.Error
+		}
+		subscription := Subscription{Uid: user.ID, TemplateId: templateId, Remaining: 1}
+		subscription.CreatedTime = now
+		subscription.ModifiedTime = now
+		return tx.Create(&subscription).Error
+	})
+}
+
+// Consume 消耗一次订阅并创建待发送的消息，没有剩余的订阅时返回 false。
+// 创建者负责首次发送，lease 之后仍未发送的消息才会被重试
+func (mapper *SubscriptionMapper) Consume(ctx context.Context, uid uint, templateId string, payload string, lease time.Duration) (Notification, bool, error) {
+	notification := Notification{}
+	consumed := false
+	err := dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&Subscription{}).Where("uid = ? and template_id = ? and remaining > 0", uid, templateId).
+			Updates(map[string]any{"remaining": gorm.Expr("remaining - 1"), "modified_time": now})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		notification = Notification{Uid: uid, TemplateId: templateId, Payload: payload, Status: NotificationPending, NextTime: now.Add(lease)}
+		notification.CreatedTime = now
+		notification.ModifiedTime = now
+		if err := tx.Create(&notification).Error; err != nil {
+			return err
+		}
+		consumed = true
+		return nil
+	})
+	return notification, consumed, err
+}
+
+// Claim 抢占一条到期的消息，避免多个副本重复发送，lease 内未记录结果时可以再次被抢占
+func (mapper *SubscriptionMapper) Claim(ctx context.Context, notification Notification, lease time.Duration) (bool, error) {
+	result := dbInstance.WithContext(ctx).Model(&Notification{}).
+		Where("id = ? and status = ? and next_time = ?", notification.ID, NotificationPending, notification.NextTime).
+		Updates(map[string]any{"next_time": time.Now().Add(lease), "modified_time": time.Now()})
+	return result.RowsAffected != 0, result.Error
+}
+
+// Sent 记录消息发送成功
+func (mapper *SubscriptionMapper) Sent(ctx context.Context, id uint) error {
+	return dbInstance.WithContext(ctx).Model(&Notification{}).Where("id = ? and status = ?", id, NotificationPending).
+		Updates(map[string]any{
+			"status":        NotificationSent,
+			"attempts":      gorm.Expr("attempts + 1"),
+			"err_msg":       "",
+			"modified_time": time.Now(),
+		}).Error
+}
+
+// Retry 记录一次失败的发送，在 next 之后重试
+func (mapper *SubscriptionMapper) Retry(ctx context.Context, id uint, errMsg string, next time.Time) error {
+	return dbInstance.WithContext(ctx).Model(&Notification{}).Where("id = ? and status = ?", id, NotificationPending).
+		Updates(map[string]any{
+			"attempts":      gorm.Expr("attempts + 1"),
+			"err_msg":       errMsg,
+			"next_time":     next,
+			"modified_time": time.Now(),
+		}).Error
+}
+
+// Fail 放弃发送。refund 时退还消耗的订阅，否则认为用户在微信侧已没有可用的订阅，清空剩余次数
+func (mapper *SubscriptionMapper) Fail(ctx context.Context, id uint, errMsg string, refund bool) error {
+	return dbInstance.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&Notification{}).Where("id = ? and status = ?", id, NotificationPending).
+			Updates(map[string]any{
+				"status":        NotificationFailed,
+				"attempts":      gorm.Expr("attempts + 1"),
+				"err_msg":       errMsg,
+				"modified_time": now,
+			})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		notification := Notification{}
+		if err := tx.First(&notification, id).Error; err != nil {
+			return err
+		}
+		remaining := gorm.Expr("0")
+		if refund {
+			remaining = gorm.Expr("remaining + 1")
+		}
+		return tx.Model(&Subscription{}).Where("uid = ? and template_id = ?", notification.Uid, notification.TemplateId).
+			Updates(map[string]any{"remaining": remaining, "modified_time": now}).Error
+	})
+}
+
+// FetchDue 到了重试时间的待发送消息
+func (mapper *SubscriptionMapper) FetchDue(ctx context.Context, now time.Time, limit int) ([]Notification, error) {
+	notifications := []Notification{}
+	result := dbInstance.WithContext(ctx).Where("status = ? and next_time <= ?", NotificationPending, now).
+		Order("id").Limit(limit).Find(&notifications)
+	return notifications, result.Error
+}
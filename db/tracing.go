@@ -0,0 +1,57 @@
+package db
+
+import (
+	"idraw-server/telemetry"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanInstanceKey = "otel:span"
+
+var tracer = telemetry.Tracer("db")
+
+// registerTracingCallbacks 为 gorm 的每类操作包上一层 span，span 挂在语句所带的 context 上
+func registerTracingCallbacks(db *gorm.DB) {
+	cb := db.Callback()
+	cb.Create().Before("gorm:create").Register("otel:before_create", beforeCallback("gorm.create"))
+	cb.Create().After("gorm:create").Register("otel:after_create", afterCallback)
+	cb.Query().Before("gorm:query").Register("otel:before_query", beforeCallback("gorm.query"))
+	cb.Query().After("gorm:query").Register("otel:after_query", afterCallback)
+	cb.Update().Before("gorm:update").Register("otel:before_update", beforeCallback("gorm.update"))
+	cb.Update().After("gorm:update").Register("otel:after_update", afterCallback)
+	cb.Delete().Before("gorm:delete").Register("otel:before_delete", beforeCallback("gorm.delete"))
+	cb.Delete().After("gorm:delete").Register("otel:after_delete", afterCallback)
+	cb.Row().Before("gorm:row").Register("otel:before_row", beforeCallback("gorm.row"))
+	cb.Row().After("gorm:row").Register("otel:after_row", afterCallback)
+	cb.Raw().Before("gorm:raw").Register("otel:before_raw", beforeCallback("gorm.raw"))
+	cb.Raw().After("gorm:raw").Register("otel:after_raw", afterCallback)
+}
+
+func beforeCallback(name string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		_, span := tracer.Start(tx.Statement.Context, name, trace.WithSpanKind(trace.SpanKindClient))
+		tx.InstanceSet(spanInstanceKey, span)
+	}
+}
+
+func afterCallback(tx *gorm.DB) {
+	val, ok := tx.InstanceGet(spanInstanceKey)
+	if !ok {
+		return
+	}
+	span := val.(trace.Span)
+	span.SetAttributes(
+		attribute.String("db.system", "sqlite"),
+		attribute.String("db.sql.table", tx.Statement.Table),
+		attribute.String("db.statement", tx.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", tx.Statement.RowsAffected),
+	)
+	// record not found is an expected outcome for lookups, not a failure
+	if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
+		telemetry.End(span, tx.Error)
+		return
+	}
+	span.End()
+}
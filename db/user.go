@@ -1,8 +1,12 @@
 package db
 
 import (
+	"context"
+	"crypto/rand"
 	"log"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type UserMapper struct {
@@ -12,26 +16,116 @@ func NewUserMapper() UserMapper {
 	return UserMapper{}
 }
 
-func (mapper *UserMapper) Insert(openId string) (uint, error) {
+// Insert 记录用户登录，首次登录时创建用户，并在 inviteCode 有效时绑定邀请关系
+func (mapper *UserMapper) Insert(ctx context.Context, openId string, inviteCode string) (uint, error) {
+	tx := dbInstance.WithContext(ctx)
 	user := User{}
-	if result := dbInstance.Where("open_id = ?", openId).First(&user); result.RowsAffected != 0 {
+	if result := tx.Where("open_id = ?", openId).First(&user); result.RowsAffected != 0 {
 		log.Printf("user %s login, last seen at %s, total login times is now %d", openId, user.LastSeen, user.LoginTimes+1)
 		// record info
 		user.LastSeen = time.Now()
 		user.LoginTimes = user.LoginTimes + 1
-		dbInstance.Save(&user)
-	} else {
-		user = User{
-			OpenId:     openId,
-			LoginTimes: 1,
-			LastSeen:   time.Now(),
+		if user.InviteCode == nil {
+			code := newInviteCode()
+			user.InviteCode = &code
 		}
-		user.CreatedTime = time.Now()
-		user.ModifiedTime = time.Now()
-		if result := dbInstance.Create(&user); result.RowsAffected == 0 {
-			log.Println("create user failed, try next time, the error is: ", result.Error)
-			return 0, result.Error
+		tx.Save(&user)
+		return user.ID, nil
+	}
+	code := newInviteCode()
+	user = User{
+		OpenId:     openId,
+		LoginTimes: 1,
+		LastSeen:   time.Now(),
+		InviteCode: &code,
+	}
+	user.CreatedTime = time.Now()
+	user.ModifiedTime = time.Now()
+	err := tx.Transaction(func(tx *gorm.DB) error {
+		if result := tx.Create(&user); result.RowsAffected == 0 {
+			return result.Error
 		}
+		return bindReferral(tx, user, inviteCode)
+	})
+	if err != nil {
+		log.Println("create user failed, try next time, the error is: ", err)
+		return 0, err
 	}
 	return user.ID, nil
 }
+
+// bindReferral 将新用户绑定到邀请人，邀请码无效或为自己的邀请码时忽略
+func bindReferral(tx *gorm.DB, invitee User, inviteCode string) error {
+	if inviteCode == "" {
+		return nil
+	}
+	inviter := User{}
+	if result := tx.Where("invite_code = ?", inviteCode).First(&inviter); result.Error != nil {
+		log.Printf("ignore invite code %s of user %s, the error is %s", inviteCode, invitee.OpenId, result.Error)
+		return nil
+	}
+	if inviter.ID == invitee.ID || inviter.OpenId == invitee.OpenId {
+		log.Printf("ignore self referral of user %s", invitee.OpenId)
+		return nil
+	}
+	referral := Referral{InviterUid: inviter.ID, InviteeUid: invitee.ID, Status: ReferralPending}
+	referral.CreatedTime = time.Now()
+	referral.ModifiedTime = referral.CreatedTime
+	return tx.Create(&referral).Error
+}
+
+// newInviteCode 8 位随机邀请码，去除了容易混淆的字符
+func newInviteCode() string {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 8)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+func (mapper *UserMapper) FetchByOpenId(ctx context.Context, openId string) (User, error) {
+	user := User{}
+	result := dbInstance.WithContext(ctx).Where("open_id = ?", openId).First(&user)
+	return user, result.Error
+}
+
+func (mapper *UserMapper) FetchById(ctx context.Context, id uint) (User, error) {
+	user := User{}
+	result := dbInstance.WithContext(ctx).First(&user, id)
+	return user, result.Error
+}
+
+// FetchByUnionId 按开放平台的 unionId 查询用户，用于关联公众号等其他应用的用户
+func (mapper *UserMapper) FetchByUnionId(ctx context.Context, unionId string) (User, error) {
+	user := User{}
+	result := dbInstance.WithContext(ctx).Where("union_id = ?", unionId).First(&user)
+	return user, result.Error
+}
+
+// BindUnionId 记录用户的 unionId，已记录时不做任何事
+func (mapper *UserMapper) BindUnionId(ctx context.Context, openId string, unionId string) error {
+	result := dbInstance.WithContext(ctx).Model(&User{}).Where("open_id = ? and union_id is null", openId).Updates(map[string]any{
+		"union_id":      unionId,
+		"modified_time": time.Now(),
+	})
+	return result.Error
+}
+
+// UpdateTier 更新用户的会员等级及到期时间
+func (mapper *UserMapper) UpdateTier(ctx context.Context, id uint, tier string, expiredTime time.Time) error {
+	result := dbInstance.WithContext(ctx).Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+		"tier":              tier,
+		"tier_expired_time": expiredTime,
+		"modified_time":     time.Now(),
+	})
+	return result.Error
+}
+
+// FetchAll 查询所有用户，用于对账等离线任务
+func (mapper *UserMapper) FetchAll(ctx context.Context) ([]User, error) {
+	users := []User{}
+	result := dbInstance.WithContext(ctx).Order("id").Find(&users)
+	return users, result.Error
+}
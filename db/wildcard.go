@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+type WildcardMapper struct {
+}
+
+func NewWildcardMapper() WildcardMapper {
+	return WildcardMapper{}
+}
+
+func (mapper *WildcardMapper) FetchByName(ctx context.Context, name string) (Wildcard, error) {
+	wildcard := Wildcard{}
+	result := dbInstance.WithContext(ctx).Where("name = ?", name).First(&wildcard)
+	return wildcard, result.Error
+}
+
+func (mapper *WildcardMapper) FetchAll(ctx context.Context) ([]Wildcard, error) {
+	wildcards := []Wildcard{}
+	result := dbInstance.WithContext(ctx).Order("name").Find(&wildcards)
+	return wildcards, result.Error
+}
+
+// Save 按 Name 新增或替换词表
+func (mapper *WildcardMapper) Save(ctx context.Context, wildcard Wildcard) error {
+	now := time.Now()
+	wildcard.CreatedTime = now
+	wildcard.ModifiedTime = now
+	return dbInstance.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"words", "modified_time"}),
+	}).Create(&wildcard).Error
+}
+
+// Delete 删除词表，返回是否找到该词表
+func (mapper *WildcardMapper) Delete(ctx context.Context, name string) (bool, error) {
+	result := dbInstance.WithContext(ctx).Where("name = ?", name).Delete(&Wildcard{})
+	return result.RowsAffected != 0, result.Error
+}
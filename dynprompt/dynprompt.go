@@ -0,0 +1,234 @@
+// Package dynprompt 展开动态描述：{a|b} 为可嵌套的选项分组，__name__ 引用一个词表
+package dynprompt
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+)
+
+const (
+	// MaxDepth 选项或词表中再嵌套分组与引用的最大层数，防止词表互相引用导致无限展开
+	MaxDepth = 16
+	// MaxExpansions 一次展开中处理的分组与引用的总数上限，与嵌套层数分开计算
+	MaxExpansions = 1024
+)
+
+var (
+	ErrTooDeep        = errors.New("dynamic prompt is nested too deep")
+	ErrTooLarge       = errors.New("dynamic prompt has too many groups to expand")
+	ErrTooManyPrompts = errors.New("dynamic prompt expands to too many prompts")
+)
+
+// Lookup 按名称读取词表的所有词，返回的错误原样传给调用方
+type Lookup func(name string) ([]string, error)
+
+// token 描述中第一个可展开的片段，prefix 与 rest 为其前后的文本
+type token struct {
+	prefix  string
+	options []string
+	rest    string
+}
+
+// Expander 在一次展开中缓存已读取的词表，budget 为剩余可处理的分组与引用数量，不可并发使用
+type Expander struct {
+	lookup Lookup
+	cache  map[string][]string
+	budget int
+}
+
+func NewExpander(lookup Lookup) *Expander {
+	return &Expander{lookup: lookup, cache: map[string][]string{}, budget: MaxExpansions}
+}
+
+// IsDynamic 描述中是否可能含有 {a|b} 或 __name__ 语法
+func IsDynamic(prompt string) bool {
+	return strings.Contains(prompt, "{") || strings.Contains(prompt, "__")
+}
+
+// IsWildcardName 词表名称只能包含字母、数字、下划线与连字符
+func IsWildcardName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// SplitWords 按行切分词表，忽略空行及首尾空白
+func SplitWords(val string) []string {
+	words := []string{}
+	for _, line := range strings.Split(val, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			words = append(words, line)
+		}
+	}
+	return words
+}
+
+func (e *Expander) words(name string) ([]string, error) {
+	if words, ok := e.cache[name]; ok {
+		return words, nil
+	}
+	words, err := e.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	e.cache[name] = words
+	return words, nil
+}
+
+// nextToken 找到第一个 {a|b} 分组或 __name__ 引用，没有时返回 nil。未闭合的括号与不合法的名称按普通文本处理
+func (e *Expander) nextToken(s string) (*token, error) {
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '{':
+			end := matchBrace(s, i)
+			if end < 0 {
+				continue
+			}
+			return &token{prefix: s[:i], options: splitOptions(s[i+1 : end]), rest: s[end+1:]}, nil
+		case strings.HasPrefix(s[i:], "__"):
+			end := strings.Index(s[i+2:], "__")
+			if end <= 0 || !IsWildcardName(s[i+2:i+2+end]) {
+				continue
+			}
+			words, err := e.words(s[i+2 : i+2+end])
+			if err != nil {
+				return nil, err
+			}
+			return &token{prefix: s[:i], options: words, rest: s[i+2+end+2:]}, nil
+		}
+	}
+	return nil, nil
+}
+
+// matchBrace 返回与 start 处左括号匹配的右括号位置
+func matchBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitOptions 按最外层的 | 切分分组内的选项，嵌套的分组保持原样留待后续展开
+func splitOptions(s string) []string {
+	options := []string{}
+	depth, last := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '|':
+			if depth == 0 {
+				options = append(options, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(options, s[last:])
+}
+
+// consume 处理一个分组或引用前扣减预算
+func (e *Expander) consume() error {
+	if e.budget <= 0 {
+		return ErrTooLarge
+	}
+	e.budget--
+	return nil
+}
+
+// Random 每个分组随机选取一个选项
+func (e *Expander) Random(s string) (string, error) {
+	return e.expandRandom(s, 0)
+}
+
+// expandRandom depth 只在展开选项内部嵌套的分组时增加，同一层中依次出现的分组不计入层数，只消耗预算
+func (e *Expander) expandRandom(s string, depth int) (string, error) {
+	if depth > MaxDepth {
+		return "", ErrTooDeep
+	}
+	var sb strings.Builder
+	for {
+		t, err := e.nextToken(s)
+		if err != nil {
+			return "", err
+		}
+		if t == nil {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if err := e.consume(); err != nil {
+			return "", err
+		}
+		option, err := e.expandRandom(t.options[rand.Intn(len(t.options))], depth+1)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(t.prefix)
+		sb.WriteString(option)
+		s = t.rest
+	}
+}
+
+// All 展开所有组合，数量超过 limit 时立即返回 ErrTooManyPrompts
+func (e *Expander) All(s string, limit int) ([]string, error) {
+	return e.expandAll(s, 0, limit)
+}
+
+// expandAll 层数与预算的计算方式同 expandRandom
+func (e *Expander) expandAll(s string, depth int, limit int) ([]string, error) {
+	if depth > MaxDepth {
+		return nil, ErrTooDeep
+	}
+	result := []string{""}
+	for {
+		t, err := e.nextToken(s)
+		if err != nil {
+			return nil, err
+		}
+		if t == nil {
+			for i := range result {
+				result[i] += s
+			}
+			return result, nil
+		}
+		if err := e.consume(); err != nil {
+			return nil, err
+		}
+		options := []string{}
+		for _, option := range t.options {
+			expanded, err := e.expandAll(option, depth+1, limit-len(options))
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, expanded...)
+			if len(options) > limit {
+				return nil, ErrTooManyPrompts
+			}
+		}
+		if len(result)*len(options) > limit {
+			return nil, ErrTooManyPrompts
+		}
+		combined := make([]string, 0, len(result)*len(options))
+		for _, head := range result {
+			for _, option := range options {
+				combined = append(combined, head+t.prefix+option)
+			}
+		}
+		result = combined
+		s = t.rest
+	}
+}
@@ -0,0 +1,139 @@
+package dynprompt
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var errUnknown = errors.New("unknown wildcard")
+
+var wildcards = map[string][]string{
+	"color": {"red", "blue"},
+	"mood":  {"{happy|sad}"},
+	"loop":  {"__loop__ again"},
+}
+
+func lookup(name string) ([]string, error) {
+	if words, ok := wildcards[name]; ok {
+		return words, nil
+	}
+	return nil, errUnknown
+}
+
+func TestAll(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		limit  int
+		want   []string
+		err    error
+	}{
+		{name: "plain", prompt: "a cat", limit: 4, want: []string{"a cat"}},
+		{name: "group", prompt: "a {red|blue} cat", limit: 4, want: []string{"a red cat", "a blue cat"}},
+		{name: "nested", prompt: "{x|{y|z}}", limit: 4, want: []string{"x", "y", "z"}},
+		{name: "sequential", prompt: "{a|b}{c|d}", limit: 4, want: []string{"ac", "ad", "bc", "bd"}},
+		{name: "empty option", prompt: "a{| big} cat", limit: 4, want: []string{"a cat", "a big cat"}},
+		{name: "empty group", prompt: "a{}b", limit: 4, want: []string{"ab"}},
+		{name: "unclosed brace", prompt: "{a|b", limit: 4, want: []string{"{a|b"}},
+		{name: "wildcard", prompt: "__color__ cat", limit: 4, want: []string{"red cat", "blue cat"}},
+		{name: "group in wildcard", prompt: "__mood__ dog", limit: 4, want: []string{"happy dog", "sad dog"}},
+		{name: "wildcard in group", prompt: "{__color__|green}", limit: 4, want: []string{"red", "blue", "green"}},
+		{name: "invalid wildcard name", prompt: "__a b__", limit: 4, want: []string{"__a b__"}},
+		{name: "unknown wildcard", prompt: "a __shape__", limit: 4, err: errUnknown},
+		{name: "at the cap", prompt: "{a|b}{c|d}{e|f}", limit: 8, want: []string{"ace", "acf", "ade", "adf", "bce", "bcf", "bde", "bdf"}},
+		{name: "over the cap", prompt: "{a|b}{c|d}{e|f}", limit: 7, err: ErrTooManyPrompts},
+		{name: "nested over the cap", prompt: "{{a|b|c}|{d|e|f}}", limit: 5, err: ErrTooManyPrompts},
+		{name: "recursive wildcard", prompt: "__loop__", limit: 4, err: ErrTooDeep},
+		{name: "too many groups", prompt: strings.Repeat("{a}", MaxExpansions+1), limit: 4, err: ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewExpander(lookup).All(tt.prompt, tt.limit)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expanding %q, the error is %v, want %v", tt.prompt, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expanding %q got %q, want %q", tt.prompt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandom(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		want   []string // any of them
+		err    error
+	}{
+		{name: "group", prompt: "a {red|blue} cat", want: []string{"a red cat", "a blue cat"}},
+		{name: "nested", prompt: "{x|{y|z}}", want: []string{"x", "y", "z"}},
+		{name: "empty option", prompt: "a{|n} cat", want: []string{"a cat", "an cat"}},
+		{name: "wildcard", prompt: "__mood__", want: []string{"happy", "sad"}},
+		{name: "unknown wildcard", prompt: "__shape__", err: errUnknown},
+		{name: "recursive wildcard", prompt: "__loop__", err: ErrTooDeep},
+		// sequential groups only consume the budget, they do not count as nesting
+		{name: "many sequential groups", prompt: strings.Repeat("{a}", MaxDepth*2), want: []string{strings.Repeat("a", MaxDepth*2)}},
+		{name: "too many groups", prompt: strings.Repeat("{a}", MaxExpansions+1), err: ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// random picks are checked against every possible result a few times
+			for i := 0; i < 10; i++ {
+				got, err := NewExpander(lookup).Random(tt.prompt)
+				if tt.err != nil {
+					if !errors.Is(err, tt.err) {
+						t.Fatalf("expanding %q, the error is %v, want %v", tt.prompt, err, tt.err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !contains(tt.want, got) {
+					t.Fatalf("expanding %q got %q, want one of %q", tt.prompt, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWildcardLookupIsCached(t *testing.T) {
+	calls := 0
+	expander := NewExpander(func(name string) ([]string, error) {
+		calls++
+		return lookup(name)
+	})
+	if _, err := expander.All("__color__ and __color__", 4); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("wildcard is looked up %d times in one expansion", calls)
+	}
+}
+
+func TestIsWildcardName(t *testing.T) {
+	tests := map[string]bool{"color": true, "art-style_2": true, "": false, "a b": false, "颜色": false, "a|b": false}
+	for name, want := range tests {
+		if got := IsWildcardName(name); got != want {
+			t.Errorf("IsWildcardName(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func contains(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// Package imagehash 计算图片的感知哈希，视觉上相似的图片哈希的汉明距离较小
+package imagehash
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/bits"
+	"sort"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// gray 缩放为 w x h 的灰度图，缩放时已平滑掉高频细节
+func gray(img image.Image, w int, h int) *image.Gray {
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// DHash 差异哈希，比较 9x8 灰度图每行相邻像素的亮度
+func DHash(img image.Image) uint64 {
+	g := gray(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if g.GrayAt(x, y).Y < g.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// PHash 感知哈希，取 32x32 灰度图离散余弦变换后左上角 8x8 的低频系数与其中位数比较
+func PHash(img image.Image) uint64 {
+	const size, low = 32, 8
+	g := gray(img, size, size)
+	pixels := make([][]float64, size)
+	for y := range pixels {
+		pixels[y] = make([]float64, size)
+		for x := range pixels[y] {
+			pixels[y][x] = float64(g.GrayAt(x, y).Y)
+		}
+	}
+	coef := dct2(pixels, low)
+	flat := make([]float64, 0, low*low)
+	for y := 0; y < low; y++ {
+		flat = append(flat, coef[y]...)
+	}
+	// 直流分量代表整体亮度，不参与中位数的计算
+	sorted := append([]float64{}, flat[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	var hash uint64
+	for _, c := range flat {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// dct2 二维 DCT-II，只计算前 n x n 个系数
+func dct2(pixels [][]float64, n int) [][]float64 {
+	size := len(pixels)
+	cos := make([][]float64, n)
+	for u := range cos {
+		cos[u] = make([]float64, size)
+		for x := range cos[u] {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / float64(2*size))
+		}
+	}
+	// 先对行变换，再对列变换
+	rows := make([][]float64, size)
+	for y := range rows {
+		rows[y] = make([]float64, n)
+		for u := 0; u < n; u++ {
+			for x := 0; x < size; x++ {
+				rows[y][u] += pixels[y][x] * cos[u][x]
+			}
+		}
+	}
+	result := make([][]float64, n)
+	for v := range result {
+		result[v] = make([]float64, n)
+		for u := 0; u < n; u++ {
+			for y := 0; y < size; y++ {
+				result[v][u] += rows[y][u] * cos[v][y]
+			}
+		}
+	}
+	return result
+}
+
+// Distance 两个哈希的汉明距离
+func Distance(a uint64, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,141 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleSystem string = "system"
+	RoleUser   string = "user"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Client 对话补全客户端，返回模型的回复内容
+type Client interface {
+	Complete(ctx context.Context, messages []Message) (string, error)
+	// Model 用于区分不同模型的输出，例如作为缓存 key 的一部分
+	Model() string
+}
+
+type Config struct {
+	ApiUrl      string // base url of an openai compatible api, e.g. https://api.openai.com/v1
+	ApiKey      string
+	Model       string
+	Temperature float64
+	MaxTokens   int
+	HttpClient  *http.Client
+}
+
+// OpenAIClient 兼容 openai /chat/completions 接口的客户端
+type OpenAIClient struct {
+	cfg Config
+}
+
+// APIError 接口返回的非 2xx 应答
+type APIError struct {
+	StatusCode int
+	Type       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("chat completions %d %s: %s", e.StatusCode, e.Type, e.Message)
+}
+
+type completionReq struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Temperature float64   `json:"temperature"`
+	MaxTokens   int       `json:"max_tokens,omitempty"`
+}
+
+type completionResp struct {
+	Choices []struct {
+		Message Message `json:"message"`
+	} `json:"choices"`
+}
+
+type errorResp struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewOpenAIClient(cfg Config) *OpenAIClient {
+	if cfg.HttpClient == nil {
+		cfg.HttpClient = http.DefaultClient
+	}
+	cfg.ApiUrl = strings.TrimSuffix(cfg.ApiUrl, "/")
+	return &OpenAIClient{cfg: cfg}
+}
+
+func (c *OpenAIClient) Model() string {
+	return c.cfg.Model
+}
+
+func (c *OpenAIClient) Complete(ctx context.Context, messages []Message) (string, error) {
+	body, _ := json.Marshal(completionReq{
+		Model:       c.cfg.Model,
+		Messages:    messages,
+		Temperature: c.cfg.Temperature,
+		MaxTokens:   c.cfg.MaxTokens,
+	})
+	r, err := http.NewRequestWithContext(ctx, "POST", c.cfg.ApiUrl+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+c.cfg.ApiKey)
+	resp, err := c.cfg.HttpClient.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: string(b)}
+		e := errorResp{}
+		if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+			apiErr.Type = e.Error.Type
+			apiErr.Message = e.Error.Message
+		}
+		return "", apiErr
+	}
+	result := completionResp{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", errors.New("chat completions returned no choice")
+	}
+	return strings.TrimSpace(result.Choices[0].Message.Content), nil
+}
+
+// Stub 离线使用的客户端，不发起任何网络请求，原样返回最后一条用户消息
+type Stub struct {
+}
+
+func (Stub) Model() string {
+	return "stub"
+}
+
+func (Stub) Complete(ctx context.Context, messages []Message) (string, error) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == RoleUser {
+			return messages[i].Content, nil
+		}
+	}
+	return "", errors.New("no user message")
+}
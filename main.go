@@ -1,15 +1,43 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"idraw-server/api/endpoint"
+	"idraw-server/api/middleware"
+	"idraw-server/api/openapi"
+	"idraw-server/db"
+	"idraw-server/service"
+	"idraw-server/telemetry"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
-const addr = ":8388"
+const (
+	addr = ":8388"
+	// drainDelay 停机前保持未就绪状态的时间，让负载均衡有机会摘除该实例
+	drainDelay      = 5 * time.Second
+	shutdownTimeout = 30 * time.Second
+)
+
+var probePaths = []string{"/ping", "/healthz", "/readyz"}
+
+// commands 运维子命令，以 idraw-server <command> [flags] 的方式运行
+var commands = map[string]func(args []string){
+	"reconcile": reconcile,
+	"coupons":   coupons,
+	"styles":    styles,
+	"wildcards": wildcards,
+}
 
 func customLogFormatter(param gin.LogFormatterParams) string {
 	return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
@@ -25,29 +53,85 @@ func customLogFormatter(param gin.LogFormatterParams) string {
 	)
 }
 
+// trustedProxies 解析逗号分隔的 TRUSTED_PROXIES，未配置时不信任任何代理，以连接的来源地址作为客户端地址
+func trustedProxies() []string {
+	proxies := []string{}
+	for _, item := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			proxies = append(proxies, item)
+		}
+	}
+	if len(proxies) == 0 {
+		return nil
+	}
+	return proxies
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	shutdownTracing, err := telemetry.Setup(context.Background())
+	if err != nil {
+		log.Fatalln("set up tracing failed, the error is", err)
+	}
+	defer shutdownTracing(context.Background())
 	r := gin.New()
+	// 只采信受信任代理设置的 X-Forwarded-For，否则限流可以通过伪造请求头绕过
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalln("invalid env TRUSTED_PROXIES, the error is", err)
+	}
 	r.Use(gin.Recovery())
 	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
 		Formatter: customLogFormatter,
-		SkipPaths: []string{"/ping"},
+		SkipPaths: probePaths,
 	}))
+	r.Use(otelgin.Middleware(telemetry.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+		for _, p := range probePaths {
+			if r.URL.Path == p {
+				return false
+			}
+		}
+		return true
+	})))
+	r.Use(middleware.RateLimit(probePaths...))
 	// health check endpoint
 	r.GET("/ping", func(ctx *gin.Context) {
 		ctx.String(200, "pong")
 	})
+	// 存活检查，不检查外部依赖
+	r.GET("/healthz", endpoint.Liveness)
+	// 就绪检查，检查 redis、db、存储及可选的 provider
+	r.GET("/readyz", endpoint.Readiness)
 	// wechat endpoints
 	wx := r.Group("/api/wx")
 	{
 		wx.GET("/login", endpoint.WeLogin)
+		// 小程序消息推送，校验服务器地址
+		wx.GET("/push", endpoint.VerifyPushUrl)
+		// 小程序消息推送，接收内容安全审核结果等事件
+		wx.POST("/push", endpoint.ReceivePush)
+		// 公众号服务器地址校验
+		wx.GET("/callback", endpoint.VerifyCallbackUrl)
+		// 公众号消息推送，收到文字描述后生成图片并以客服消息下发
+		wx.POST("/callback", endpoint.ReceiveCallback)
+	}
+	// user endpoints
+	users := r.Group("/api/users")
+	{
+		// 当前会员等级下的额度与能力
+		users.GET("/me/entitlements", endpoint.GetEntitlements)
+		// 我的邀请码及邀请记录
+		users.GET("/me/referrals", endpoint.FetchReferrals)
 	}
 	// biz service endpoints
 	app := r.Group("/api/images")
 	{
 		// 获取每日限额
 		app.GET("/dailyLimits", endpoint.GetDailyLimits)
-		// 增加每日限额
-		app.POST("/dailyLimits", endpoint.IncreaseDailyLimits)
 		// 当前使用值
 		app.GET("/currentUsages", endpoint.GetCurrentUsages)
 		// 文件下载
@@ -56,14 +140,248 @@ func main() {
 		app.GET("/records", endpoint.FetchRecords)
 		// 生成纪录总数查询
 		app.GET("/records/count", endpoint.FetchRecordsCount)
+		// 合成分享海报
+		app.POST("/records/:id/poster", endpoint.CreatePoster)
 		// 文件上传
 		app.POST("", endpoint.UploadFile)
+		// 查询视觉上相似的图片
+		app.GET("/similar", endpoint.FetchSimilarImages)
 		// 根据场景描述产出符合场景的图片
 		app.POST("/generations", endpoint.GenerateImagesByPrompt)
 		// 根据图片产出其变体
 		app.POST("/variations", endpoint.GenerateImageVariationsByImage)
+		// 生成任务进度事件流（SSE）
+		app.GET("/tasks/:id/events", endpoint.StreamTaskEvents)
+	}
+	// 风格预设列表
+	r.GET("/api/styles", endpoint.FetchStyles)
+	// 动态描述可引用的词表
+	r.GET("/api/wildcards", endpoint.FetchWildcards)
+	// public gallery endpoints
+	gallery := r.Group("/api/gallery")
+	{
+		// 画廊列表（最新、热门）
+		gallery.GET("", endpoint.FetchGallery)
+		// 发布生成记录到画廊
+		gallery.POST("", endpoint.Publish)
+		// 作品详情
+		gallery.GET("/:token", endpoint.FetchPublication)
+		// 取消发布
+		gallery.DELETE("/:token", endpoint.Unpublish)
+		// 作品图片
+		gallery.GET("/:token/images/:index", endpoint.ServeGalleryImage)
+		// 点赞
+		gallery.POST("/:token/like", endpoint.Like)
+		// 取消点赞
+		gallery.DELETE("/:token/like", endpoint.Unlike)
+	}
+	// 分享页，小程序外打开分享链接时展示
+	r.GET("/s/:token", endpoint.SharePage)
+	// credits and payment endpoints
+	credits := r.Group("/api/credits")
+	{
+		// 次数包列表
+		credits.GET("/packs", endpoint.GetCreditPacks)
+		// 已购次数余额
+		credits.GET("/balance", endpoint.GetCreditBalance)
+		// 兑换码兑换次数
+		credits.POST("/redeem", endpoint.RedeemCoupon)
+	}
+	// check-in and rewarded ad endpoints
+	bonus := r.Group("/api/bonus")
+	{
+		// 今日签到状态
+		bonus.GET("/checkin", endpoint.GetCheckIn)
+		// 每日签到
+		bonus.POST("/checkin", endpoint.CheckIn)
+		// 展示激励视频前获取 nonce
+		bonus.POST("/ads/nonce", endpoint.IssueAdNonce)
+		// 激励视频看完后领取奖励
+		bonus.POST("/ads/complete", endpoint.RewardAd)
+	}
+	payments := r.Group("/api/payments")
+	{
+		// 创建订单并下单
+		payments.POST("/orders", endpoint.CreateOrder)
+		// 订单列表
+		payments.GET("/orders", endpoint.FetchOrders)
+		// 查询订单
+		payments.GET("/orders/:outTradeNo", endpoint.QueryOrder)
+		// 关闭订单
+		payments.POST("/orders/:outTradeNo/close", endpoint.CloseOrder)
+		// 微信支付结果回调
+		payments.POST("/notify", endpoint.PaymentNotify)
+	}
+	// admin endpoints
+	admin := r.Group("/api/admin", middleware.AdminAuth())
+	{
+		// 未通过内容安全审核的图片
+		admin.GET("/media-checks", endpoint.FetchFlaggedImages)
+		// 为用户追加当天的每日额度
+		admin.POST("/dailyLimits", endpoint.IncreaseDailyLimits)
+	}
+	// api docs
+	r.GET(openapi.SpecPath, openapi.ServeSpec)
+	r.GET("/swagger/*any", openapi.ServeSwaggerUI())
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: r,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln("server start up failed, the error is", err)
+		}
+	}()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("received shutdown signal, mark as not ready and drain the traffic")
+	service.MarkDraining()
+	time.Sleep(drainDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("server shutdown failed, the error is", err)
+	}
+	log.Println("server exited")
+}
+
+// reconcile 对比 redis 中的额度缓存与数据库流水，输出不一致的项，-fix 时删除这些缓存
+func reconcile(args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "delete the drifted cache keys so that they are rebuilt from the ledger")
+	fs.Parse(args)
+	drifts, err := service.ReconcileQuotaCache(context.Background(), *fix)
+	if err != nil {
+		log.Fatalln("reconcile quota cache failed, the error is", err)
+	}
+	for _, d := range drifts {
+		fmt.Printf("%s\t%s\tcached=%s\tledger=%d\n", d.User, d.Key, d.Cached, d.Ledger)
+	}
+	log.Printf("found %d drifted cache keys, fixed: %t", len(drifts), *fix)
+}
+
+// coupons 兑换码管理：mint 生成一批兑换码并逐行输出，report 输出各批次的兑换统计
+func coupons(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("usage: idraw-server coupons mint|report [flags]")
+	}
+	switch args[0] {
+	case "mint":
+		fs := flag.NewFlagSet("coupons mint", flag.ExitOnError)
+		name := fs.String("name", "", "batch name, usually the event name")
+		credits := fs.Int("credits", 0, "credits granted per redemption")
+		count := fs.Int("count", 1, "number of codes to mint")
+		maxUses := fs.Int("max-uses", 1, "max redemptions of each code")
+		validFor := fs.Duration("valid-for", 30*24*time.Hour, "codes expire after this duration")
+		fs.Parse(args[1:])
+		codes, err := service.MintCoupons(context.Background(), *name, *credits, *count, *maxUses, time.Now().Add(*validFor))
+		if err != nil {
+			log.Fatalln("mint coupons failed, the error is", err)
+		}
+		for _, code := range codes {
+			fmt.Println(code)
+		}
+	case "report":
+		reports, err := service.CouponReport(context.Background())
+		if err != nil {
+			log.Fatalln("report coupons failed, the error is", err)
+		}
+		fmt.Println("batch\tname\tcredits\tcodes\tmaxUses\tredeemed\tusedUp\texpiredAt")
+		for _, r := range reports {
+			fmt.Printf("%d\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", r.ID, r.Name, r.Credits, r.Codes, r.MaxUses,
+				r.Redeemed, r.UsedUpCode, r.ExpiredTime.Format(time.RFC3339))
+		}
+	default:
+		log.Fatalln("unknown coupons command " + args[0])
+	}
+}
+
+// styles 风格预设管理：list 输出所有风格，save 按 name 新增或更新，enable/disable 启停指定风格
+func styles(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("usage: idraw-server styles list|save|enable|disable [flags]")
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		all, err := service.AllStyles(ctx)
+		if err != nil {
+			log.Fatalln("list styles failed, the error is", err)
+		}
+		fmt.Println("id\tname\ttitle\tsize\tsort\tenabled\ttemplate\tnegative")
+		for _, s := range all {
+			fmt.Printf("%d\t%s\t%s\t%s\t%d\t%t\t%s\t%s\n", s.ID, s.Name, s.Title, s.DefaultSize, s.Sort, s.Enabled,
+				s.PromptTemplate, s.NegativePrompt)
+		}
+	case "save":
+		fs := flag.NewFlagSet("styles save", flag.ExitOnError)
+		style := db.Style{}
+		fs.StringVar(&style.Name, "name", "", "unique slug of the style")
+		fs.StringVar(&style.Title, "title", "", "display title")
+		fs.StringVar(&style.PromptTemplate, "template", "", "prompt template with a {prompt} placeholder")
+		fs.StringVar(&style.NegativePrompt, "negative", "", "things to avoid")
+		fs.StringVar(&style.DefaultSize, "size", "512x512", "default size")
+		fs.IntVar(&style.Sort, "sort", 0, "display order, ascending")
+		fs.BoolVar(&style.Enabled, "enabled", true, "whether the style is available")
+		fs.Parse(args[1:])
+		saved, err := service.SaveStyle(ctx, style)
+		if err != nil {
+			log.Fatalln("save style failed, the error is", err)
+		}
+		log.Printf("style %s saved with id %d", saved.Name, saved.ID)
+	case "enable", "disable":
+		if len(args) < 2 {
+			log.Fatalln("usage: idraw-server styles " + args[0] + " <name>")
+		}
+		if err := service.SetStyleEnabled(ctx, args[1], args[0] == "enable"); err != nil {
+			log.Fatalln(args[0]+" style failed, the error is", err)
+		}
+	default:
+		log.Fatalln("unknown styles command " + args[0])
+	}
+}
+
+// wildcards 词表管理：list 输出所有词表，save 新增或替换词表，delete 删除词表
+func wildcards(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("usage: idraw-server wildcards list|save|delete [flags]")
 	}
-	if err := r.Run(addr); err != nil {
-		log.Println("server start up failed")
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		all, err := service.FetchWildcards(ctx)
+		if err != nil {
+			log.Fatalln("list wildcards failed, the error is", err)
+		}
+		for _, w := range all {
+			fmt.Printf("__%s__\t%d\t%s\n", w.Name, w.Count, strings.Join(w.Samples, ", "))
+		}
+	case "save":
+		fs := flag.NewFlagSet("wildcards save", flag.ExitOnError)
+		name := fs.String("name", "", "referenced as __name__ in prompts")
+		words := fs.String("words", "", "comma separated words")
+		file := fs.String("file", "", "file with one word or phrase per line, used instead of -words")
+		fs.Parse(args[1:])
+		list := strings.Split(*words, ",")
+		if *file != "" {
+			b, err := os.ReadFile(*file)
+			if err != nil {
+				log.Fatalln("read words failed, the error is", err)
+			}
+			list = strings.Split(string(b), "\n")
+		}
+		if err := service.SaveWildcard(ctx, *name, list); err != nil {
+			log.Fatalln("save wildcard failed, the error is", err)
+		}
+	case "delete":
+		if len(args) < 2 {
+			log.Fatalln("usage: idraw-server wildcards delete <name>")
+		}
+		if err := service.DeleteWildcard(ctx, args[1]); err != nil {
+			log.Fatalln("delete wildcard failed, the error is", err)
+		}
+	default:
+		log.Fatalln("unknown wildcards command " + args[0])
 	}
 }
@@ -0,0 +1,159 @@
+// Package poster 将生成的图片、描述、作者及小程序码合成为一张分享海报
+package poster
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	Width = 750
+
+	margin       = 40
+	captionSize  = 32
+	captionLines = 4
+	footerSize   = 24
+	hintSize     = 16
+	codeSize     = 160
+	lineGap      = 12
+)
+
+var (
+	background = color.White
+	textColor  = color.RGBA{R: 0x22, G: 0x22, B: 0x22, A: 0xff}
+	hintColor  = color.RGBA{R: 0x88, G: 0x88, B: 0x88, A: 0xff}
+)
+
+// Spec 海报的内容，Code 为空时不绘制小程序码
+type Spec struct {
+	Image   image.Image
+	Caption string
+	Author  string
+	Hint    string // text next to the code, e.g. how to open the mini-program
+	Code    image.Image
+}
+
+// Composer 持有解析后的字体，可并发使用
+type Composer struct {
+	font *opentype.Font
+}
+
+// LoadFont 解析 path 指定的 TrueType/OpenType 字体，需包含 CJK 字形，例如 Noto Sans SC
+func LoadFont(path string) (*opentype.Font, error) {
+	if path == "" {
+		return nil, errors.New("font path is empty")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.Parse(data)
+}
+
+func NewComposer(f *opentype.Font) *Composer {
+	return &Composer{font: f}
+}
+
+func (c *Composer) face(size float64) (font.Face, error) {
+	return opentype.NewFace(c.font, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// Compose 自上而下依次绘制图片、描述，底部左侧为作者及提示，右侧为小程序码
+func (c *Composer) Compose(spec Spec) (*image.RGBA, error) {
+	caption, err := c.face(captionSize)
+	if err != nil {
+		return nil, err
+	}
+	defer caption.Close()
+	footer, err := c.face(footerSize)
+	if err != nil {
+		return nil, err
+	}
+	defer footer.Close()
+	hint, err := c.face(hintSize)
+	if err != nil {
+		return nil, err
+	}
+	defer hint.Close()
+
+	contentWidth := Width - 2*margin
+	b := spec.Image.Bounds()
+	imageHeight := b.Dy() * contentWidth / b.Dx()
+	lines := wrap(caption, spec.Caption, contentWidth, captionLines)
+	captionHeight := len(lines) * (captionSize + lineGap)
+	height := margin + imageHeight + margin + captionHeight + codeSize + margin
+
+	dst := image.NewRGBA(image.Rect(0, 0, Width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	imageRect := image.Rect(margin, margin, margin+contentWidth, margin+imageHeight)
+	xdraw.CatmullRom.Scale(dst, imageRect, spec.Image, b, draw.Over, nil)
+
+	y := imageRect.Max.Y + margin
+	for _, line := range lines {
+		drawText(dst, caption, textColor, margin, y+captionSize, line)
+		y += captionSize + lineGap
+	}
+	footerTop := y
+	if spec.Author != "" {
+		drawText(dst, footer, textColor, margin, footerTop+codeSize/2, "@"+spec.Author)
+	}
+	if spec.Hint != "" {
+		drawText(dst, hint, hintColor, margin, footerTop+codeSize/2+footerSize+lineGap, spec.Hint)
+	}
+	if spec.Code != nil {
+		codeRect := image.Rect(Width-margin-codeSize, footerTop, Width-margin, footerTop+codeSize)
+		xdraw.CatmullRom.Scale(dst, codeRect, spec.Code, spec.Code.Bounds(), draw.Over, nil)
+	}
+	return dst, nil
+}
+
+func drawText(dst draw.Image, face font.Face, c color.Color, x int, baseline int, text string) {
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(c), Face: face, Dot: fixed.P(x, baseline)}
+	d.DrawString(text)
+}
+
+// wrap 按字符折行，超出 maxLines 时截断并以省略号结尾
+func wrap(face font.Face, text string, width int, maxLines int) []string {
+	text = strings.Join(strings.Fields(text), " ")
+	if text == "" {
+		return nil
+	}
+	limit := fixed.I(width)
+	ellipsis := font.MeasureString(face, "…")
+	lines := []string{}
+	line := []rune{}
+	var lineWidth fixed.Int26_6
+	for _, r := range text {
+		advance, ok := face.GlyphAdvance(r)
+		if !ok {
+			continue
+		}
+		if lineWidth+advance > limit {
+			if len(lines) == maxLines-1 {
+				for lineWidth+ellipsis > limit && len(line) > 0 {
+					a, _ := face.GlyphAdvance(line[len(line)-1])
+					lineWidth -= a
+					line = line[:len(line)-1]
+				}
+				return append(lines, string(line)+"…")
+			}
+			lines = append(lines, strings.TrimSpace(string(line)))
+			line, lineWidth = line[:0], 0
+			if r == ' ' {
+				continue
+			}
+		}
+		line = append(line, r)
+		lineWidth += advance
+	}
+	return append(lines, string(line))
+}
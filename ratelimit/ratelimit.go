@@ -0,0 +1,65 @@
+// Package ratelimit 基于 redis 有序集合的滑动窗口限流，多副本共享同一份计数
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slidingWindowScript 以有序集合记录窗口内每次请求的时间戳，超限时返回最早一次请求离开窗口的剩余毫秒数
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+local count = redis.call('ZCARD', key)
+if count < limit then
+	redis.call('ZADD', key, now, ARGV[4])
+	redis.call('PEXPIRE', key, window)
+	return {1, limit - count - 1, window}
+end
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return {0, 0, tonumber(oldest[2]) + window - now}
+`)
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter 窗口内最早一次请求过期所需的时间，被拒绝时即为建议的重试间隔
+	ResetAfter time.Duration
+}
+
+// Limiter 计数保存在 prefix + key 下
+type Limiter struct {
+	client redis.Scripter
+	prefix string
+	now    func() time.Time
+}
+
+func New(client redis.Scripter, prefix string) *Limiter {
+	return &Limiter{client: client, prefix: prefix, now: time.Now}
+}
+
+// Allow 记录一次请求并判断是否在 window 内超过 limit 次，恰好经过 window 的请求已离开窗口。
+// redis 出错时返回允许的结果及错误，由调用方决定是否放行
+func (l *Limiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (Result, error) {
+	now := l.now().UnixMilli()
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+	vals, err := slidingWindowScript.Run(ctx, l.client, []string{l.prefix + key},
+		now, window.Milliseconds(), limit, member).Int64Slice()
+	if err != nil {
+		return Result{Allowed: true, Limit: limit, Remaining: limit}, err
+	}
+	return Result{
+		Allowed:    vals[0] == 1,
+		Limit:      limit,
+		Remaining:  int(vals[1]),
+		ResetAfter: time.Duration(vals[2]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// clock the time returned to the limiter, moved forward by the tests
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newTestLimiter(t *testing.T) (*Limiter, *clock) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(client, "ratelimit-")
+	l.now = c.now
+	return l, c
+}
+
+func TestAllowUpToLimit(t *testing.T) {
+	ctx := context.Background()
+	l, c := newTestLimiter(t)
+	tests := []struct {
+		elapsed time.Duration
+		want    Result
+	}{
+		{elapsed: 0, want: Result{Allowed: true, Limit: 3, Remaining: 2, ResetAfter: time.Minute}},
+		{elapsed: 10 * time.Second, want: Result{Allowed: true, Limit: 3, Remaining: 1, ResetAfter: time.Minute}},
+		{elapsed: 20 * time.Second, want: Result{Allowed: true, Limit: 3, Remaining: 0, ResetAfter: time.Minute}},
+		// denied until the first request leaves the window
+		{elapsed: 30 * time.Second, want: Result{Allowed: false, Limit: 3, Remaining: 0, ResetAfter: 30 * time.Second}},
+		{elapsed: 45 * time.Second, want: Result{Allowed: false, Limit: 3, Remaining: 0, ResetAfter: 15 * time.Second}},
+	}
+	start := c.t
+	for _, tt := range tests {
+		c.t = start.Add(tt.elapsed)
+		got, err := l.Allow(ctx, "user-1", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Fatalf("request after %s got %+v, want %+v", tt.elapsed, got, tt.want)
+		}
+	}
+	// another key has its own count
+	if got, err := l.Allow(ctx, "user-2", 3, time.Minute); err != nil || !got.Allowed {
+		t.Fatalf("request of another key is denied, result: %+v, the error is %v", got, err)
+	}
+}
+
+func TestAllowWindowBoundary(t *testing.T) {
+	ctx := context.Background()
+	l, c := newTestLimiter(t)
+	start := c.t
+	tests := []struct {
+		elapsed time.Duration
+		allowed bool
+	}{
+		{elapsed: 0, allowed: true},
+		{elapsed: time.Minute - time.Millisecond, allowed: false},
+		// the first request is exactly one window old and no longer counts
+		{elapsed: time.Minute, allowed: true},
+		{elapsed: 2*time.Minute - time.Millisecond, allowed: false},
+		{elapsed: 2 * time.Minute, allowed: true},
+	}
+	for _, tt := range tests {
+		c.t = start.Add(tt.elapsed)
+		got, err := l.Allow(ctx, "user-1", 1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Allowed != tt.allowed {
+			t.Fatalf("request after %s is allowed: %t, want %t", tt.elapsed, got.Allowed, tt.allowed)
+		}
+	}
+}
+
+func TestAllowDeniedRequestIsNotCounted(t *testing.T) {
+	ctx := context.Background()
+	l, c := newTestLimiter(t)
+	start := c.t
+	for _, elapsed := range []time.Duration{0, 30 * time.Second, 50 * time.Second} {
+		c.t = start.Add(elapsed)
+		if _, err := l.Allow(ctx, "user-1", 1, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the denied requests do not extend the window
+	c.t = start.Add(time.Minute)
+	if got, err := l.Allow(ctx, "user-1", 1, time.Minute); err != nil || !got.Allowed {
+		t.Fatalf("request after the window is denied, result: %+v, the error is %v", got, err)
+	}
+}
+
+func TestAllowRedisError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	mr.Close()
+	got, err := New(client, "ratelimit-").Allow(context.Background(), "user-1", 3, time.Minute)
+	if err == nil {
+		t.Fatal("redis error is not returned")
+	}
+	if got != (Result{Allowed: true, Limit: 3, Remaining: 3}) {
+		t.Fatalf("request is not allowed when redis fails, result: %+v", got)
+	}
+}
@@ -0,0 +1,224 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/telemetry"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// accessTokenMargin 缓存比凭证早一些过期，避免使用时刚好失效
+	accessTokenMargin = time.Minute
+	// accessTokenRefreshAhead 缓存剩余时间少于该值时提前刷新，稳定版接口在凭证过期前 5 分钟内才会返回新凭证
+	accessTokenRefreshAhead = 4 * time.Minute
+	accessTokenLockTTL      = 10 * time.Second
+	// accessTokenWait 未抢到刷新锁时等待其他副本刷新的最长时间
+	accessTokenWait = 5 * time.Second
+)
+
+// releaseLockScript 只释放自己持有的锁
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// tokenSource 一个公众号或小程序的接口调用凭证，多个副本共享 redis 中缓存的同一个凭证
+type tokenSource struct {
+	name   string // used in the logs
+	appId  string
+	secret string
+	key    string // cache key of the token, the refresh lock is key + "-lock"
+}
+
+// miniProgramTokens 小程序的接口调用凭证
+var miniProgramTokens = &tokenSource{name: "mini program", appId: getWeAppId(), secret: getWeAppSecret(), key: "wx-access-token"}
+
+type stableTokenReq struct {
+	GrantType    string `json:"grant_type"`
+	AppId        string `json:"appid"`
+	Secret       string `json:"secret"`
+	ForceRefresh bool   `json:"force_refresh"`
+}
+
+type stableTokenResp struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	ErrCode     int    `json:"errcode"`
+	ErrMsg      string `json:"errmsg"`
+}
+
+// refreshAccessTokenAhead 凭证即将过期时提前刷新
+func refreshAccessTokenAhead(ctx context.Context) {
+	miniProgramTokens.refreshAhead(ctx)
+	if oaTokens != nil {
+		oaTokens.refreshAhead(ctx)
+	}
+}
+
+// withAccessToken 以小程序的接口调用凭证调用 call
+func withAccessToken(ctx context.Context, call func(token string) error) error {
+	return miniProgramTokens.with(ctx, call)
+}
+
+// refreshAhead 没有缓存的凭证时不做任何事，使用时再获取
+func (s *tokenSource) refreshAhead(ctx context.Context) {
+	ttl, err := redisCli.TTL(ctx, s.key).Result()
+	if err != nil || ttl <= 0 || ttl >= accessTokenRefreshAhead {
+		return
+	}
+	if _, err := s.refresh(ctx, ""); err != nil {
+		log.Printf("failed to refresh the %s access token ahead of expiry, the error is %s", s.name, err)
+	}
+}
+
+func (s *tokenSource) get(ctx context.Context) (string, error) {
+	token, err := redisCli.Get(ctx, s.key).Result()
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, redis.Nil) {
+		log.Printf("failed to read the cached %s access token, the error is %s", s.name, err)
+	}
+	return s.refresh(ctx, "")
+}
+
+// with 以接口调用凭证调用 call，凭证失效时强制刷新并重试一次
+func (s *tokenSource) with(ctx context.Context, call func(token string) error) error {
+	token, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = call(token)
+	if !isInvalidAccessToken(err) {
+		return err
+	}
+	log.Printf("the %s access token is invalid, refresh and retry, the error is %s", s.name, err)
+	if token, err = s.refresh(ctx, token); err != nil {
+		return err
+	}
+	return call(token)
+}
+
+// isInvalidAccessToken 40001 凭证无效、40014 不合法、42001 已过期
+func isInvalidAccessToken(err error) bool {
+	apiErr := &weChatApiError{}
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrCode {
+	case 40001, 40014, 42001:
+		return true
+	default:
+		return false
+	}
+}
+
+// refresh 在分布式锁内刷新凭证，只有一个副本会请求微信，其余副本等待其写入缓存。
+// invalid 为调用方确认已失效的凭证，缓存中仍是该凭证时强制刷新
+func (s *tokenSource) refresh(ctx context.Context, invalid string) (string, error) {
+	ctx, span := tracer.Start(ctx, "wechat.refreshAccessToken")
+	defer span.End()
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	owner := hex.EncodeToString(b)
+	deadline := time.Now().Add(accessTokenWait)
+	for {
+		acquired, err := redisCli.SetNX(ctx, s.key+"-lock", owner, accessTokenLockTTL).Result()
+		if err != nil {
+			return "", err
+		}
+		if acquired {
+			defer releaseLockScript.Run(telemetry.Detach(ctx), redisCli, []string{s.key + "-lock"}, owner)
+			return s.refreshLocked(ctx, invalid)
+		}
+		// 其他副本正在刷新，等待其写入新的凭证
+		if token, ok := s.usable(ctx, invalid); ok {
+			return token, nil
+		}
+		if time.Now().After(deadline) {
+			return "", errors.New("timed out waiting for another replica to refresh the access token")
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// usable 缓存中不是已失效的凭证，且不需要提前刷新
+func (s *tokenSource) usable(ctx context.Context, invalid string) (string, bool) {
+	pipe := redisCli.Pipeline()
+	get := pipe.Get(ctx, s.key)
+	ttl := pipe.TTL(ctx, s.key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", false
+	}
+	token := get.Val()
+	return token, token != "" && token != invalid && ttl.Val() >= accessTokenRefreshAhead
+}
+
+func (s *tokenSource) refreshLocked(ctx context.Context, invalid string) (string, error) {
+	// 拿到锁时其他副本可能已经刷新过
+	if token, ok := s.usable(ctx, invalid); ok {
+		return token, nil
+	}
+	cached, _ := redisCli.Get(ctx, s.key).Result()
+	force := invalid != "" && cached == invalid
+	result, err := s.fetchStable(ctx, force)
+	if err != nil {
+		return "", err
+	}
+	ttl := time.Duration(result.ExpiresIn)*time.Second - accessTokenMargin
+	if err := redisCli.Set(ctx, s.key, result.AccessToken, ttl).Err(); err != nil {
+		log.Printf("failed to cache the %s access token, the error is %s", s.name, err)
+	}
+	log.Printf("refreshed the %s access token, force: %t, expires in %ds", s.name, force, result.ExpiresIn)
+	return result.AccessToken, nil
+}
+
+// fetchStable 调用稳定版接口，非强制刷新时在有效期内重复获取会返回同一个凭证，不会使其他副本持有的凭证失效
+func (s *tokenSource) fetchStable(ctx context.Context, force bool) (*stableTokenResp, error) {
+	body, _ := json.Marshal(stableTokenReq{
+		GrantType:    "client_credential",
+		AppId:        s.appId,
+		Secret:       s.secret,
+		ForceRefresh: force,
+	})
+	r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "POST", weChatApiUrl+"/cgi-bin/stable_token", bytes.NewReader(body))
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return nil, classifyStatus(upstreamWeChat, r.StatusCode, nil)
+	}
+	result := &stableTokenResp{}
+	if err = json.NewDecoder(r.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.ErrCode != 0 {
+		log.Printf("get stable %s access token failed, errcode: %d, errmsg: %s", s.name, result.ErrCode, result.ErrMsg)
+		return nil, weChatError(result.ErrCode, result.ErrMsg)
+	}
+	if result.AccessToken == "" || result.ExpiresIn <= 0 {
+		return nil, fmt.Errorf("unexpected stable token response, expires in %d", result.ExpiresIn)
+	}
+	return result, nil
+}
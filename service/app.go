@@ -5,32 +5,45 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"idraw-server/api/request"
 	"idraw-server/api/response"
+	"idraw-server/apperror"
 	"idraw-server/db"
+	"idraw-server/dynprompt"
+	"idraw-server/telemetry"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
-	"time"
 
+	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sunshineplan/imgconv"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/robfig/cron/v3"
 )
 
+// generationReq provider 的图片生成请求体
+type generationReq struct {
+	Model          string `json:"model,omitempty"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format,omitempty"`
+	User           string `json:"user"`
+}
+
 type generationResp struct {
 	Created int64            `json:"created"`
 	Data    []generationData `json:"data"`
 }
 
 type generationData struct {
-	Url string `json:"url"`
+	Url     string `json:"url"`
+	B64Json string `json:"b64_json"`
 }
 
 type errorResp struct {
@@ -53,39 +66,47 @@ const (
 	typeVariation      string = "VARIATION"
 	prefixDailyLimits  string = "limits-"
 	prefixCurrentUsage string = "usage-"
+	// ask for inline base64 content by default, which saves a second round trip to fetch the image
+	defaultResponseFormat string = "b64_json"
 )
 
 var (
-	ctx          context.Context
 	redisCli     *redis.Client
 	recordMapper db.RecordMapper
+	tracer       = telemetry.Tracer("service")
 )
 
 func init() {
 	validateAppServiceEnvInjections()
 	recordMapper = db.NewRecordMapper()
 	log.Println("create a redis client")
-	ctx = context.Background()
 	redisCli = redis.NewClient(&redis.Options{
 		Addr:     os.Getenv("REDIS_ADDR"),
 		Password: os.Getenv("REDIS_PASSWORD"),
 		DB:       0, // use default DB
 	})
-	log.Println("fire a cron worker to reset the redis value")
+	if err := redisotel.InstrumentTracing(redisCli); err != nil {
+		log.Println("failed to instrument redis client with tracing, the error is", err)
+	}
+	log.Println("fire cron workers to expire the daily quota and purge expired images and blobs")
 	c := cron.New()
 	c.AddFunc("@daily", func() {
-		log.Println("start to reset the redis value")
-		// reset the usages
-		usageIter := redisCli.Scan(ctx, 0, prefixCurrentUsage+"*", 0).Iterator()
-		for usageIter.Next(ctx) {
-			redisCli.Set(ctx, usageIter.Val(), 0, 0)
+		expireDailyQuota(context.Background())
+	})
+	c.AddFunc("@daily", func() {
+		purgeExpiredImages(context.Background())
+		purgeUnreferencedBlobs(context.Background())
+	})
+	c.AddFunc("@every 1m", func() {
+		refreshAccessTokenAhead(context.Background())
+		if notifier != nil {
+			resendNotifications(context.Background())
 		}
-		// reset the limits
-		limitsIter := redisCli.Scan(ctx, 0, prefixDailyLimits+"*", 0).Iterator()
-		for limitsIter.Next(ctx) {
-			redisCli.Set(ctx, limitsIter.Val(), os.Getenv("DAILY_LIMITS"), 0)
+	})
+	c.AddFunc("@every 10m", func() {
+		if mediaChecker != nil {
+			resubmitStaleMediaChecks(context.Background())
 		}
-		log.Println("finished reseting the redis value")
 	})
 	c.Start()
 }
@@ -109,263 +130,340 @@ func getOpenAiApiKey() string {
 	return os.Getenv("OPENAI_API_KEY")
 }
 
-func GetDailyLimits(user string) int {
-	defaultVal := os.Getenv("DAILY_LIMITS")
-	if user == "" {
-		result, _ := strconv.Atoi(defaultVal)
-		return result
-	}
-	val, err := redisCli.Get(ctx, prefixDailyLimits+user).Result()
-	if err != nil {
-		if err == redis.Nil {
-			redisCli.Set(ctx, prefixDailyLimits+user, defaultVal, 0)
-		} else {
-			log.Println("failed to get daily limits, set value as default")
-		}
-		val = defaultVal
-	}
-	limits, _ := strconv.Atoi(val)
-	return limits
-}
-
-func IncreaseDailyLimits(user string, num int) {
-	val, _ := redisCli.Get(ctx, prefixDailyLimits+user).Result()
-	result, _ := strconv.Atoi(val)
-	redisCli.Set(ctx, prefixDailyLimits+user, result+num, 0)
-}
-
-func GetCurrentUsages(user string) int {
-	val, err := redisCli.Get(ctx, prefixCurrentUsage+user).Result()
-	if err != nil {
-		if err == redis.Nil {
-			redisCli.Set(ctx, prefixCurrentUsage+user, 0, 0)
-		} else {
-			log.Println("failed to get current usage, set value as 0")
-		}
-		val = "0"
-	}
-	usages, _ := strconv.Atoi(val)
-	return usages
-}
-
 // ServeFile 提供文件下载功能
-func ServeFile(relativePath string) (*os.File, error) {
-	filePath := dataDir + relativePath
-	return os.Open(filePath)
-}
-
-// UploadFile 接收文件上传，并保存至数据目录（外挂 nas 持久化）
-func UploadFile(req request.FileUploadReq) (string, error) {
-	file := req.File
-	src, err := file.Open()
-	if err != nil {
-		return "", err
-	}
-	defer src.Close()
-	// for security reasons, we just expose the relative path not the full path to the outside world
-	relativeDst := uploadedPath + req.User + "-" + file.Filename
-	if err = os.MkdirAll(filepath.Dir(dataDir+relativeDst), 0750); err != nil {
-		return "", err
+func ServeFile(ctx context.Context, relativePath string) (*os.File, error) {
+	_, span := tracer.Start(ctx, "storage.open")
+	span.SetAttributes(attribute.String("file.path", relativePath))
+	filePath := dataDir + resolvePath(ctx, relativePath)
+	file, err := os.Open(filePath)
+	telemetry.End(span, err)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, apperror.New(apperror.CodeNotFound, err)
 	}
-	out, err := os.Create(dataDir + relativeDst)
-	if err != nil {
-		return "", err
-	}
-	defer out.Close()
-	_, err = io.Copy(out, src)
-	if err != nil {
-		return "", nil
-	}
-	log.Println("saved file in ", dataDir+relativeDst)
-	return relativeDst, nil
+	return file, err
 }
 
-func FetchRecordsCount(openId string) (int, error) {
-	count, err := recordMapper.FetchCountByUser(openId)
-	if err != nil && err.Error() != "record not found" {
+func FetchRecordsCount(ctx context.Context, openId string) (int, error) {
+	count, err := recordMapper.FetchCountByUser(ctx, openId)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
 		log.Printf("fetch user %s's records count failed, the error is %s\n", openId, err)
 		return 0, err
 	}
 	return count, nil
 }
 
-func FetchRecords(openId string, calledType string) ([]response.RecordDto, error) {
+func FetchRecords(ctx context.Context, openId string, calledType string) ([]response.RecordDto, error) {
 	if calledType != typePrompt && calledType != typeVariation {
-		return []response.RecordDto{}, errors.New("not a valid called type")
+		return []response.RecordDto{}, errInvalidType
 	}
-	records, err := recordMapper.FetchByUserAndType(openId, calledType)
-	if err != nil && err.Error() != "record not found" {
+	records, err := recordMapper.FetchByUserAndType(ctx, openId, calledType)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
 		log.Printf("fetch user %s's records failed, the error is %s\n", openId, err)
 		return []response.RecordDto{}, err
 	}
+	hidden, err := fetchHiddenImages(ctx, records)
+	if err != nil {
+		return []response.RecordDto{}, err
+	}
 	result := make([]response.RecordDto, len(records))
 	for i, v := range records {
-		var output []string
+		var output, originals []string
 		_ = json.Unmarshal([]byte(v.Output), &output)
+		_ = json.Unmarshal([]byte(v.Original), &originals)
+		output, originals = filterHidden(hidden, output, originals)
 		dto := response.RecordDto{
-			Id:     v.ID,
-			Type:   v.Type,
-			Input:  v.Input,
-			Output: output,
+			Id:             v.ID,
+			Type:           v.Type,
+			Input:          v.Input,
+			Output:         output,
+			Originals:      originals,
+			Status:         v.Status,
+			StyleId:        v.StyleId,
+			EnhancedPrompt: v.EnhancedPrompt,
+			Prompt:         v.Prompt,
+			Template:       v.Template,
+			BatchId:        v.BatchId,
 		}
 		result[i] = dto
 	}
 	return result, nil
 }
 
-// GenerateImagesByPrompt 根据场景描述产出符合场景的图片
-func GenerateImagesByPrompt(req request.ImageGenerationReq) ([]string, error) {
-	usages := GetCurrentUsages(req.User)
-	log.Printf("do prompt request, current user %s, current usages: %d\n", req.User, usages)
-	if usages >= GetDailyLimits(req.User) {
-		return nil, errors.New("current user has exceeded daily limits")
-	}
-	body, _ := json.Marshal(req)
-	r, err := http.NewRequest("POST", openAiApiUrl+"/generations", bytes.NewBuffer(body))
-	if err != nil {
-		log.Println("build http request failed", err)
-		return nil, err
-	}
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", "Bearer "+getOpenAiApiKey())
-	client := &http.Client{}
-	resp, err := client.Do(r)
-	if err != nil {
-		log.Println("do http request failed, err: ", err)
-		return nil, err
+// GenerateImagesByPrompt 根据场景描述产出符合场景的图片，描述中含有动态语法时先展开
+func GenerateImagesByPrompt(ctx context.Context, req request.ImageGenerationReq) ([]string, error) {
+	log.Printf("do prompt request, current user %s\n", req.User)
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = defaultResponseFormat
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		result := &errorResp{}
-		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
-			b, _ := io.ReadAll(resp.Body)
-			log.Printf("do decode body failed, just print string, status: %s, body: %s\n", resp.Status, string(b))
-			return nil, errors.New(resp.Status)
-		}
-		log.Printf("error response, status is: %s, msg is: %s\n", resp.Status, result.Error.Message)
-		return nil, errors.New(result.Error.Message)
+	acceptSubscriptions(ctx, req.User, req.SubscribedTemplateIds)
+	if dynprompt.IsDynamic(req.Prompt) {
+		return generateDynamicPrompt(ctx, req)
 	}
-	result := &generationResp{}
-	json.NewDecoder(resp.Body).Decode(result)
-	urls := make([]string, len(result.Data))
-	for i, data := range result.Data {
-		// download from the url and save as a file
-		fileUrl, err := saveFile(typePrompt, req.User, data.Url)
+	return generateByPrompt(ctx, req, newTaskProgress(req.TaskId), promptOrigin{})
+}
+
+// promptOrigin 由动态描述展开而来的描述的来源，普通描述为零值
+type promptOrigin struct {
+	template string // dynamic prompt before expansion
+	batchId  string // shared by the prompts of a combinatorial batch
+}
+
+// generateByPrompt 需要时先由 llm 翻译扩写描述，指定风格时再将描述套入风格模板，扩写在等级校验与额度预扣通过后才进行，
+// 未指定尺寸时使用风格的默认尺寸，等级不允许时改用等级允许的最大尺寸
+func generateByPrompt(ctx context.Context, req request.ImageGenerationReq, task *taskProgress, origin promptOrigin) ([]string, error) {
+	var style *db.Style
+	if req.StyleId != 0 {
+		s, err := fetchStyle(ctx, req.StyleId)
 		if err != nil {
-			log.Println("save file error")
-			return []string{}, err
+			task.failed(ctx, err)
+			return nil, err
+		}
+		style = &s
+		if req.Size == "" {
+			_, spec, err := fetchTier(ctx, req.User)
+			if err != nil {
+				task.failed(ctx, err)
+				return nil, err
+			}
+			req.Size = spec.fitSize(style.DefaultSize)
 		}
-		urls[i] = fileUrl
 	}
-	// save record to db
-	jsonStr, _ := json.Marshal(urls)
-	recordMapper.Insert(req.User, typePrompt, req.Prompt, string(jsonStr))
-	// accumulate usages
-	accumulateCurrentUsage(req.User)
-	return urls, nil
+	return generate(ctx, generationJob{
+		task:       task,
+		calledType: typePrompt,
+		user:       req.User,
+		input:      req.Prompt,
+		prompt:     req.Prompt,
+		origin:     origin,
+		notify:     origin.batchId == "",
+		styleId:    req.StyleId,
+		n:          req.N,
+		size:       req.Size,
+		model:      req.Model,
+		// the enhancement is a paid llm call, it only runs once the request is entitled and the quota is reserved
+		prepare: func(ctx context.Context, job *generationJob) {
+			if req.Enhance {
+				task.enhancing(ctx)
+				// fall back to the original prompt, the enhancement is not worth failing the generation
+				if enhanced, err := enhancePrompt(ctx, req.Prompt); err != nil {
+					log.Printf("enhance prompt of user %s failed, use the original one, the error is %s", req.User, err)
+				} else {
+					task.prompt = enhanced
+					job.enhanced = enhanced
+					job.prompt = enhanced
+				}
+			}
+			if style != nil {
+				job.prompt = expandPrompt(*style, job.prompt)
+			}
+		},
+		call: func(ctx context.Context, job *generationJob) (*generationResp, error) {
+			body, _ := json.Marshal(generationReq{
+				Model:          req.Model,
+				Prompt:         job.prompt,
+				N:              req.N,
+				Size:           req.Size,
+				ResponseFormat: req.ResponseFormat,
+				User:           req.User,
+			})
+			ctx, span := tracer.Start(ctx, "provider.generations")
+			span.SetAttributes(attribute.String("image.size", req.Size), attribute.Int("image.n", req.N))
+			result, err := doGenerationRequest(ctx, "/generations", "application/json", body)
+			telemetry.End(span, err)
+			return result, err
+		},
+	})
 }
 
 // GenerateImageVariationsByImage 根据图片产出相应变体图片
-func GenerateImageVariationsByImage(req request.ImageVariationReq) ([]string, error) {
-	usages := GetCurrentUsages(req.User)
-	log.Printf("do variation request, current user %s, current usages: %d\n", req.User, usages)
-	if usages >= GetDailyLimits(req.User) {
-		return nil, errors.New("current user has exceeded daily limits")
+func GenerateImageVariationsByImage(ctx context.Context, req request.ImageVariationReq) ([]string, error) {
+	log.Printf("do variation request, current user %s\n", req.User)
+	if req.ResponseFormat == "" {
+		req.ResponseFormat = defaultResponseFormat
+	}
+	acceptSubscriptions(ctx, req.User, req.SubscribedTemplateIds)
+	return generate(ctx, generationJob{
+		task:       newTaskProgress(req.TaskId),
+		calledType: typeVariation,
+		notify:     true,
+		user:       req.User,
+		input:      req.FilePath,
+		n:          req.N,
+		size:       req.Size,
+		call: func(ctx context.Context, job *generationJob) (*generationResp, error) {
+			fileDst := dataDir + resolvePath(ctx, req.FilePath)
+			file, err := imgconv.Open(fileDst)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil, apperror.New(apperror.CodeNotFound, err)
+				}
+				return nil, err
+			}
+			buf := new(bytes.Buffer)
+			mp := multipart.NewWriter(buf)
+			filePart, _ := mp.CreateFormFile("image", "image.png")
+			imgconv.Write(filePart, file, &imgconv.FormatOption{Format: imgconv.PNG})
+			mp.WriteField("user", req.User)
+			mp.WriteField("size", req.Size)
+			mp.WriteField("n", strconv.Itoa(req.N))
+			mp.WriteField("response_format", req.ResponseFormat)
+			mp.Close()
+			ctx, span := tracer.Start(ctx, "provider.variations")
+			span.SetAttributes(attribute.String("image.size", req.Size), attribute.Int("image.n", req.N))
+			result, err := doGenerationRequest(ctx, "/variations", mp.FormDataContentType(), buf.Bytes())
+			telemetry.End(span, err)
+			return result, err
+		},
+	})
+}
+
+// generationJob 一次生成请求中与类型相关的部分，call 负责向 provider 发起实际调用
+type generationJob struct {
+	task       *taskProgress
+	calledType string
+	user       string
+	input      string // prompt text or variation origin image path
+	prompt     string // prompt sent to the provider, empty for variations
+	enhanced   string // prompt rewritten by the llm, empty if not enhanced
+	origin     promptOrigin
+	notify     bool // send the generation result to the subscribed user, false for the prompts of a batch
+	styleId    uint
+	n          int
+	size       string
+	model      string                                        // empty for the provider default
+	prepare    func(ctx context.Context, job *generationJob) // optional, runs after the entitlement checks and the quota reservation
+	call       func(ctx context.Context, job *generationJob) (*generationResp, error)
+}
+
+// generate 生成流程的公共部分：额度检查、排队、调用 provider、保存图片、记录与计数，全程发布任务进度
+func generate(ctx context.Context, job generationJob) (urls []string, err error) {
+	task := job.task
+	defer func() {
+		if err != nil {
+			task.failed(ctx, err)
+		}
+	}()
+	if !validSizes[job.size] {
+		return nil, errInvalidSize
 	}
-	fileDst := dataDir + req.FilePath
-	file, err := imgconv.Open(fileDst)
+	tier, spec, err := fetchTier(ctx, job.user)
 	if err != nil {
 		return nil, err
 	}
-	buf := new(bytes.Buffer)
-	mp := multipart.NewWriter(buf)
-	filePart, _ := mp.CreateFormFile("image", "image.png")
-	imgconv.Write(filePart, file, &imgconv.FormatOption{Format: imgconv.PNG})
-	mp.WriteField("user", req.User)
-	mp.WriteField("size", req.Size)
-	mp.WriteField("n", strconv.Itoa(req.N))
-	mp.Close()
-	r, err := http.NewRequest("POST", openAiApiUrl+"/variations", buf)
-	if err != nil {
-		log.Println("build http request failed", err)
+	if err = spec.check(job.n, job.size, job.model); err != nil {
+		log.Printf("user %s in tier %s is not entitled, the error is %s", job.user, tier, err)
 		return nil, err
 	}
-	r.Header.Add("Content-Type", mp.FormDataContentType())
-	r.Header.Add("Authorization", "Bearer "+getOpenAiApiKey())
-	client := &http.Client{}
-	resp, err := client.Do(r)
+	// reserve the quota before anything is spent, concurrent requests can not overdraw it
+	reservationId, err := reserveQuota(ctx, job.user)
 	if err != nil {
-		log.Println("do http request failed, err: ", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		result := &errorResp{}
-		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
-			b, _ := io.ReadAll(resp.Body)
-			log.Printf("do decode body failed, just print string, status: %s, body: %s\n", resp.Status, string(b))
-			return nil, errors.New(resp.Status)
-		}
-		log.Printf("error response, status is: %s, msg is: %s\n", resp.Status, result.Error.Message)
-		return nil, errors.New(result.Error.Message)
-	}
-	result := &generationResp{}
-	json.NewDecoder(resp.Body).Decode(result)
-	urls := make([]string, len(result.Data))
-	for i, data := range result.Data {
-		// download from the url and save as a file
-		fileUrl, err := saveFile(typeVariation, req.User, data.Url)
+	defer func() {
 		if err != nil {
-			log.Println("save file error")
-			return []string{}, err
+			releaseQuota(telemetry.Detach(ctx), job.user, reservationId)
 		}
-		urls[i] = fileUrl
+	}()
+	if job.prepare != nil {
+		job.prepare(ctx, &job)
+	}
+	if err = queue.acquire(ctx, spec.Priority, func(position int) { task.queued(ctx, position) }); err != nil {
+		return nil, err
+	}
+	defer queue.release()
+	var recordId uint
+	if job.notify {
+		// only the generations that made it through the queue are worth notifying, the others fail right away
+		defer func() {
+			outcome := generationOutcome{recordId: recordId, images: len(urls), err: err}
+			if job.calledType == typePrompt {
+				outcome.input = job.input
+			}
+			go notifyGeneration(telemetry.Detach(ctx), job.user, outcome)
+		}()
+	}
+	task.callingProvider(ctx)
+	result, err := job.call(ctx, &job)
+	if err != nil {
+		return nil, toAppError(err)
+	}
+	// download from the urls (or decode the inline content) and save as files
+	task.downloading(ctx, len(result.Data))
+	urls, originals, err := saveImages(ctx, job.calledType, job.user, spec, result.Data, task)
+	if err != nil {
+		log.Println("save file error")
+		return []string{}, toAppError(err)
 	}
 	// save record to db
 	jsonStr, _ := json.Marshal(urls)
-	recordMapper.Insert(req.User, typeVariation, req.FilePath, string(jsonStr))
-	// accumulate usages
-	accumulateCurrentUsage(req.User)
-	return urls, nil
-}
-
-func saveFile(calledType string, user string, url string) (string, error) {
-	fileName := fmt.Sprintf("%s-%s-%d.png", user, calledType, time.Now().UnixNano()/int64(time.Millisecond))
-	relativeDst := generatedPath + fileName
-	if err := os.MkdirAll(filepath.Dir(dataDir+relativeDst), 0750); err != nil {
-		return "", err
+	record := db.Record{
+		Type:           job.calledType,
+		Input:          job.input,
+		Output:         string(jsonStr),
+		StyleId:        job.styleId,
+		EnhancedPrompt: job.enhanced,
+		Template:       job.origin.template,
+		BatchId:        job.origin.batchId,
+		Tier:           tier,
+	}
+	if spec.KeepOriginal {
+		originalStr, _ := json.Marshal(originals)
+		record.Original = string(originalStr)
+	}
+	// the checks are created along with the record, so no image is returned before it is under review
+	var checkPaths []string
+	if mediaChecker != nil {
+		record.Status = db.RecordReviewing
+		checkPaths = urls
+	}
+	if job.prompt != job.input {
+		record.Prompt = job.prompt
 	}
-	out, err := os.Create(dataDir + relativeDst)
+	recordId, err = recordMapper.Insert(ctx, job.user, record, reservationId, checkPaths)
 	if err != nil {
-		return "", err
+		log.Printf("save record of user %s failed, the error is %s", job.user, err)
+		if mediaChecker != nil {
+			// unreviewed images must not be delivered, the reservation is released as well
+			removeImages(telemetry.Detach(ctx), urls, originals)
+			return nil, err
+		}
+		// the images are delivered even if the record is not saved, the reservation is kept as the charge
+	} else {
+		rewardReferral(ctx, job.user)
+		if mediaChecker != nil {
+			go submitMediaChecks(telemetry.Detach(ctx), job.user, recordId)
+		}
 	}
-	defer out.Close()
-	// download the content
-	resp, err := http.Get(url)
+	task.done(ctx, urls)
+	return urls, nil
+}
+
+// doGenerationRequest 发起 provider 请求并解析返回结果，失败时返回 *UpstreamError
+func doGenerationRequest(ctx context.Context, path string, contentType string, body []byte) (*generationResp, error) {
+	resp, err := doRequest(ctx, upstreamProvider, func(ctx context.Context) (*http.Request, error) {
+		r, err := http.NewRequestWithContext(ctx, "POST", openAiApiUrl+path, bytes.NewReader(body))
+		if err != nil {
+			log.Println("build http request failed", err)
+			return nil, err
+		}
+		r.Header.Add("Content-Type", contentType)
+		r.Header.Add("Authorization", "Bearer "+getOpenAiApiKey())
+		return r, nil
+	})
 	if err != nil {
-		log.Println("do download file request failed, err: ", err)
-		return "", err
+		log.Println("do http request failed, err: ", err)
+		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
-		log.Printf("do download file request failed, status: %s, body: %s\n", resp.Status, string(b))
-		return "", errors.New(resp.Status)
+		log.Printf("error response, status is: %s, body is: %s\n", resp.Status, string(b))
+		return nil, classifyStatus(upstreamProvider, resp.StatusCode, b)
 	}
-	defer resp.Body.Close()
-	// copy to the file
-	size, _ := io.Copy(out, resp.Body)
-	log.Printf("save file %s completed, the size is: %d bytes", fileName, size)
-	return relativeDst, nil
-}
-
-func accumulateCurrentUsage(user string) {
-	val, err := redisCli.Get(ctx, prefixCurrentUsage+user).Result()
-	if err == redis.Nil {
-		redisCli.Set(ctx, prefixCurrentUsage+user, 1, 0)
-	} else if err == nil {
-		intVar, _ := strconv.Atoi(val)
-		redisCli.Set(ctx, prefixCurrentUsage+user, intVar+1, 0)
-	} else {
-		log.Printf("just ignore this accumulation, the error is %s", err)
+	result := &generationResp{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		log.Println("do decode body failed, err: ", err)
+		return nil, &UpstreamError{Upstream: upstreamProvider, Kind: ErrKindUnavailable, StatusCode: resp.StatusCode, Err: err}
 	}
+	return result, nil
 }
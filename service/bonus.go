@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	prefixAdNonce string = "ad-nonce-"
+	// adNonceTTL 领取奖励需在该时间内完成
+	adNonceTTL = 30 * time.Minute
+)
+
+var (
+	bonusMapper    = db.NewBonusMapper()
+	checkInBonuses []int
+	adBonus        int
+	adDailyLimit   int
+	adMinWatch     time.Duration
+
+	errBonusLimitReached = apperror.New(apperror.CodeBonusLimitReached, db.ErrBonusLimitReached)
+)
+
+func init() {
+	checkInBonuses = loadCheckInBonuses()
+	adBonus = intEnv("AD_REWARD_BONUS", 1)
+	adDailyLimit = intEnv("AD_DAILY_LIMIT", 3)
+	adMinWatch = time.Duration(intEnv("AD_MIN_WATCH_SECONDS", 15)) * time.Second
+}
+
+// loadCheckInBonuses 可通过 CHECKIN_BONUSES 以逗号分隔配置连续签到第 1、2、3... 天的奖励
+func loadCheckInBonuses() []int {
+	val := os.Getenv("CHECKIN_BONUSES")
+	if val == "" {
+		return []int{1, 1, 2, 2, 3, 3, 5}
+	}
+	bonuses := []int{}
+	for _, item := range strings.Split(val, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || n < 0 {
+			log.Fatalln("invalid env CHECKIN_BONUSES")
+		}
+		bonuses = append(bonuses, n)
+	}
+	return bonuses
+}
+
+// checkInBonus 连续签到第 streak 天的奖励，超出配置的天数后取最后一项
+func checkInBonus(streak int) int {
+	if streak > len(checkInBonuses) {
+		return checkInBonuses[len(checkInBonuses)-1]
+	}
+	return checkInBonuses[streak-1]
+}
+
+func yesterdayPeriod() string {
+	return time.Now().AddDate(0, 0, -1).Format(periodLayout)
+}
+
+// nextStreak 今天签到时的连续天数，昨天有签到时在其基础上加一
+func nextStreak(last db.CheckIn) int {
+	if last.Period == yesterdayPeriod() {
+		return last.Streak + 1
+	}
+	return 1
+}
+
+// GetCheckIn 用户今天的签到状态，未签到时返回下一次签到可得的奖励
+func GetCheckIn(ctx context.Context, openId string) (*response.CheckInDto, error) {
+	last, err := bonusMapper.FetchLastCheckIn(ctx, openId)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return nil, err
+	}
+	if last.Period == currentPeriod() {
+		return &response.CheckInDto{CheckedIn: true, Streak: last.Streak, Bonus: last.Bonus}, nil
+	}
+	streak := nextStreak(last)
+	return &response.CheckInDto{Streak: streak - 1, Bonus: checkInBonus(streak)}, nil
+}
+
+// CheckIn 每日签到，连续签到的奖励逐日递增，奖励计入当天的每日额度
+func CheckIn(ctx context.Context, openId string) (*response.CheckInDto, error) {
+	ctx, span := tracer.Start(ctx, "bonus.checkIn")
+	defer span.End()
+	period := currentPeriod()
+	// make sure today's regular grant exists, otherwise the bonus would stand in for it
+	if err := ensureDailyGrant(ctx, openId, period); err != nil {
+		return nil, err
+	}
+	last, err := bonusMapper.FetchLastCheckIn(ctx, openId)
+	if err != nil {
+		return nil, err
+	}
+	streak := nextStreak(last)
+	checkIn, created, err := bonusMapper.CheckIn(ctx, openId, period, streak, checkInBonus(streak))
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		log.Printf("user %s checked in, streak %d, bonus %d", openId, checkIn.Streak, checkIn.Bonus)
+		invalidateQuotaCache(ctx, openId)
+	}
+	return &response.CheckInDto{CheckedIn: true, Repeated: !created, Streak: checkIn.Streak, Bonus: checkIn.Bonus}, nil
+}
+
+// IssueAdNonce 在展示激励视频前签发 nonce，看完后凭 nonce 领取奖励
+func IssueAdNonce(ctx context.Context, openId string) (*response.AdNonceDto, error) {
+	count, err := bonusMapper.CountAdRewards(ctx, openId, currentPeriod())
+	if err != nil {
+		return nil, err
+	}
+	if count >= adDailyLimit {
+		return nil, errBonusLimitReached
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	nonce := hex.EncodeToString(b)
+	val := openId + ":" + strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := redisCli.Set(ctx, prefixAdNonce+nonce, val, adNonceTTL).Err(); err != nil {
+		return nil, err
+	}
+	return &response.AdNonceDto{Nonce: nonce, Remaining: adDailyLimit - count}, nil
+}
+
+// RewardAd 校验 nonce 后为看完的激励视频发放奖励，nonce 只能使用一次，且签发后需经过最短观看时长
+func RewardAd(ctx context.Context, openId string, nonce string) (*response.AdRewardDto, error) {
+	ctx, span := tracer.Start(ctx, "bonus.rewardAd")
+	defer span.End()
+	val, err := redisCli.GetDel(ctx, prefixAdNonce+nonce).Result()
+	if err == redis.Nil {
+		return nil, apperror.New(apperror.CodeAdNotVerified, errors.New("unknown or used nonce"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	owner, issuedAt, _ := strings.Cut(val, ":")
+	issued, _ := strconv.ParseInt(issuedAt, 10, 64)
+	if owner != openId {
+		return nil, apperror.New(apperror.CodeAdNotVerified, fmt.Errorf("nonce was issued to another user %s", owner))
+	}
+	if elapsed := time.Since(time.UnixMilli(issued)); elapsed < adMinWatch {
+		return nil, apperror.New(apperror.CodeAdNotVerified, fmt.Errorf("completed in %s, too fast to be a full view", elapsed))
+	}
+	period := currentPeriod()
+	if err := ensureDailyGrant(ctx, openId, period); err != nil {
+		return nil, err
+	}
+	remaining, err := bonusMapper.RewardAd(ctx, openId, period, nonce, adBonus, adDailyLimit)
+	if errors.Is(err, db.ErrBonusLimitReached) {
+		return nil, errBonusLimitReached
+	}
+	if err != nil {
+		return nil, err
+	}
+	invalidateQuotaCache(ctx, openId)
+	return &response.AdRewardDto{Bonus: adBonus, Remaining: remaining}, nil
+}
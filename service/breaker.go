@@ -0,0 +1,23 @@
+package service
+
+import (
+	"idraw-server/upstream"
+	"sync"
+	"time"
+)
+
+const (
+	breakerFailureThreshold = 5
+	breakerCooldown         = 30 * time.Second
+)
+
+var breakers sync.Map
+
+// breakerFor 按上游名称获取熔断器，每个上游一个实例
+func breakerFor(name string) *upstream.Breaker {
+	if val, ok := breakers.Load(name); ok {
+		return val.(*upstream.Breaker)
+	}
+	val, _ := breakers.LoadOrStore(name, upstream.NewBreaker(breakerFailureThreshold, breakerCooldown))
+	return val.(*upstream.Breaker)
+}
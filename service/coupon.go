@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"log"
+	"strings"
+	"time"
+)
+
+// couponAlphabet 去除了容易混淆的字符，兑换码不区分大小写
+const couponAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var couponMapper = db.NewCouponMapper()
+
+// MintCoupons 创建一批兑换码，每个码最多兑换 maxUses 次，返回生成的兑换码
+func MintCoupons(ctx context.Context, name string, credits int, count int, maxUses int, expiredTime time.Time) ([]string, error) {
+	if credits <= 0 || count <= 0 || maxUses <= 0 {
+		return nil, errors.New("credits, count and max uses must be positive")
+	}
+	codes := make([]string, 0, count)
+	seen := make(map[string]bool, count)
+	for len(codes) < count {
+		code, err := newCouponCode()
+		if err != nil {
+			return nil, err
+		}
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	batch, err := couponMapper.MintBatch(ctx, db.CouponBatch{
+		Name:        name,
+		Credits:     credits,
+		MaxUses:     maxUses,
+		ExpiredTime: expiredTime,
+	}, codes)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("minted %d coupons in batch %d (%s)", count, batch.ID, name)
+	return codes, nil
+}
+
+// newCouponCode 12 位随机兑换码，按 4 位一组以短横线分隔
+func newCouponCode() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(couponAlphabet[int(b[i])%len(couponAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+// RedeemCoupon 兑换并记入已购次数，返回兑换得到的次数及兑换后的余额
+func RedeemCoupon(ctx context.Context, openId string, code string) (*response.RedeemDto, error) {
+	ctx, span := tracer.Start(ctx, "coupon.redeem")
+	defer span.End()
+	code = strings.ToUpper(strings.TrimSpace(code))
+	batch, err := couponMapper.Redeem(ctx, openId, code)
+	switch {
+	case errors.Is(err, db.ErrCouponNotFound):
+		return nil, apperror.New(apperror.CodeCouponInvalid, err)
+	case errors.Is(err, db.ErrCouponExpired), errors.Is(err, db.ErrCouponUsedUp):
+		return nil, apperror.New(apperror.CodeCouponExpired, err)
+	case errors.Is(err, db.ErrCouponRedeemed):
+		return nil, apperror.New(apperror.CodeCouponRedeemed, err)
+	case errors.Is(err, db.ErrRecordNotFound):
+		return nil, apperror.New(apperror.CodeUnauthorized, err)
+	case err != nil:
+		return nil, err
+	}
+	log.Printf("user %s redeemed coupon %s of batch %d", openId, code, batch.ID)
+	invalidateQuotaCache(ctx, openId)
+	balance, err := GetCreditBalance(ctx, openId)
+	if err != nil {
+		return nil, err
+	}
+	return &response.RedeemDto{Credits: batch.Credits, Balance: balance}, nil
+}
+
+// CouponReport 所有批次的兑换统计
+func CouponReport(ctx context.Context) ([]db.CouponBatchReport, error) {
+	return couponMapper.Report(ctx)
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"idraw-server/telemetry"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	maxConcurrentDownloads       = 4
+	maxImageSize           int64 = 20 << 20 // 20 MiB, a 1024x1024 png is usually around 3 MiB
+	sniffLen                     = 512
+)
+
+var (
+	errEmptyImage       = errors.New("provider returned neither url nor b64_json")
+	errUnsupportedImage = errors.New("unsupported image type")
+	// pngTypes provider 返回及水印处理后写入的图片都是 png
+	pngTypes = []string{"image/png"}
+	// uploadTypes 用户上传的参考图允许的类型
+	uploadTypes = []string{"image/png", "image/jpeg", "image/webp"}
+)
+
+// saveImages 并发保存 provider 返回的所有图片并按等级添加水印，任何一张失败都会清理本批次已写入的文件，
+// 返回图片及保留的原图路径
+func saveImages(ctx context.Context, calledType string, user string, spec tierSpec, data []generationData, task *taskProgress) ([]string, []string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batch := time.Now().UnixMilli()
+	paths := make([]string, len(data))
+	originals := make([]string, len(data))
+	errs := make([]error, len(data))
+	sem := make(chan struct{}, maxConcurrentDownloads)
+	var wg sync.WaitGroup
+	for i, d := range data {
+		wg.Add(1)
+		go func(i int, d generationData) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			fileName, err := uniqueFileName(user, calledType, batch, i)
+			if err == nil {
+				paths[i], err = saveFile(ctx, fileName, d)
+			}
+			if err == nil {
+				originals[i], err = markImage(ctx, paths[i], spec)
+			}
+			if err == nil {
+				indexGenerated(ctx, user, paths[i])
+			}
+			if err == nil {
+				task.imageStored(ctx)
+			}
+			if err != nil {
+				errs[i] = err
+				// no need to continue with the rest once one of them has failed
+				cancel()
+			}
+		}(i, d)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		removeImages(telemetry.Detach(ctx), paths, originals)
+		return nil, nil, err
+	}
+	return paths, originals, nil
+}
+
+// removeImages 删除一个批次已写入的图片、原图及其索引
+func removeImages(ctx context.Context, paths []string, originals []string) {
+	for _, p := range append(paths, originals...) {
+		if p != "" {
+			os.Remove(dataDir + p)
+		}
+	}
+	if err := imageMapper.DeleteByPaths(ctx, paths); err != nil {
+		log.Println("failed to delete the image index of the failed batch, the error is", err)
+	}
+}
+
+// firstError 优先返回真正的失败原因，而不是因取消而产生的连带错误
+func firstError(errs []error) error {
+	var canceled error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, context.Canceled) {
+			canceled = err
+			continue
+		}
+		return err
+	}
+	return canceled
+}
+
+// uniqueFileName 以用户、类型、批次时间、序号加随机后缀命名，同一毫秒内的多张图片也不会互相覆盖
+func uniqueFileName(user string, calledType string, batch int64, index int) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d-%d-%s.png", user, calledType, batch, index, hex.EncodeToString(b)), nil
+}
+
+// saveFile 将单张图片写入生成目录，b64_json 直接解码，否则从 url 下载
+func saveFile(ctx context.Context, fileName string, data generationData) (relativeDst string, err error) {
+	ctx, span := tracer.Start(ctx, "storage.download")
+	defer func() { telemetry.End(span, err) }()
+	span.SetAttributes(attribute.String("file.name", fileName), attribute.Bool("file.inline", data.B64Json != ""))
+	relativeDst = generatedPath + fileName
+	var src io.Reader
+	var expectedSize int64 = -1
+	switch {
+	case data.B64Json != "":
+		src = base64.NewDecoder(base64.StdEncoding, strings.NewReader(data.B64Json))
+	case data.Url != "":
+		resp, err := doRequest(ctx, upstreamDownload, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", data.Url, nil)
+		})
+		if err != nil {
+			log.Println("do download file request failed, err: ", err)
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			log.Printf("do download file request failed, status: %s, body: %s\n", resp.Status, string(b))
+			return "", classifyStatus(upstreamDownload, resp.StatusCode, b)
+		}
+		if resp.ContentLength > maxImageSize {
+			return "", fmt.Errorf("image is too large, %d bytes", resp.ContentLength)
+		}
+		src = resp.Body
+		expectedSize = resp.ContentLength
+	default:
+		return "", errEmptyImage
+	}
+	size, err := writeImageAtomically(dataDir+relativeDst, src, expectedSize, pngTypes)
+	if err != nil {
+		return "", err
+	}
+	span.SetAttributes(attribute.Int64("file.size", size))
+	log.Printf("save file %s completed, the size is: %d bytes", fileName, size)
+	return relativeDst, nil
+}
+
+// writeImageAtomically 先写入同目录下的临时文件，校验大小及内容类型属于 allowedTypes 后再 rename，失败时删除临时文件，
+// 因此目标路径上要么是完整的图片，要么什么都没有
+func writeImageAtomically(dst string, src io.Reader, expectedSize int64, allowedTypes []string) (size int64, err error) {
+	if err = os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-"+filepath.Base(dst)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	// sniff the head to verify it is really an image before writing the rest
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	head = head[:n]
+	if contentType := http.DetectContentType(head); !contains(allowedTypes, contentType) {
+		return 0, fmt.Errorf("%w %s", errUnsupportedImage, contentType)
+	}
+	if _, err = tmp.Write(head); err != nil {
+		return 0, err
+	}
+	// read one byte more than allowed so that an oversize image can be detected
+	rest, err := io.Copy(tmp, io.LimitReader(src, maxImageSize-int64(n)+1))
+	if err != nil {
+		return 0, err
+	}
+	size = int64(n) + rest
+	if size > maxImageSize {
+		return 0, fmt.Errorf("image is too large, more than %d bytes", maxImageSize)
+	}
+	if expectedSize >= 0 && size != expectedSize {
+		return 0, fmt.Errorf("incomplete image, expect %d bytes but got %d", expectedSize, size)
+	}
+	if err = tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
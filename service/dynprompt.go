@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"idraw-server/api/request"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"idraw-server/dynprompt"
+	"idraw-server/telemetry"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	promptModeRandom        string = "random"
+	promptModeCombinatorial string = "combinatorial"
+	// batchConcurrency 同一批次内同时进行的生成数量，总体并发仍受 queue 限制
+	batchConcurrency = 4
+)
+
+var (
+	wildcardMapper = db.NewWildcardMapper()
+	// promptBatchLimit 组合展开后允许的最大描述数量
+	promptBatchLimit int
+)
+
+func init() {
+	promptBatchLimit = intEnv("PROMPT_BATCH_LIMIT", 16)
+}
+
+// UnknownWildcardError 描述中引用了不存在的词表
+type UnknownWildcardError struct {
+	Name string
+}
+
+func (e *UnknownWildcardError) Error() string {
+	return "unknown wildcard __" + e.Name + "__"
+}
+
+// newPromptExpander 由数据库中的词表展开动态描述
+func newPromptExpander(ctx context.Context) *dynprompt.Expander {
+	return dynprompt.NewExpander(func(name string) ([]string, error) {
+		wildcard, err := wildcardMapper.FetchByName(ctx, name)
+		if errors.Is(err, db.ErrRecordNotFound) {
+			// the name only contains [A-Za-z0-9_-], it is safe to show
+			return nil, apperror.WithDetail(apperror.CodeInvalidParams, &UnknownWildcardError{Name: name}, "__"+name+"__")
+		}
+		if err != nil {
+			return nil, err
+		}
+		words := dynprompt.SplitWords(wildcard.Words)
+		if len(words) == 0 {
+			return nil, apperror.New(apperror.CodeInvalidParams, fmt.Errorf("wildcard __%s__ is empty", name))
+		}
+		return words, nil
+	})
+}
+
+// expandError 展开的层数或分组数量超限属于参数错误
+func expandError(err error) error {
+	if errors.Is(err, dynprompt.ErrTooDeep) || errors.Is(err, dynprompt.ErrTooLarge) {
+		return apperror.New(apperror.CodeInvalidParams, err)
+	}
+	return err
+}
+
+// generateDynamicPrompt 展开动态描述后生成。random 模式只生成一次；combinatorial 模式为每个组合各生成一次，
+// 共享同一个批次 id，各自的进度发布在 <taskId>-<序号> 上，全部结束后在 taskId 上发布汇总结果
+func generateDynamicPrompt(ctx context.Context, req request.ImageGenerationReq) (urls []string, err error) {
+	task := newTaskProgress(req.TaskId)
+	template := req.Prompt
+	expander := newPromptExpander(ctx)
+	if req.PromptMode != promptModeCombinatorial {
+		prompt, err := expander.Random(template)
+		if err != nil {
+			err = expandError(err)
+			task.failed(ctx, err)
+			return nil, err
+		}
+		origin := promptOrigin{}
+		if prompt != template {
+			origin.template = template
+		}
+		req.Prompt = prompt
+		return generateByPrompt(ctx, req, task, origin)
+	}
+	defer func() {
+		if err != nil {
+			task.failed(ctx, err)
+		}
+	}()
+	prompts, err := expander.All(template, promptBatchLimit)
+	if errors.Is(err, dynprompt.ErrTooManyPrompts) {
+		return nil, apperror.New(apperror.CodeInvalidParams, fmt.Errorf("dynamic prompt expands to more than %d prompts", promptBatchLimit))
+	}
+	if err != nil {
+		return nil, expandError(err)
+	}
+	// every prompt consumes one generation, refuse the batch up front if the quota can not cover it
+	balance, err := fetchBalance(ctx, req.User)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return nil, err
+	}
+	if len(prompts) > balance.DailyRemaining()+balance.Paid {
+		return nil, apperror.New(apperror.CodeQuotaExceeded, fmt.Errorf("batch of %d prompts exceeds the remaining quota", len(prompts)))
+	}
+	batchId := newBatchId()
+	defer func() {
+		go notifyGeneration(telemetry.Detach(ctx), req.User, generationOutcome{input: template, batchId: batchId, images: len(urls), err: err})
+	}()
+	log.Printf("user %s starts batch %s with %d prompts", req.User, batchId, len(prompts))
+	results := make([][]string, len(prompts))
+	errs := make([]error, len(prompts))
+	sem := make(chan struct{}, batchConcurrency)
+	wg := sync.WaitGroup{}
+	for i, prompt := range prompts {
+		sub := req
+		sub.Prompt = prompt
+		subTask := newTaskProgress(task.id + "-" + strconv.Itoa(i+1))
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = generateByPrompt(ctx, sub, subTask, promptOrigin{template: template, batchId: batchId})
+		}(i)
+	}
+	wg.Wait()
+	for i := range prompts {
+		if errs[i] != nil {
+			log.Printf("prompt %d of batch %s failed, the error is %s", i+1, batchId, errs[i])
+			continue
+		}
+		urls = append(urls, results[i]...)
+	}
+	// partial results are still worth returning, the failed ones have their own failure events
+	if len(urls) == 0 {
+		return nil, firstError(errs)
+	}
+	task.done(ctx, urls)
+	return urls, nil
+}
+
+func newBatchId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// FetchWildcards 所有词表的名称及示例
+func FetchWildcards(ctx context.Context) ([]response.WildcardDto, error) {
+	wildcards, err := wildcardMapper.FetchAll(ctx)
+	if err != nil {
+		return []response.WildcardDto{}, err
+	}
+	result := make([]response.WildcardDto, len(wildcards))
+	for i, w := range wildcards {
+		words := dynprompt.SplitWords(w.Words)
+		samples := words
+		if len(samples) > 5 {
+			samples = samples[:5]
+		}
+		result[i] = response.WildcardDto{Name: w.Name, Count: len(words), Samples: samples}
+	}
+	return result, nil
+}
+
+// SaveWildcard 新增或替换词表
+func SaveWildcard(ctx context.Context, name string, words []string) error {
+	if !dynprompt.IsWildcardName(name) || strings.Contains(name, "__") {
+		return errors.New("invalid wildcard name " + name)
+	}
+	val := strings.Join(dynprompt.SplitWords(strings.Join(words, "\n")), "\n")
+	if val == "" {
+		return errors.New("wildcard must have at least one word")
+	}
+	return wildcardMapper.Save(ctx, db.Wildcard{Name: name, Words: val})
+}
+
+func DeleteWildcard(ctx context.Context, name string) error {
+	found, err := wildcardMapper.Delete(ctx, name)
+	if err == nil && !found {
+		return errors.New("wildcard " + name + " not found")
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"idraw-server/llm"
+	"idraw-server/telemetry"
+	"idraw-server/upstream"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	prefixEnhancedPrompt string = "enhance-"
+	enhanceCacheTTL             = 7 * 24 * time.Hour
+	// enhanceTimeout 改写只是锦上添花，超时后直接使用原始描述
+	enhanceTimeout = 15 * time.Second
+	enhanceSystem  = "You rewrite prompts for an image generation model. Translate the user's description into English " +
+		"if needed, keep every subject and detail the user asked for, and expand it into one vivid, concrete description " +
+		"covering subject, composition, lighting and style. Reply with the rewritten prompt only, no quotes or explanations, " +
+		"at most 800 characters."
+)
+
+// enhancer 为空时不支持改写，请求中的 enhance 标记将被忽略
+var enhancer llm.Client
+
+func init() {
+	enhancer = newEnhancer()
+}
+
+// newEnhancer 由 PROMPT_ENHANCER 选择实现：openai 使用兼容 openai 的对话接口，stub 为离线实现，留空则关闭改写
+func newEnhancer() llm.Client {
+	switch val := os.Getenv("PROMPT_ENHANCER"); val {
+	case "":
+		log.Println("lack env PROMPT_ENHANCER, prompt enhancement is disabled")
+		return nil
+	case "stub":
+		return llm.Stub{}
+	case "openai":
+		apiUrl := os.Getenv("LLM_API_URL")
+		if apiUrl == "" {
+			apiUrl = strings.TrimSuffix(openAiApiUrl, "/images")
+		}
+		apiKey := os.Getenv("LLM_API_KEY")
+		if apiKey == "" {
+			apiKey = getOpenAiApiKey()
+		}
+		model := os.Getenv("LLM_MODEL")
+		if model == "" {
+			model = "gpt-4o-mini"
+		}
+		return llm.NewOpenAIClient(llm.Config{
+			ApiUrl:      apiUrl,
+			ApiKey:      apiKey,
+			Model:       model,
+			Temperature: 0.7,
+			MaxTokens:   400,
+			HttpClient:  httpClient,
+		})
+	default:
+		log.Fatalln("invalid env PROMPT_ENHANCER " + val)
+		return nil
+	}
+}
+
+// enhancePrompt 翻译并扩写用户的描述，相同的描述直接使用缓存。
+// 改写后的描述不在同步应答中，只随进度事件 STORED 推送并保存在生成记录的 enhancedPrompt 中
+func enhancePrompt(ctx context.Context, prompt string) (enhanced string, err error) {
+	if enhancer == nil {
+		return "", errors.New("prompt enhancement is disabled")
+	}
+	ctx, span := tracer.Start(ctx, "llm.enhance")
+	defer func() { telemetry.End(span, err) }()
+	sum := sha256.Sum256([]byte(enhancer.Model() + "\n" + prompt))
+	key := prefixEnhancedPrompt + hex.EncodeToString(sum[:])
+	if val, err := redisCli.Get(ctx, key).Result(); err == nil {
+		return val, nil
+	} else if err != redis.Nil {
+		log.Println("failed to read the enhanced prompt cache, the error is", err)
+	}
+	breaker := breakerFor(upstreamLlm)
+	if !breaker.Allow() {
+		return "", &UpstreamError{Upstream: upstreamLlm, Kind: ErrKindUnavailable, Message: "circuit breaker is open"}
+	}
+	callCtx, cancel := context.WithTimeout(ctx, enhanceTimeout)
+	defer cancel()
+	enhanced, err = enhancer.Complete(callCtx, []llm.Message{
+		{Role: llm.RoleSystem, Content: enhanceSystem},
+		{Role: llm.RoleUser, Content: prompt},
+	})
+	if err != nil {
+		reportEnhanceError(ctx, breaker, err)
+		return "", err
+	}
+	breaker.OnSuccess()
+	if enhanced == "" {
+		return "", errors.New("empty enhanced prompt")
+	}
+	if err := redisCli.Set(ctx, key, enhanced, enhanceCacheTTL).Err(); err != nil {
+		log.Println("failed to cache the enhanced prompt, the error is", err)
+	}
+	return enhanced, nil
+}
+
+// reportEnhanceError 只有连接失败、超时与 5xx 说明模型服务不健康；调用方取消只归还探测名额，
+// 4xx 与无法解析的应答说明服务可达，均不计入熔断
+func reportEnhanceError(ctx context.Context, breaker *upstream.Breaker, err error) {
+	var apiErr *llm.APIError
+	var urlErr *url.Error
+	switch {
+	case ctx.Err() != nil:
+		// the caller is gone or out of time, it says nothing about the upstream
+		breaker.Release()
+	case errors.As(err, &apiErr):
+		if apiErr.StatusCode >= 500 {
+			breaker.OnFailure()
+		} else {
+			breaker.OnSuccess()
+		}
+	case errors.As(err, &urlErr):
+		breaker.OnFailure()
+	default:
+		breaker.OnSuccess()
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"errors"
+	"idraw-server/apperror"
+	"strings"
+)
+
+var (
+	errQuotaExceeded = apperror.New(apperror.CodeQuotaExceeded, errors.New("current user has exceeded daily limits"))
+	errInvalidType   = apperror.New(apperror.CodeInvalidParams, errors.New("not a valid called type"))
+	errInvalidSize   = apperror.New(apperror.CodeInvalidSize, errors.New("not a valid image size"))
+)
+
+// validSizes image sizes supported by the provider
+var validSizes = map[string]bool{
+	"256x256":   true,
+	"512x512":   true,
+	"1024x1024": true,
+}
+
+// providerErrorCode 将 openai 的错误类型/错误码映射为业务码
+func providerErrorCode(e *UpstreamError) string {
+	switch e.ErrorCode {
+	case "content_policy_violation":
+		return apperror.CodeContentBlocked
+	case "billing_hard_limit_reached", "insufficient_quota", "invalid_api_key", "account_deactivated":
+		// all of them are on our side, nothing the user can do but wait
+		return apperror.CodeProviderUnavailable
+	case "rate_limit_exceeded":
+		return apperror.CodeProviderRateLimited
+	}
+	switch e.ErrorType {
+	case "insufficient_quota", "billing_error":
+		return apperror.CodeProviderUnavailable
+	case "invalid_request_error":
+		if e.Param == "size" {
+			return apperror.CodeInvalidSize
+		}
+		// older deployments report safety rejections without a dedicated code
+		if strings.Contains(e.Message, "safety system") {
+			return apperror.CodeContentBlocked
+		}
+	}
+	switch e.Kind {
+	case ErrKindTimeout, ErrKindCanceled:
+		return apperror.CodeProviderTimeout
+	case ErrKindRateLimited:
+		return apperror.CodeProviderRateLimited
+	case ErrKindUnavailable:
+		return apperror.CodeProviderUnavailable
+	default:
+		return apperror.CodeProviderRejected
+	}
+}
+
+// toAppError 将上游错误转换为带业务码的 *apperror.Error，其余错误原样返回
+func toAppError(err error) error {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return apperror.New(providerErrorCode(upstreamErr), err)
+	}
+	return err
+}
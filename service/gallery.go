@@ -0,0 +1,328 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GallerySortLatest   = "latest"
+	GallerySortTrending = "trending"
+
+	galleryDefaultLimit  = 20
+	galleryMaxLimit      = 50
+	galleryDefaultWindow = 7 * 24 * time.Hour
+	galleryMaxWindow     = 30 * 24 * time.Hour
+)
+
+var (
+	galleryMapper = db.NewGalleryMapper()
+	// publicBaseUrl 分享链接的域名，如 https://idraw.example.com，为空时返回相对路径
+	publicBaseUrl = strings.TrimSuffix(os.Getenv("PUBLIC_BASE_URL"), "/")
+
+	errInvalidCursor      = apperror.New(apperror.CodeInvalidParams, errors.New("invalid cursor"))
+	errPublicationMissing = apperror.New(apperror.CodeNotFound, errors.New("publication not found"))
+)
+
+// GalleryQuery 画廊分页查询条件
+type GalleryQuery struct {
+	OpenId string // optional, used to mark the liked items
+	Sort   string
+	Window time.Duration // trending window
+	Cursor string
+	Limit  int
+}
+
+// SharePage 分享页渲染所需的数据
+type SharePage struct {
+	Title       string
+	Description string
+	ImageUrl    string
+	PageUrl     string
+}
+
+// newShareToken 16 字节随机数，不可猜测
+func newShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func shareUrl(token string) string {
+	return publicBaseUrl + "/s/" + token
+}
+
+func galleryImageUrl(token string, index int) string {
+	return fmt.Sprintf("%s/api/gallery/%s/images/%d", publicBaseUrl, token, index)
+}
+
+func publicationOutput(view db.PublicationView) []string {
+	var output []string
+	_ = json.Unmarshal([]byte(view.Output), &output)
+	return output
+}
+
+func toGalleryItem(view db.PublicationView, liked bool) response.GalleryItemDto {
+	images := make([]string, len(publicationOutput(view)))
+	for i := range images {
+		images[i] = galleryImageUrl(view.Token, i)
+	}
+	item := response.GalleryItemDto{
+		Token:       view.Token,
+		Type:        view.Type,
+		Images:      images,
+		Author:      view.NickName,
+		Likes:       view.Likes,
+		Liked:       liked,
+		PublishedAt: view.PublishedTime,
+	}
+	// 变体的输入是用户上传的图片路径，不对外公开
+	if view.Type == typePrompt {
+		item.Prompt = view.Input
+	}
+	return item
+}
+
+// Publish 将自己的生成记录发布到画廊
+func Publish(ctx context.Context, openId string, recordId uint) (*response.ShareDto, error) {
+	ctx, span := tracer.Start(ctx, "gallery.publish")
+	defer span.End()
+	record, err := recordMapper.FetchByUserAndId(ctx, openId, recordId)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return nil, apperror.New(apperror.CodeNotFound, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if err = checkRecordVisible(record); err != nil {
+		return nil, err
+	}
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	publication, err := galleryMapper.Publish(ctx, openId, recordId, token)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return nil, apperror.New(apperror.CodeNotFound, err)
+	} else if err != nil {
+		return nil, err
+	}
+	log.Printf("user %s published record %d", openId, recordId)
+	return &response.ShareDto{Token: publication.Token, ShareUrl: shareUrl(publication.Token)}, nil
+}
+
+// Unpublish 取消发布，之后分享链接失效
+func Unpublish(ctx context.Context, openId string, token string) error {
+	ctx, span := tracer.Start(ctx, "gallery.unpublish")
+	defer span.End()
+	found, err := galleryMapper.Unpublish(ctx, openId, token)
+	if errors.Is(err, db.ErrRecordNotFound) || (err == nil && !found) {
+		return errPublicationMissing
+	}
+	return err
+}
+
+// FetchGallery 画廊分页，latest 的游标为最后一项的 id，trending 的游标为 <点赞数>-<id>
+func FetchGallery(ctx context.Context, q GalleryQuery) (*response.GalleryPageDto, error) {
+	ctx, span := tracer.Start(ctx, "gallery.fetch")
+	defer span.End()
+	if q.Limit <= 0 {
+		q.Limit = galleryDefaultLimit
+	}
+	if q.Limit > galleryMaxLimit {
+		q.Limit = galleryMaxLimit
+	}
+	var views []db.PublicationView
+	var err error
+	switch q.Sort {
+	case "", GallerySortLatest:
+		var after *db.PublicationView
+		if q.Cursor != "" {
+			if after, err = parseLatestCursor(q.Cursor); err != nil {
+				return nil, err
+			}
+		}
+		views, err = galleryMapper.FetchLatest(ctx, after, q.Limit)
+	case GallerySortTrending:
+		if q.Window <= 0 {
+			q.Window = galleryDefaultWindow
+		}
+		if q.Window > galleryMaxWindow {
+			q.Window = galleryMaxWindow
+		}
+		var after *db.PublicationView
+		if q.Cursor != "" {
+			if after, err = parseTrendingCursor(q.Cursor); err != nil {
+				return nil, err
+			}
+		}
+		views, err = galleryMapper.FetchTrending(ctx, time.Now().Add(-q.Window), after, q.Limit)
+	default:
+		return nil, apperror.New(apperror.CodeInvalidParams, fmt.Errorf("unknown sort %s", q.Sort))
+	}
+	if err != nil {
+		return nil, err
+	}
+	liked := map[uint]bool{}
+	if q.OpenId != "" {
+		ids := make([]uint, len(views))
+		for i, v := range views {
+			ids[i] = v.ID
+		}
+		if liked, err = galleryMapper.FetchLikedIds(ctx, q.OpenId, ids); err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	page := &response.GalleryPageDto{Items: make([]response.GalleryItemDto, len(views))}
+	for i, v := range views {
+		page.Items[i] = toGalleryItem(v, liked[v.ID])
+	}
+	if len(views) == q.Limit {
+		last := views[len(views)-1]
+		if q.Sort == GallerySortTrending {
+			page.NextCursor = fmt.Sprintf("%d-%d", last.Score, last.ID)
+		} else {
+			page.NextCursor = fmt.Sprintf("%d-%d", last.PublishedTime.UnixNano(), last.ID)
+		}
+	}
+	return page, nil
+}
+
+// parseLatestCursor 最新列表的游标为 <发布时间的纳秒时间戳>-<id>
+func parseLatestCursor(cursor string) (*db.PublicationView, error) {
+	published, id, ok := strings.Cut(cursor, "-")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(published, 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	i, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	view := &db.PublicationView{}
+	view.PublishedTime = time.Unix(0, nanos)
+	view.ID = uint(i)
+	return view, nil
+}
+
+func parseTrendingCursor(cursor string) (*db.PublicationView, error) {
+	score, id, ok := strings.Cut(cursor, "-")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	s, err := strconv.Atoi(score)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	i, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	view := &db.PublicationView{Score: s}
+	view.ID = uint(i)
+	return view, nil
+}
+
+func fetchPublication(ctx context.Context, token string) (db.PublicationView, error) {
+	view, err := galleryMapper.FetchByToken(ctx, token)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return view, errPublicationMissing
+	}
+	return view, err
+}
+
+// FetchPublication 查询单个已发布的作品
+func FetchPublication(ctx context.Context, token string, openId string) (*response.GalleryItemDto, error) {
+	ctx, span := tracer.Start(ctx, "gallery.fetchOne")
+	defer span.End()
+	view, err := fetchPublication(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	liked := map[uint]bool{}
+	if openId != "" {
+		if liked, err = galleryMapper.FetchLikedIds(ctx, openId, []uint{view.ID}); err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	item := toGalleryItem(view, liked[view.ID])
+	return &item, nil
+}
+
+// ServeGalleryImage 通过分享 token 读取已发布作品的图片，不暴露原始文件路径
+func ServeGalleryImage(ctx context.Context, token string, index int) (*os.File, error) {
+	view, err := fetchPublication(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	output := publicationOutput(view)
+	if index < 0 || index >= len(output) {
+		return nil, apperror.New(apperror.CodeNotFound, fmt.Errorf("image %d of publication %s not found", index, token))
+	}
+	if err = checkVisible(ctx, output[index]); err != nil {
+		return nil, err
+	}
+	return ServeFile(ctx, output[index])
+}
+
+// Like 点赞或取消点赞，重复操作不会重复计数
+func Like(ctx context.Context, openId string, token string, like bool) (*response.LikeDto, error) {
+	ctx, span := tracer.Start(ctx, "gallery.like")
+	defer span.End()
+	var err error
+	if like {
+		_, err = galleryMapper.Like(ctx, openId, token)
+	} else {
+		_, err = galleryMapper.Unlike(ctx, openId, token)
+	}
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return nil, errPublicationMissing
+	} else if err != nil {
+		return nil, err
+	}
+	view, err := fetchPublication(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return &response.LikeDto{Liked: like, Likes: view.Likes}, nil
+}
+
+// FetchSharePage 分享页的 OpenGraph 信息，链接只由 PUBLIC_BASE_URL 拼接，不信任请求的 Host 头，
+// 未配置时为相对路径
+func FetchSharePage(ctx context.Context, token string) (*SharePage, error) {
+	view, err := fetchPublication(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	page := &SharePage{
+		Title:       "iDraw 作品",
+		Description: "来 iDraw 看看这幅 AI 作品",
+		PageUrl:     shareUrl(token),
+	}
+	if view.NickName != "" {
+		page.Title = view.NickName + " 的 iDraw 作品"
+	}
+	if view.Type == typePrompt {
+		page.Description = view.Input
+	}
+	if len(publicationOutput(view)) > 0 {
+		page.ImageUrl = galleryImageUrl(token, 0)
+	}
+	return page, nil
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"idraw-server/api/response"
+	"idraw-server/db"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusUp       string = "UP"
+	statusDown     string = "DOWN"
+	statusDraining string = "DRAINING"
+	checkTimeout          = 2 * time.Second
+)
+
+var draining atomic.Bool
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// MarkDraining 在优雅停机开始时调用，之后就绪检查始终返回未就绪
+func MarkDraining() {
+	draining.Store(true)
+}
+
+// CheckLiveness 只反映进程自身是否存活，不检查任何外部依赖，避免依赖故障导致 pod 被反复重启
+func CheckLiveness() response.HealthDto {
+	return response.HealthDto{Status: statusUp}
+}
+
+// CheckReadiness 并发检查各项依赖，任何一项失败或正在停机时都视为未就绪
+func CheckReadiness(ctx context.Context) (response.HealthDto, bool) {
+	checks := []healthCheck{
+		{name: "redis", check: checkRedis},
+		{name: "db", check: db.Ping},
+		{name: "storage", check: checkStorage},
+	}
+	if os.Getenv("HEALTH_CHECK_PROVIDER") == "true" {
+		checks = append(checks, healthCheck{name: "provider", check: checkProvider})
+	}
+	result := response.HealthDto{
+		Status: statusUp,
+		Checks: make(map[string]response.CheckDto, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(checkCtx)
+			dto := response.CheckDto{Status: statusUp, Latency: time.Since(start).String()}
+			if err != nil {
+				dto.Status = statusDown
+				dto.Error = err.Error()
+			}
+			mu.Lock()
+			result.Checks[c.name] = dto
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	ready := true
+	for _, dto := range result.Checks {
+		if dto.Status != statusUp {
+			ready = false
+		}
+	}
+	if !ready {
+		result.Status = statusDown
+	}
+	if draining.Load() {
+		result.Status = statusDraining
+		ready = false
+	}
+	return result, ready
+}
+
+func checkRedis(ctx context.Context) error {
+	return redisCli.Ping(ctx).Err()
+}
+
+// storageProbe 一次正在进行的存储探测，done 关闭后 err 即为结果
+type storageProbe struct {
+	done chan struct{}
+	err  error
+}
+
+var (
+	storageProbeMu sync.Mutex
+	// inflightProbe 正在进行的探测，没有时为 nil
+	inflightProbe *storageProbe
+)
+
+// checkStorage 在数据目录下写入并删除一个探测文件，确认 nas 已挂载且可写。
+// 挂载卡死时文件操作不会返回，因此在单独的 goroutine 中执行，超时后直接判定失败。
+// 同一时间只有一个探测，上一次探测卡住未返回时后续检查等待同一个结果，不会不断堆积 goroutine
+func checkStorage(ctx context.Context) error {
+	storageProbeMu.Lock()
+	probe := inflightProbe
+	if probe == nil {
+		probe = &storageProbe{done: make(chan struct{})}
+		inflightProbe = probe
+		go func() {
+			probe.err = probeStorage()
+			storageProbeMu.Lock()
+			inflightProbe = nil
+			storageProbeMu.Unlock()
+			close(probe.done)
+		}()
+	}
+	storageProbeMu.Unlock()
+	select {
+	case <-probe.done:
+		return probe.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func probeStorage() error {
+	f, err := os.CreateTemp(dataDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.WriteString(time.Now().String())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// checkProvider 只确认 provider 可达，不消耗额度，任何 5xx 以下的响应都算可达
+func checkProvider(ctx context.Context) error {
+	r, err := http.NewRequestWithContext(ctx, "GET", openAiApiUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/upstream"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	upstreamProvider string = "provider"
+	upstreamDownload string = "download"
+	upstreamWeChat   string = "wechat"
+	upstreamLlm      string = "llm"
+	maxAttempts             = 3
+	baseBackoff             = 500 * time.Millisecond
+	maxBackoff              = 8 * time.Second
+	maxRetryAfter           = 30 * time.Second
+)
+
+// error kinds surfaced to the callers, so that they can decide how to respond
+const (
+	ErrKindTimeout     string = "TIMEOUT"
+	ErrKindUnavailable string = "UNAVAILABLE"
+	ErrKindRateLimited string = "RATE_LIMITED"
+	ErrKindRejected    string = "REJECTED"
+	ErrKindCanceled    string = "CANCELED"
+)
+
+// UpstreamError 描述一次上游调用失败的原因
+type UpstreamError struct {
+	Upstream   string
+	Kind       string
+	StatusCode int    // upstream http status, 0 if no response received
+	ErrorType  string // error.type of an openai style error body, e.g. invalid_request_error
+	ErrorCode  string // error.code of an openai style error body, e.g. content_policy_violation
+	Param      string // error.param of an openai style error body, e.g. size
+	Message    string
+	Err        error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s %s: %s", e.Upstream, e.Kind, e.Message)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s %s: %s", e.Upstream, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s %s", e.Upstream, e.Kind)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// httpClient 所有上游调用共享的客户端，连接与首包都有超时，整体超时由调用方的 context 控制
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 90 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	},
+	Timeout: 3 * time.Minute,
+}
+
+var retrier = upstream.NewRetrier(maxAttempts, baseBackoff, maxBackoff, maxRetryAfter)
+
+// doRequest 通过熔断器向上游发起请求，失败时以带抖动的指数退避重试，429/503 优先遵循 Retry-After。
+// 幂等的请求在网络错误、429 与 5xx 时重试；非幂等的请求（例如付费的生成调用）只在确定上游未处理时重试，
+// 即连接未能建立或上游返回 429。build 每次重试都会被调用以重建请求体。
+// 返回的 response 状态码总是 2xx 或不可重试的 4xx，其余情况返回 *UpstreamError
+func doRequest(ctx context.Context, upstream string, build func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	breaker := breakerFor(upstream)
+	span := trace.SpanFromContext(ctx)
+	var resp *http.Response
+	err := retrier.Do(ctx, upstream, func(attempt int) (time.Duration, bool, error) {
+		span.SetAttributes(attribute.Int("http.attempt", attempt))
+		r, wait, retry, err := tryRequest(ctx, upstream, breaker, build)
+		var upstreamErr *UpstreamError
+		resp = r
+		return wait, retry && errors.As(err, &upstreamErr), err
+	})
+	if err != nil && err == ctx.Err() {
+		return nil, &UpstreamError{Upstream: upstream, Kind: ErrKindCanceled, Err: err}
+	}
+	return resp, err
+}
+
+// tryRequest 发起一次请求，返回是否值得重试及建议的等待时间。
+// 无论以何种方式返回都会向熔断器报告，取消等与上游无关的结果只归还探测名额，避免熔断器卡在半开状态
+func tryRequest(ctx context.Context, upstream string, breaker *upstream.Breaker, build func(ctx context.Context) (*http.Request, error)) (resp *http.Response, wait time.Duration, retry bool, err error) {
+	if !breaker.Allow() {
+		return nil, 0, false, &UpstreamError{Upstream: upstream, Kind: ErrKindUnavailable, Message: "circuit breaker is open"}
+	}
+	verdict := breaker.Release
+	defer func() {
+		verdict()
+	}()
+	r, err := build(ctx)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	idempotent := isIdempotent(r.Method)
+	resp, err = httpClient.Do(r)
+	switch {
+	case err != nil:
+		upstreamErr := classifyTransportError(upstream, err)
+		if upstreamErr.Kind == ErrKindCanceled {
+			return nil, 0, false, upstreamErr
+		}
+		verdict = breaker.OnFailure
+		return nil, 0, idempotent || isDialError(err), upstreamErr
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			verdict = breaker.OnFailure
+		} else {
+			verdict = breaker.OnSuccess
+		}
+		retry = idempotent || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retrier.ParseRetryAfter(resp.Header.Get("Retry-After")), retry, classifyStatus(upstream, resp.StatusCode, b)
+	default:
+		verdict = breaker.OnSuccess
+		return resp, 0, false, nil
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDialError 连接未能建立，请求一定没有到达上游
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+func classifyTransportError(upstream string, err error) *UpstreamError {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return &UpstreamError{Upstream: upstream, Kind: ErrKindCanceled, Err: err}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &UpstreamError{Upstream: upstream, Kind: ErrKindTimeout, Err: err}
+	default:
+		return &UpstreamError{Upstream: upstream, Kind: ErrKindUnavailable, Err: err}
+	}
+}
+
+// classifyStatus 将上游的非 2xx 状态码归类，并尽量从 openai 风格的错误体中取出错误类型与可读信息
+func classifyStatus(upstream string, statusCode int, body []byte) *UpstreamError {
+	e := &UpstreamError{Upstream: upstream, StatusCode: statusCode, Message: string(body)}
+	result := &errorResp{}
+	if err := json.Unmarshal(body, result); err == nil && result.Error.Message != "" {
+		e.Message = result.Error.Message
+		e.ErrorType = result.Error.Type
+		e.ErrorCode, _ = result.Error.Code.(string)
+		e.Param, _ = result.Error.Param.(string)
+	}
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		e.Kind = ErrKindRateLimited
+	case statusCode == http.StatusGatewayTimeout || statusCode == http.StatusRequestTimeout:
+		e.Kind = ErrKindTimeout
+	case statusCode >= 500:
+		e.Kind = ErrKindUnavailable
+	default:
+		e.Kind = ErrKindRejected
+	}
+	return e
+}
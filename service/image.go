@@ -0,0 +1,216 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"idraw-server/api/request"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"idraw-server/imagehash"
+	"idraw-server/telemetry"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sunshineplan/imgconv"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// blobPath 上传的图片按内容存放，相同内容只保存一份
+	blobPath string = "/idraw-blob-dir/"
+	// blobGracePeriod 不再被引用的 blob 保留一段时间后再删除，以免与同时进行的上传冲突
+	blobGracePeriod       = 24 * time.Hour
+	defaultSimilarLimit   = 20
+	maxSimilarLimit       = 100
+	defaultSimilarMaxDist = 10
+)
+
+var imageMapper = db.NewImageMapper()
+
+// hashImage 计算内容哈希及感知哈希，无法解码的图片只计算内容哈希
+func hashImage(data []byte) db.ImageFile {
+	sum := sha256.Sum256(data)
+	file := db.ImageFile{Sha256: hex.EncodeToString(sum[:])}
+	if img, err := imgconv.Decode(bytes.NewReader(data)); err == nil {
+		file.PHash = int64(imagehash.PHash(img))
+		file.DHash = int64(imagehash.DHash(img))
+	}
+	return file
+}
+
+// resolvePath 路径实际存放内容的位置，查询失败时按原路径处理
+func resolvePath(ctx context.Context, relativePath string) string {
+	resolved, err := imageMapper.ResolvePath(ctx, relativePath)
+	if err != nil {
+		log.Printf("failed to resolve the path %s, the error is %s", relativePath, err)
+	}
+	return resolved
+}
+
+// UploadFile 接收文件上传，并保存至数据目录（外挂 nas 持久化），相同内容只保存一份
+func UploadFile(ctx context.Context, req request.FileUploadReq) (result string, err error) {
+	ctx, span := tracer.Start(ctx, "storage.upload")
+	defer func() { telemetry.End(span, err) }()
+	file := req.File
+	if file.Size > maxImageSize {
+		return "", apperror.New(apperror.CodeInvalidParams, fmt.Errorf("image is too large, %d bytes", file.Size))
+	}
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, maxImageSize))
+	if err != nil {
+		return "", err
+	}
+	// reject unsupported files before they are indexed, the same check is done again when writing
+	if contentType := http.DetectContentType(data); !contains(uploadTypes, contentType) {
+		return "", apperror.New(apperror.CodeInvalidParams, fmt.Errorf("%w %s", errUnsupportedImage, contentType))
+	}
+	// for security reasons, we just expose the relative path not the full path to the outside world
+	relativeDst := uploadedPath + req.User + "-" + file.Filename
+	image := hashImage(data)
+	image.Path = relativeDst
+	blob, created, err := imageMapper.SaveUpload(ctx, req.User, image, blobPath+image.Sha256+strings.ToLower(filepath.Ext(file.Filename)))
+	if errors.Is(err, db.ErrRecordNotFound) {
+		// 未登录过的用户不做去重，直接保存
+		if _, err = writeImageAtomically(dataDir+relativeDst, bytes.NewReader(data), int64(len(data)), uploadTypes); err != nil {
+			return "", err
+		}
+		log.Println("saved file in ", dataDir+relativeDst)
+		return relativeDst, nil
+	} else if err != nil {
+		return "", err
+	}
+	span.SetAttributes(attribute.String("file.blob", blob.Path), attribute.Bool("file.deduplicated", !created))
+	if _, statErr := os.Stat(dataDir + blob.Path); created || statErr != nil {
+		if _, err = writeImageAtomically(dataDir+blob.Path, bytes.NewReader(data), int64(len(data)), uploadTypes); err != nil {
+			return "", err
+		}
+		log.Println("saved file in ", dataDir+blob.Path)
+	} else {
+		log.Printf("file %s has the same content as %s, skip saving", relativeDst, blob.Path)
+	}
+	return relativeDst, nil
+}
+
+// indexGenerated 记录生成图片的哈希，失败不影响生成
+func indexGenerated(ctx context.Context, user string, relativePath string) {
+	data, err := os.ReadFile(dataDir + relativePath)
+	if err == nil {
+		image := hashImage(data)
+		image.Path = relativePath
+		err = imageMapper.SaveGenerated(ctx, user, image)
+	}
+	if err != nil {
+		log.Printf("failed to index the generated image %s, the error is %s", relativePath, err)
+	}
+}
+
+// FetchSimilarImages 用户自己的图片中与 fileName 视觉上相似的图片，按感知哈希的汉明距离升序
+func FetchSimilarImages(ctx context.Context, openId string, fileName string, maxDistance int, limit int) ([]response.SimilarImageDto, error) {
+	ctx, span := tracer.Start(ctx, "storage.similar")
+	defer span.End()
+	if maxDistance <= 0 {
+		maxDistance = defaultSimilarMaxDist
+	}
+	if limit <= 0 {
+		limit = defaultSimilarLimit
+	}
+	if limit > maxSimilarLimit {
+		limit = maxSimilarLimit
+	}
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return nil, apperror.New(apperror.CodeUnauthorized, err)
+	} else if err != nil {
+		return nil, err
+	}
+	target, err := imageMapper.FetchByPath(ctx, fileName)
+	if errors.Is(err, db.ErrRecordNotFound) && strings.HasPrefix(filepath.Base(fileName), openId+"-") {
+		// 早于哈希记录保存的图片，即时计算
+		var data []byte
+		if data, err = os.ReadFile(dataDir + fileName); err == nil {
+			target = hashImage(data)
+			target.Path = fileName
+			target.Uid = user.ID
+		} else if errors.Is(err, os.ErrNotExist) {
+			err = db.ErrRecordNotFound
+		}
+	}
+	if errors.Is(err, db.ErrRecordNotFound) || (err == nil && target.Uid != user.ID) {
+		return nil, apperror.New(apperror.CodeNotFound, fmt.Errorf("image %s not found", fileName))
+	} else if err != nil {
+		return nil, err
+	}
+	files, err := imageMapper.FetchByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	result := []response.SimilarImageDto{}
+	for _, f := range files {
+		if f.Path == target.Path {
+			continue
+		}
+		distance := imagehash.Distance(uint64(f.PHash), uint64(target.PHash))
+		if distance > maxDistance {
+			continue
+		}
+		result = append(result, response.SimilarImageDto{
+			FileName:      f.Path,
+			Source:        f.Source,
+			Distance:      distance,
+			DHashDistance: imagehash.Distance(uint64(f.DHash), uint64(target.DHash)),
+			Identical:     f.Sha256 == target.Sha256,
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Distance != result[j].Distance {
+			return result[i].Distance < result[j].Distance
+		}
+		return result[i].DHashDistance < result[j].DHashDistance
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// purgeUnreferencedBlobs 删除不再被引用的 blob 及其文件
+func purgeUnreferencedBlobs(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "storage.purgeBlobs")
+	defer span.End()
+	blobs, err := imageMapper.FetchUnreferencedBlobs(ctx, time.Now().Add(-blobGracePeriod))
+	if err != nil {
+		log.Println("failed to fetch unreferenced blobs, the error is", err)
+		return
+	}
+	purged := 0
+	for _, blob := range blobs {
+		deleted, err := imageMapper.PurgeBlob(ctx, blob, time.Now().Add(-blobGracePeriod))
+		if err != nil {
+			log.Printf("failed to purge blob %s, the error is %s", blob.Path, err)
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		if err := os.Remove(dataDir + blob.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to remove blob %s, the error is %s", blob.Path, err)
+		}
+		purged++
+	}
+	log.Printf("purged %d unreferenced blobs", purged)
+}
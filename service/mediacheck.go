@@ -0,0 +1,428 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"idraw-server/telemetry"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mediaTypeImage = 2
+	// mediaCheckScene 1 资料、2 评论、3 论坛、4 社交日志
+	mediaCheckScene = 3
+	// mediaCheckResubmitAfter 超过该时长仍未收到结果时重新提交
+	mediaCheckResubmitAfter = 30 * time.Minute
+	mediaCheckMaxAttempts   = 5
+	defaultFlaggedLimit     = 20
+	maxFlaggedLimit         = 100
+)
+
+var (
+	// mediaChecker 为空时不审核生成的图片
+	mediaChecker     mediaCheckClient
+	mediaCheckMapper = db.NewMediaCheckMapper()
+	// pushToken 小程序消息推送配置的 token，用于校验推送的签名
+	pushToken = os.Getenv("WX_PUSH_TOKEN")
+
+	errImageReviewing = apperror.New(apperror.CodeImageReviewing, errors.New("image is under review"))
+	errImageBlocked   = apperror.New(apperror.CodeImageBlocked, errors.New("image did not pass the review"))
+)
+
+// mediaCheckClient 提交图片异步审核，结果通过 HandleMediaCheckEvent 回传
+type mediaCheckClient interface {
+	Submit(ctx context.Context, mediaUrl string, openId string) (traceId string, err error)
+}
+
+// MediaCheckEvent 小程序消息推送中的 wxa_media_check 事件
+type MediaCheckEvent struct {
+	MsgType string `json:"MsgType"`
+	Event   string `json:"Event"`
+	TraceId string `json:"trace_id"`
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+	Result  struct {
+		Suggest string `json:"suggest"` // pass, risky or review
+		Label   int    `json:"label"`
+	} `json:"result"`
+}
+
+func init() {
+	mediaChecker = newMediaChecker()
+}
+
+// newMediaChecker 由 MEDIA_CHECK_CLIENT 选择实现：wechat 调用 security.mediaCheckAsync，stub 为离线实现，留空则关闭审核
+func newMediaChecker() mediaCheckClient {
+	switch val := os.Getenv("MEDIA_CHECK_CLIENT"); val {
+	case "":
+		log.Println("lack env MEDIA_CHECK_CLIENT, media check is disabled")
+		return nil
+	case "wechat":
+		// 微信需要通过公网地址拉取图片，并将结果推送到消息推送地址
+		if publicBaseUrl == "" {
+			log.Fatalln("lack env PUBLIC_BASE_URL")
+		}
+		if pushToken == "" {
+			log.Fatalln("lack env WX_PUSH_TOKEN")
+		}
+		return weChatMediaChecker{}
+	case "stub":
+		suggest := os.Getenv("MEDIA_CHECK_STUB_SUGGEST")
+		if suggest == "" {
+			suggest = "pass"
+		}
+		return stubMediaChecker{suggest: suggest}
+	default:
+		log.Fatalln("invalid env MEDIA_CHECK_CLIENT " + val)
+		return nil
+	}
+}
+
+type weChatMediaChecker struct {
+}
+
+type mediaCheckReq struct {
+	MediaUrl  string `json:"media_url"`
+	MediaType int    `json:"media_type"`
+	Version   int    `json:"version"`
+	Scene     int    `json:"scene"`
+	OpenId    string `json:"openid"`
+}
+
+type mediaCheckResp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+	TraceId string `json:"trace_id"`
+}
+
+func (weChatMediaChecker) Submit(ctx context.Context, mediaUrl string, openId string) (traceId string, err error) {
+	body, _ := json.Marshal(mediaCheckReq{MediaUrl: mediaUrl, MediaType: mediaTypeImage, Version: 2, Scene: mediaCheckScene, OpenId: openId})
+	err = withAccessToken(ctx, func(token string) error {
+		reqUrl := weChatApiUrl + "/wxa/media_check_async?access_token=" + url.QueryEscape(token)
+		r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "POST", reqUrl, bytes.NewReader(body))
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != 200 {
+			return classifyStatus(upstreamWeChat, r.StatusCode, nil)
+		}
+		result := mediaCheckResp{}
+		if err = json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return err
+		}
+		if result.ErrCode != 0 {
+			log.Printf("media check async failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+			return weChatError(result.ErrCode, result.ErrMsg)
+		}
+		traceId = result.TraceId
+		return nil
+	})
+	return traceId, err
+}
+
+// stubMediaChecker 稍后以固定的结论回传结果，用于本地开发
+type stubMediaChecker struct {
+	suggest string
+}
+
+func (c stubMediaChecker) Submit(ctx context.Context, _ string, _ string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	traceId := "stub-" + hex.EncodeToString(b)
+	ctx = telemetry.Detach(ctx)
+	time.AfterFunc(2*time.Second, func() {
+		event := MediaCheckEvent{MsgType: "event", Event: "wxa_media_check", TraceId: traceId}
+		event.Result.Suggest = c.suggest
+		event.Result.Label = 100
+		if err := HandleMediaCheckEvent(ctx, event); err != nil {
+			log.Println("failed to handle the stub media check result, the error is", err)
+		}
+	})
+	return traceId, nil
+}
+
+// signPath 审核方拉取图片时使用的签名，持有签名的请求不受审核状态限制
+func signPath(relativePath string) string {
+	mac := hmac.New(sha256.New, []byte(getWeAppSecret()))
+	mac.Write([]byte(relativePath))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func signedImageUrl(relativePath string) string {
+	return publicBaseUrl + "/api/images?fileName=" + url.QueryEscape(relativePath) + "&sig=" + signPath(relativePath)
+}
+
+// checkVisible 图片是否可以展示给用户，保留的原图跟随对应图片的审核结果。
+// 审核条目与记录在同一事务中创建，没有审核条目的图片未提交过审核，均可展示
+func checkVisible(ctx context.Context, relativePath string) error {
+	if strings.HasPrefix(relativePath, originalPath) {
+		relativePath = generatedPath + filepath.Base(relativePath)
+	}
+	check, err := mediaCheckMapper.FetchByPath(ctx, relativePath)
+	switch {
+	case errors.Is(err, db.ErrRecordNotFound):
+		return nil
+	case err != nil:
+		return err
+	case check.Status == db.CheckPass:
+		return nil
+	case check.Status == db.CheckReviewing:
+		return errImageReviewing
+	default:
+		return errImageBlocked
+	}
+}
+
+// fetchHiddenImages 记录中未通过审核的图片
+func fetchHiddenImages(ctx context.Context, records []db.Record) (map[string]bool, error) {
+	ids := []uint{}
+	for _, r := range records {
+		if r.Status != "" {
+			ids = append(ids, r.ID)
+		}
+	}
+	checks, err := mediaCheckMapper.FetchByRecords(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	hidden := map[string]bool{}
+	for _, c := range checks {
+		if c.Status != db.CheckPass && c.Status != db.CheckReviewing {
+			hidden[c.Path] = true
+		}
+	}
+	return hidden, nil
+}
+
+// filterHidden 去掉未通过审核的图片及其原图，原图与图片按下标对应
+func filterHidden(hidden map[string]bool, output []string, originals []string) ([]string, []string) {
+	if len(hidden) == 0 {
+		return output, originals
+	}
+	visible, visibleOriginals := []string{}, []string{}
+	for i, p := range output {
+		if hidden[p] {
+			continue
+		}
+		visible = append(visible, p)
+		if i < len(originals) {
+			visibleOriginals = append(visibleOriginals, originals[i])
+		}
+	}
+	if len(originals) == 0 {
+		visibleOriginals = originals
+	}
+	return visible, visibleOriginals
+}
+
+// checkRecordVisible 审核中或有图片未通过审核的记录不能公开
+func checkRecordVisible(record db.Record) error {
+	switch record.Status {
+	case db.RecordReviewing:
+		return errImageReviewing
+	case db.RecordBlocked:
+		return errImageBlocked
+	default:
+		return nil
+	}
+}
+
+// ServeImage 读取图片，审核中或未通过审核的图片只对持有签名的请求开放
+func ServeImage(ctx context.Context, relativePath string, sig string) (*os.File, error) {
+	if sig == "" || subtle.ConstantTimeCompare([]byte(sig), []byte(signPath(relativePath))) != 1 {
+		if err := checkVisible(ctx, relativePath); err != nil {
+			return nil, err
+		}
+	}
+	return ServeFile(ctx, relativePath)
+}
+
+// submitMediaChecks 将记录的所有图片提交审核，审核条目随记录一同创建，提交失败的由定时任务重试
+func submitMediaChecks(ctx context.Context, user string, recordId uint) {
+	ctx, span := tracer.Start(ctx, "mediaCheck.submit")
+	defer span.End()
+	checks, err := mediaCheckMapper.FetchByRecords(ctx, []uint{recordId})
+	if err != nil {
+		log.Printf("failed to fetch media checks of record %d, the error is %s", recordId, err)
+		return
+	}
+	for _, check := range checks {
+		submitMediaCheck(ctx, user, check)
+	}
+}
+
+func submitMediaCheck(ctx context.Context, user string, check db.MediaCheck) {
+	traceId, err := mediaChecker.Submit(ctx, signedImageUrl(check.Path), user)
+	if err != nil {
+		log.Printf("failed to submit media check of %s, the error is %s", check.Path, err)
+	}
+	if err := mediaCheckMapper.Submitted(ctx, check.ID, traceId); err != nil {
+		log.Printf("failed to save the trace id of media check %d, the error is %s", check.ID, err)
+	}
+}
+
+// resubmitStaleMediaChecks 重新提交长时间未收到结果的审核，超过重试次数后视为审核失败
+func resubmitStaleMediaChecks(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "mediaCheck.resubmit")
+	defer span.End()
+	checks, err := mediaCheckMapper.FetchStale(ctx, time.Now().Add(-mediaCheckResubmitAfter))
+	if err != nil {
+		log.Println("failed to fetch stale media checks, the error is", err)
+		return
+	}
+	for _, check := range checks {
+		if check.Attempts >= mediaCheckMaxAttempts {
+			log.Printf("media check of %s failed after %d attempts", check.Path, check.Attempts)
+			resolveMediaCheck(ctx, check, db.CheckFailed, 0)
+			continue
+		}
+		user, err := userMapper.FetchById(ctx, check.Uid)
+		if err != nil {
+			log.Printf("failed to fetch the owner of media check %d, the error is %s", check.ID, err)
+			continue
+		}
+		submitMediaCheck(ctx, user.OpenId, check)
+	}
+}
+
+// HandleMediaCheckEvent 处理异步审核结果，重复推送的结果会被忽略
+func HandleMediaCheckEvent(ctx context.Context, event MediaCheckEvent) error {
+	ctx, span := tracer.Start(ctx, "mediaCheck.result")
+	defer span.End()
+	check, err := mediaCheckMapper.FetchByTraceId(ctx, event.TraceId)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		log.Printf("unknown media check trace id %s", event.TraceId)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	status := db.CheckReview
+	switch {
+	case event.ErrCode != 0:
+		// 微信未能完成审核，例如拉取图片失败，等待重新提交
+		log.Printf("media check of %s failed, errcode: %d, errmsg: %s", check.Path, event.ErrCode, event.ErrMsg)
+		return nil
+	case event.Result.Suggest == "pass":
+		status = db.CheckPass
+	case event.Result.Suggest == "risky":
+		status = db.CheckRisky
+	}
+	resolveMediaCheck(ctx, check, status, event.Result.Label)
+	return nil
+}
+
+// resolveMediaCheck 写入审核结果，图片未通过审核时按比例退还本次生成扣减的额度
+func resolveMediaCheck(ctx context.Context, check db.MediaCheck, status string, label int) {
+	if err := mediaCheckMapper.Resolve(ctx, check.ID, status, label); err != nil {
+		log.Printf("failed to resolve media check %d, the error is %s", check.ID, err)
+		return
+	}
+	if oaTokens != nil {
+		settleOaDelivery(ctx, check.Path, status == db.CheckPass)
+	}
+	if status == db.CheckPass {
+		return
+	}
+	log.Printf("image %s of record %d is flagged as %s, label %d", check.Path, check.RecordId, status, label)
+	uid, refunded, err := ledgerMapper.RefundBlockedImage(ctx, check.ID)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		// the record was saved without a charge
+		return
+	} else if err != nil {
+		log.Printf("failed to refund blocked image %s of record %d, the error is %s", check.Path, check.RecordId, err)
+		return
+	}
+	if refunded == 0 {
+		return
+	}
+	user, err := userMapper.FetchById(ctx, uid)
+	if err != nil {
+		log.Printf("failed to fetch the owner of record %d, the error is %s", check.RecordId, err)
+		return
+	}
+	invalidateQuotaCache(ctx, user.OpenId)
+	log.Printf("refunded %d for blocked image %s of user %s", refunded, check.Path, user.OpenId)
+}
+
+// VerifyPushSignature 校验小程序消息推送的签名
+func VerifyPushSignature(signature string, timestamp string, nonce string) bool {
+	if pushToken == "" {
+		return false
+	}
+	parts := []string{pushToken, timestamp, nonce}
+	sort.Strings(parts)
+	sum := sha1.Sum([]byte(strings.Join(parts, "")))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(signature)) == 1
+}
+
+// FetchFlaggedImages 未通过审核的图片，供运维复核
+func FetchFlaggedImages(ctx context.Context, cursor string, limit int) (*response.FlaggedImagesDto, error) {
+	if limit <= 0 {
+		limit = defaultFlaggedLimit
+	}
+	if limit > maxFlaggedLimit {
+		limit = maxFlaggedLimit
+	}
+	var beforeId uint64
+	if cursor != "" {
+		var err error
+		if beforeId, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return nil, errInvalidCursor
+		}
+	}
+	checks, err := mediaCheckMapper.FetchFlagged(ctx, uint(beforeId), limit)
+	if err != nil {
+		return nil, err
+	}
+	result := &response.FlaggedImagesDto{Items: make([]response.FlaggedImageDto, len(checks))}
+	owners := map[uint]string{}
+	for i, c := range checks {
+		if _, ok := owners[c.Uid]; !ok {
+			user, err := userMapper.FetchById(ctx, c.Uid)
+			if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+				return nil, err
+			}
+			owners[c.Uid] = user.OpenId
+		}
+		result.Items[i] = response.FlaggedImageDto{
+			Id:        c.ID,
+			RecordId:  c.RecordId,
+			User:      owners[c.Uid],
+			FileName:  c.Path,
+			Url:       signedImageUrl(c.Path),
+			Status:    c.Status,
+			Label:     c.Label,
+			TraceId:   c.TraceId,
+			CheckedAt: c.ModifiedTime,
+		}
+	}
+	if len(checks) == limit {
+		result.NextCursor = fmt.Sprint(checks[len(checks)-1].ID)
+	}
+	return result, nil
+}
@@ -0,0 +1,414 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"idraw-server/api/request"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"idraw-server/telemetry"
+	"idraw-server/wxmsg"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	prefixOaMessage  string = "oa-msg-"
+	prefixOaUnionId  string = "oa-union-"
+	prefixOaDelivery string = "oa-delivery-"
+	prefixOaInFlight string = "oa-inflight-"
+	// oaMessageTTL 微信在 5 秒内未收到应答时会重试推送，按 MsgId 去重
+	oaMessageTTL = 10 * time.Minute
+	oaUnionIdTTL = 7 * 24 * time.Hour
+	// oaDeliveryTTL 客服消息只能在用户最近一次互动后的 48 小时内下发
+	oaDeliveryTTL = 48 * time.Hour
+	// oaInFlightTTL 每个公众号用户同时只有一次生成，生成异常退出时锁在到期后释放
+	oaInFlightTTL = 10 * time.Minute
+	oaImageSize   = "512x512"
+	// maxOaPromptLength 超出长度的描述不予生成
+	maxOaPromptLength = 500
+
+	oaWelcomeReply   = "欢迎关注！发送一段画面描述，即可收到为你生成的图片。"
+	oaUnsupported    = "目前只支持文字描述，发送一段画面描述试试吧。"
+	oaPromptTooLong  = "描述太长了，请精简到 500 字以内再发送。"
+	oaNotLoggedIn    = "请先打开小程序登录一次，再回到这里发送描述。"
+	oaGeneratingText = "收到，正在生成图片，完成后会发送给你，请稍候。"
+	oaInFlightText   = "上一张图片还在生成中，完成后再发送新的描述吧。"
+	oaTooFrequent    = "发送太频繁了，请稍后再试。"
+	oaBlockedText    = "生成的图片未通过内容审核，本次不扣除次数，换个描述试试吧。"
+)
+
+var (
+	// oaTokens 为空时不启用公众号的文字生图
+	oaTokens  *tokenSource
+	oaToken   string
+	oaCrypter *wxmsg.Crypter
+
+	errOaDisabled = apperror.New(apperror.CodeNotFound, errors.New("official account is not configured"))
+	// errFollowerUnbound 公众号未绑定开放平台，或用户未登录过小程序，无法关联到用户
+	errFollowerUnbound = errors.New("follower is not bound to any user")
+)
+
+func init() {
+	appId := os.Getenv("OA_APP_ID")
+	if appId == "" {
+		log.Println("lack env OA_APP_ID, official account chatbot is disabled")
+		return
+	}
+	secret := os.Getenv("OA_APP_SECRET")
+	if secret == "" {
+		log.Fatalln("lack env OA_APP_SECRET")
+	}
+	if oaToken = os.Getenv("OA_TOKEN"); oaToken == "" {
+		log.Fatalln("lack env OA_TOKEN")
+	}
+	// 只接受安全模式的消息，明文模式的签名不覆盖消息体
+	aesKey := os.Getenv("OA_ENCODING_AES_KEY")
+	if aesKey == "" {
+		log.Fatalln("lack env OA_ENCODING_AES_KEY")
+	}
+	var err error
+	if oaCrypter, err = wxmsg.NewCrypter(oaToken, aesKey, appId); err != nil {
+		log.Fatalln("invalid env OA_ENCODING_AES_KEY, the error is", err)
+	}
+	oaTokens = &tokenSource{name: "official account", appId: appId, secret: secret, key: "wx-oa-access-token"}
+}
+
+// VerifyCallbackSignature 校验公众号服务器地址验证及消息推送的签名
+func VerifyCallbackSignature(signature string, timestamp string, nonce string) bool {
+	if oaTokens == nil {
+		return false
+	}
+	return wxmsg.VerifySignature(oaToken, signature, timestamp, nonce)
+}
+
+// HandleOfficialAccountMessage 解密并处理公众号推送的消息，返回加密后的被动回复，无需回复时返回 nil
+func HandleOfficialAccountMessage(ctx context.Context, timestamp string, nonce string, msgSignature string, body []byte) ([]byte, error) {
+	if oaTokens == nil {
+		return nil, errOaDisabled
+	}
+	ctx, span := tracer.Start(ctx, "officialAccount.message")
+	defer span.End()
+	envelope := wxmsg.Envelope{}
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		return nil, apperror.New(apperror.CodeInvalidParams, err)
+	}
+	if envelope.Encrypt == "" {
+		return nil, apperror.New(apperror.CodeInvalidParams, errors.New("plaintext messages are not accepted"))
+	}
+	plain, err := oaCrypter.Decrypt(msgSignature, timestamp, nonce, envelope.Encrypt)
+	if err != nil {
+		return nil, apperror.New(apperror.CodeUnauthorized, err)
+	}
+	msg := wxmsg.Message{}
+	if err := xml.Unmarshal(plain, &msg); err != nil {
+		return nil, apperror.New(apperror.CodeInvalidParams, err)
+	}
+	reply, err := replyOaMessage(ctx, msg)
+	if err != nil || reply == "" {
+		return nil, err
+	}
+	b, err := xml.Marshal(wxmsg.NewTextReply(msg, reply))
+	if err != nil {
+		return nil, err
+	}
+	return oaCrypter.EncryptReply(b, timestamp, nonce)
+}
+
+// replyOaMessage 处理一条消息，返回被动回复的文本
+func replyOaMessage(ctx context.Context, msg wxmsg.Message) (string, error) {
+	switch {
+	case msg.MsgType == wxmsg.MsgTypeEvent && msg.Event == wxmsg.EventSubscribe:
+		return oaWelcomeReply, nil
+	case msg.MsgType == wxmsg.MsgTypeEvent:
+		return "", nil
+	case msg.MsgType != wxmsg.MsgTypeText:
+		return oaUnsupported, nil
+	}
+	key := prefixOaMessage + strconv.FormatInt(msg.MsgId, 10)
+	first, err := redisCli.SetNX(ctx, key, 1, oaMessageTTL).Result()
+	if err != nil {
+		return "", err
+	}
+	if !first {
+		log.Printf("ignore the retried message %d of follower %s", msg.MsgId, msg.FromUserName)
+		return "", nil
+	}
+	reply, err := startOaGeneration(ctx, msg)
+	if err != nil {
+		// let the retried push through
+		redisCli.Del(ctx, key)
+	}
+	return reply, err
+}
+
+// startOaGeneration 关联到小程序用户后异步生成，生成的图片通过客服消息下发。
+// 与小程序共用生成在用户维度的限流，每个公众号用户同时只有一次生成
+func startOaGeneration(ctx context.Context, msg wxmsg.Message) (string, error) {
+	prompt := strings.TrimSpace(msg.Content)
+	if prompt == "" {
+		return oaUnsupported, nil
+	}
+	if len([]rune(prompt)) > maxOaPromptLength {
+		return oaPromptTooLong, nil
+	}
+	user, err := resolveFollower(ctx, msg.FromUserName)
+	if errors.Is(err, errFollowerUnbound) || errors.Is(err, db.ErrRecordNotFound) {
+		return oaNotLoggedIn, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// the same limits as the mini program apply before any goroutine is started
+	inFlightKey := prefixOaInFlight + msg.FromUserName
+	acquired, err := redisCli.SetNX(ctx, inFlightKey, user.OpenId, oaInFlightTTL).Result()
+	if err != nil {
+		return "", err
+	}
+	if !acquired {
+		log.Printf("follower %s already has a generation in flight", msg.FromUserName)
+		return oaInFlightText, nil
+	}
+	result, err := AllowRequest(ctx, GenerationRoute+":user:"+user.OpenId, GenerationUserLimit, GenerationUserWindow)
+	if err != nil {
+		// fail open as the rate limit middleware does
+		log.Println("rate limit check failed, let the generation pass, the error is", err)
+	} else if !result.Allowed {
+		redisCli.Del(ctx, inFlightKey)
+		log.Printf("follower %s of user %s exceeds the generation limit", msg.FromUserName, user.OpenId)
+		return oaTooFrequent, nil
+	}
+	log.Printf("follower %s of user %s asks for a generation", msg.FromUserName, user.OpenId)
+	go generateForFollower(telemetry.Detach(ctx), msg.FromUserName, user.OpenId, prompt)
+	return oaGeneratingText, nil
+}
+
+type oaUserInfoResp struct {
+	Subscribe int    `json:"subscribe"`
+	OpenId    string `json:"openid"`
+	UnionId   string `json:"unionid"`
+	ErrCode   int    `json:"errcode"`
+	ErrMsg    string `json:"errmsg"`
+}
+
+// resolveFollower 通过 unionId 将公众号的 openId 关联到小程序的用户
+func resolveFollower(ctx context.Context, follower string) (db.User, error) {
+	unionId, err := redisCli.Get(ctx, prefixOaUnionId+follower).Result()
+	if errors.Is(err, redis.Nil) {
+		if unionId, err = fetchFollowerUnionId(ctx, follower); err != nil {
+			return db.User{}, err
+		}
+		if unionId == "" {
+			return db.User{}, errFollowerUnbound
+		}
+		// the union id of a follower never changes
+		redisCli.Set(ctx, prefixOaUnionId+follower, unionId, oaUnionIdTTL)
+	} else if err != nil {
+		return db.User{}, err
+	}
+	return userMapper.FetchByUnionId(ctx, unionId)
+}
+
+// fetchFollowerUnionId 公众号绑定开放平台后，用户信息中才会带有 unionid
+func fetchFollowerUnionId(ctx context.Context, follower string) (string, error) {
+	result := oaUserInfoResp{}
+	err := oaTokens.with(ctx, func(token string) error {
+		params := url.Values{}
+		params.Add("access_token", token)
+		params.Add("openid", follower)
+		params.Add("lang", "zh_CN")
+		reqUrl := weChatApiUrl + "/cgi-bin/user/info?" + params.Encode()
+		r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != 200 {
+			return classifyStatus(upstreamWeChat, r.StatusCode, nil)
+		}
+		if err = json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return err
+		}
+		if result.ErrCode != 0 {
+			log.Printf("get follower info failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+			return weChatError(result.ErrCode, result.ErrMsg)
+		}
+		return nil
+	})
+	return result.UnionId, err
+}
+
+// generateForFollower 走与小程序相同的生成流程，额度、会员等级与审核均按关联的用户计算
+func generateForFollower(ctx context.Context, follower string, openId string, prompt string) {
+	ctx, span := tracer.Start(ctx, "officialAccount.generate")
+	defer span.End()
+	urls, err := GenerateImagesByPrompt(ctx, request.ImageGenerationReq{User: openId, Prompt: prompt, N: 1, Size: oaImageSize})
+	// the delivery may wait for the media check, the follower can ask for the next one already
+	redisCli.Del(ctx, prefixOaInFlight+follower)
+	if err != nil {
+		log.Printf("generation of follower %s failed, the error is %s", follower, err)
+		sendOaText(ctx, follower, apperror.From(err, 0).Message(apperror.Lang("")))
+		return
+	}
+	for _, u := range urls {
+		if mediaChecker == nil {
+			deliverOaImage(ctx, follower, u)
+			continue
+		}
+		// 审核通过后再下发，审核结果可能在写入之前就已经回传
+		if err := redisCli.Set(ctx, prefixOaDelivery+u, follower, oaDeliveryTTL).Err(); err != nil {
+			log.Printf("failed to save the delivery of %s, the error is %s", u, err)
+			continue
+		}
+		check, err := mediaCheckMapper.FetchByPath(ctx, u)
+		if err == nil && check.Status != db.CheckReviewing {
+			settleOaDelivery(ctx, u, check.Status == db.CheckPass)
+		}
+	}
+}
+
+// settleOaDelivery 图片审核有结果后下发给等待中的公众号用户，每张图片只会下发一次
+func settleOaDelivery(ctx context.Context, path string, passed bool) {
+	follower, err := redisCli.GetDel(ctx, prefixOaDelivery+path).Result()
+	if errors.Is(err, redis.Nil) {
+		return
+	}
+	if err != nil {
+		log.Printf("failed to fetch the delivery of %s, the error is %s", path, err)
+		return
+	}
+	if passed {
+		deliverOaImage(ctx, follower, path)
+	} else {
+		sendOaText(ctx, follower, oaBlockedText)
+	}
+}
+
+type oaMediaResp struct {
+	MediaId string `json:"media_id"`
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+type customMessage struct {
+	ToUser  string       `json:"touser"`
+	MsgType string       `json:"msgtype"`
+	Text    *customText  `json:"text,omitempty"`
+	Image   *customMedia `json:"image,omitempty"`
+}
+
+type customMessageResp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+type customText struct {
+	Content string `json:"content"`
+}
+
+type customMedia struct {
+	MediaId string `json:"media_id"`
+}
+
+// deliverOaImage 上传为临时素材后以客服消息下发
+func deliverOaImage(ctx context.Context, follower string, path string) {
+	mediaId, err := uploadOaImage(ctx, path)
+	if err != nil {
+		log.Printf("failed to upload %s for follower %s, the error is %s", path, follower, err)
+		return
+	}
+	sendCustomMessage(ctx, customMessage{ToUser: follower, MsgType: "image", Image: &customMedia{MediaId: mediaId}})
+}
+
+func sendOaText(ctx context.Context, follower string, content string) {
+	sendCustomMessage(ctx, customMessage{ToUser: follower, MsgType: "text", Text: &customText{Content: content}})
+}
+
+// uploadOaImage 调用 media/upload 上传临时素材，返回 media_id
+func uploadOaImage(ctx context.Context, path string) (string, error) {
+	file, err := ServeFile(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	buf := new(bytes.Buffer)
+	mp := multipart.NewWriter(buf)
+	part, _ := mp.CreateFormFile("media", filepath.Base(path))
+	if _, err := io.Copy(part, file); err != nil {
+		return "", err
+	}
+	mp.Close()
+	result := oaMediaResp{}
+	err = oaTokens.with(ctx, func(token string) error {
+		reqUrl := weChatApiUrl + "/cgi-bin/media/upload?type=image&access_token=" + url.QueryEscape(token)
+		r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+			r, err := http.NewRequestWithContext(ctx, "POST", reqUrl, bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			r.Header.Set("Content-Type", mp.FormDataContentType())
+			return r, nil
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != 200 {
+			return classifyStatus(upstreamWeChat, r.StatusCode, nil)
+		}
+		if err = json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return err
+		}
+		if result.ErrCode != 0 {
+			log.Printf("upload media failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+			return weChatError(result.ErrCode, result.ErrMsg)
+		}
+		return nil
+	})
+	return result.MediaId, err
+}
+
+// sendCustomMessage 调用 message/custom/send 下发客服消息
+func sendCustomMessage(ctx context.Context, msg customMessage) {
+	body, _ := json.Marshal(msg)
+	err := oaTokens.with(ctx, func(token string) error {
+		reqUrl := weChatApiUrl + "/cgi-bin/message/custom/send?access_token=" + url.QueryEscape(token)
+		r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "POST", reqUrl, bytes.NewReader(body))
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != 200 {
+			return classifyStatus(upstreamWeChat, r.StatusCode, nil)
+		}
+		result := customMessageResp{}
+		if err = json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return err
+		}
+		if result.ErrCode != 0 {
+			log.Printf("send custom message failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+			return weChatError(result.ErrCode, result.ErrMsg)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to send the %s message to follower %s, the error is %s", msg.MsgType, msg.ToUser, err)
+	}
+}
@@ -0,0 +1,321 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"idraw-server/wxpay"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// orderExpiration 订单的支付时限，超时后微信侧自动关单
+const orderExpiration = 30 * time.Minute
+
+var defaultCreditPacks = []response.CreditPackDto{
+	{Id: "pack-10", Title: "10 次生成", Credits: 10, Price: 300},
+	{Id: "pack-50", Title: "50 次生成", Credits: 50, Price: 1200},
+	{Id: "pack-200", Title: "200 次生成", Credits: 200, Price: 3990},
+	{Id: "member-30", Title: "会员 30 天", Tier: TierMember, Days: 30, Price: 1500},
+	{Id: "pro-30", Title: "专业版 30 天", Tier: TierPro, Days: 30, Price: 3990},
+}
+
+var (
+	payClient   *wxpay.Client
+	orderMapper db.OrderMapper
+	creditPacks []response.CreditPackDto
+
+	errPaymentDisabled = apperror.New(apperror.CodeServiceUnavailable, errors.New("wechat pay is not configured"))
+	errOrderNotFound   = apperror.New(apperror.CodeNotFound, errors.New("order not found"))
+)
+
+func init() {
+	orderMapper = db.NewOrderMapper()
+	creditPacks = loadCreditPacks()
+	if os.Getenv("WXPAY_MCH_ID") == "" {
+		log.Println("lack env WXPAY_MCH_ID, payments are disabled")
+		return
+	}
+	client, err := newPayClient()
+	if err != nil {
+		log.Fatalln("init wechat pay client failed, the error is", err)
+	}
+	payClient = client
+}
+
+// loadCreditPacks 可通过 CREDIT_PACKS 以 json 数组覆盖默认的次数包
+func loadCreditPacks() []response.CreditPackDto {
+	val := os.Getenv("CREDIT_PACKS")
+	if val == "" {
+		return defaultCreditPacks
+	}
+	packs := []response.CreditPackDto{}
+	if err := json.Unmarshal([]byte(val), &packs); err != nil {
+		log.Fatalln("invalid env CREDIT_PACKS, the error is", err)
+	}
+	return packs
+}
+
+func newPayClient() (*wxpay.Client, error) {
+	log.Println("validating wechat pay's env injections")
+	for _, key := range []string{"WXPAY_SERIAL_NO", "WXPAY_PRIVATE_KEY_PATH", "WXPAY_API_V3_KEY",
+		"WXPAY_PLATFORM_SERIAL", "WXPAY_PLATFORM_KEY_PATH", "WXPAY_NOTIFY_URL"} {
+		if os.Getenv(key) == "" {
+			return nil, errors.New("lack env " + key)
+		}
+	}
+	privateKey, err := wxpay.LoadPrivateKey(os.Getenv("WXPAY_PRIVATE_KEY_PATH"))
+	if err != nil {
+		return nil, err
+	}
+	platformKey, err := wxpay.LoadPublicKey(os.Getenv("WXPAY_PLATFORM_KEY_PATH"))
+	if err != nil {
+		return nil, err
+	}
+	log.Println("validation done")
+	return wxpay.NewClient(wxpay.Config{
+		ApiUrl:         os.Getenv("WXPAY_API_URL"),
+		AppId:          getWeAppId(),
+		MchId:          os.Getenv("WXPAY_MCH_ID"),
+		SerialNo:       os.Getenv("WXPAY_SERIAL_NO"),
+		PrivateKey:     privateKey,
+		ApiV3Key:       []byte(os.Getenv("WXPAY_API_V3_KEY")),
+		PlatformSerial: os.Getenv("WXPAY_PLATFORM_SERIAL"),
+		PlatformKey:    platformKey,
+		NotifyUrl:      os.Getenv("WXPAY_NOTIFY_URL"),
+		HttpClient:     httpClient,
+	}), nil
+}
+
+func CreditPacks() []response.CreditPackDto {
+	return creditPacks
+}
+
+func findCreditPack(packId string) *response.CreditPackDto {
+	for i := range creditPacks {
+		if creditPacks[i].Id == packId {
+			return &creditPacks[i]
+		}
+	}
+	return nil
+}
+
+// CreateOrder 创建次数包订单并向微信支付下单，返回小程序调起支付所需的参数
+func CreateOrder(ctx context.Context, openId string, packId string) (*response.PaymentDto, error) {
+	if payClient == nil {
+		return nil, errPaymentDisabled
+	}
+	pack := findCreditPack(packId)
+	if pack == nil {
+		return nil, apperror.New(apperror.CodeInvalidParams, errors.New("unknown pack "+packId))
+	}
+	order, err := orderMapper.Insert(ctx, openId, db.Order{
+		OutTradeNo: newOutTradeNo(),
+		PackId:     pack.Id,
+		Credits:    pack.Credits,
+		Tier:       pack.Tier,
+		Days:       pack.Days,
+		Amount:     pack.Price,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrRecordNotFound) {
+			return nil, apperror.New(apperror.CodeUnauthorized, err)
+		}
+		return nil, err
+	}
+	ctx, span := tracer.Start(ctx, "wxpay.prepay")
+	prepayId, err := payClient.PrepayJsapi(ctx, pack.Title, order.OutTradeNo, order.Amount, openId, time.Now().Add(orderExpiration))
+	span.End()
+	if err != nil {
+		log.Printf("prepay order %s failed, the error is %s", order.OutTradeNo, err)
+		return nil, apperror.New(apperror.CodeServiceUnavailable, err)
+	}
+	if err := orderMapper.UpdatePrepayId(ctx, order.ID, prepayId); err != nil {
+		return nil, err
+	}
+	params, err := payClient.JsapiPayParams(prepayId)
+	if err != nil {
+		return nil, err
+	}
+	return &response.PaymentDto{
+		Order: toOrderDto(order),
+		PayParams: response.PayParamsDto{
+			TimeStamp: params.TimeStamp,
+			NonceStr:  params.NonceStr,
+			Package:   params.Package,
+			SignType:  params.SignType,
+			PaySign:   params.PaySign,
+		},
+	}, nil
+}
+
+// HandlePaymentNotify 处理微信支付的支付结果通知，验签失败或处理失败时返回错误，微信会稍后重试
+func HandlePaymentNotify(ctx context.Context, r *http.Request) error {
+	if payClient == nil {
+		return errPaymentDisabled
+	}
+	tx, err := payClient.ParseNotify(r)
+	if err != nil {
+		log.Println("parse wechat pay notification failed, the error is", err)
+		return err
+	}
+	return settleOrder(ctx, tx)
+}
+
+// QueryOrder 查询订单，未支付的订单会向微信支付确认最新状态，以弥补丢失的回调
+func QueryOrder(ctx context.Context, openId string, outTradeNo string) (*response.OrderDto, error) {
+	order, err := fetchOwnOrder(ctx, openId, outTradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status == db.OrderCreated && payClient != nil {
+		tx, err := payClient.QueryOrder(ctx, outTradeNo)
+		if err != nil {
+			log.Printf("query order %s failed, the error is %s", outTradeNo, err)
+		} else {
+			switch tx.TradeState {
+			case wxpay.TradeSuccess:
+				err = settleOrder(ctx, tx)
+			case wxpay.TradeClosed, wxpay.TradeRevoked, wxpay.TradePayError:
+				err = orderMapper.MarkClosed(ctx, outTradeNo)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if order, err = orderMapper.FetchByOutTradeNo(ctx, outTradeNo); err != nil {
+				return nil, err
+			}
+		}
+	}
+	dto := toOrderDto(order)
+	return &dto, nil
+}
+
+// FetchOrders 用户的所有订单
+func FetchOrders(ctx context.Context, openId string) ([]response.OrderDto, error) {
+	orders, err := orderMapper.FetchByUser(ctx, openId)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return []response.OrderDto{}, err
+	}
+	result := make([]response.OrderDto, len(orders))
+	for i, o := range orders {
+		result[i] = toOrderDto(o)
+	}
+	return result, nil
+}
+
+// CloseOrder 关闭未支付的订单
+func CloseOrder(ctx context.Context, openId string, outTradeNo string) error {
+	if payClient == nil {
+		return errPaymentDisabled
+	}
+	order, err := fetchOwnOrder(ctx, openId, outTradeNo)
+	if err != nil {
+		return err
+	}
+	if order.Status != db.OrderCreated {
+		return apperror.New(apperror.CodeInvalidParams, errors.New("order is "+order.Status))
+	}
+	if err := payClient.CloseOrder(ctx, outTradeNo); err != nil {
+		var apiErr *wxpay.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == "ORDERPAID" {
+			// paid in the meantime, let the query settle it
+			_, err = QueryOrder(ctx, openId, outTradeNo)
+			return err
+		}
+		return apperror.New(apperror.CodeServiceUnavailable, err)
+	}
+	return orderMapper.MarkClosed(ctx, outTradeNo)
+}
+
+// settleMaxAttempts 用户的会员等级被并发修改时重新计算并入账的次数
+const settleMaxAttempts = 3
+
+// settleOrder 校验交易信息后将订单入账，次数与会员等级取自下单时记录在订单上的值，
+// 入账与开通会员在同一事务中完成，重复调用是安全的
+func settleOrder(ctx context.Context, tx *wxpay.Transaction) error {
+	if tx.TradeState != wxpay.TradeSuccess {
+		log.Printf("ignore order %s in state %s", tx.OutTradeNo, tx.TradeState)
+		return nil
+	}
+	order, err := orderMapper.FetchByOutTradeNo(ctx, tx.OutTradeNo)
+	if err != nil {
+		return err
+	}
+	if tx.MchId != payClient.MchId() || tx.AppId != payClient.AppId() || tx.Amount.Total != order.Amount {
+		return fmt.Errorf("transaction of order %s does not match, mchid: %s, appid: %s, total: %d",
+			tx.OutTradeNo, tx.MchId, tx.AppId, tx.Amount.Total)
+	}
+	if order.Status == db.OrderPaid {
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		user, err := userMapper.FetchById(ctx, order.Uid)
+		if err != nil {
+			return err
+		}
+		var grant *db.MembershipGrant
+		if order.Tier != "" {
+			if grant, err = membershipGrant(user, order.Tier, order.Days); err != nil {
+				log.Printf("grant %s membership of order %s failed, the error is %s", order.Tier, order.OutTradeNo, err)
+				return err
+			}
+		}
+		credited, err := orderMapper.MarkPaid(ctx, tx.OutTradeNo, tx.TransactionId, grant)
+		if errors.Is(err, db.ErrUserModified) && attempt < settleMaxAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if credited {
+			log.Printf("order %s paid, %d credits granted", tx.OutTradeNo, order.Credits)
+			if grant != nil {
+				log.Printf("order %s paid, %s membership granted until %s", tx.OutTradeNo, grant.Tier, grant.ExpiredTime.Format(time.DateTime))
+			}
+			invalidateQuotaCache(ctx, user.OpenId)
+		}
+		return nil
+	}
+}
+
+func fetchOwnOrder(ctx context.Context, openId string, outTradeNo string) (db.Order, error) {
+	order, err := orderMapper.FetchByOutTradeNo(ctx, outTradeNo)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return order, errOrderNotFound
+	}
+	if err != nil {
+		return order, err
+	}
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if err != nil || user.ID != order.Uid {
+		return order, errOrderNotFound
+	}
+	return order, nil
+}
+
+// newOutTradeNo 商户订单号，时间前缀便于对账，随机后缀避免冲突，总长度不超过 32
+func newOutTradeNo() string {
+	return "ID" + time.Now().Format("20060102150405") + wxpay.NonceStr()[:12]
+}
+
+func toOrderDto(o db.Order) response.OrderDto {
+	dto := response.OrderDto{
+		OutTradeNo: o.OutTradeNo,
+		PackId:     o.PackId,
+		Credits:    o.Credits,
+		Amount:     o.Amount,
+		Status:     o.Status,
+		CreatedAt:  o.CreatedTime.UnixMilli(),
+	}
+	if !o.PaidTime.IsZero() {
+		dto.PaidAt = o.PaidTime.UnixMilli()
+	}
+	return dto
+}
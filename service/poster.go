@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"idraw-server/poster"
+	"idraw-server/telemetry"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/image/font/opentype"
+)
+
+const (
+	posterPath string = "/idraw-poster-dir/"
+	posterHint string = "长按识别小程序码，一起来画"
+	// maxSceneLength wxacode.getUnlimited 的 scene 最长 32 个字符
+	maxSceneLength = 32
+)
+
+var (
+	// posterFont 海报与水印共用的字体，在各文件的 init 之前加载
+	posterFont = loadPosterFont()
+	composer   = poster.NewComposer(posterFont)
+	coder      miniProgramCoder
+	// codePage 小程序码打开的页面，该页面需读取 scene 参数
+	codePage = os.Getenv("WXACODE_PAGE")
+)
+
+// miniProgramCoder 生成带参数的小程序码
+type miniProgramCoder interface {
+	Code(ctx context.Context, scene string, page string) (image.Image, error)
+}
+
+func init() {
+	if codePage == "" {
+		codePage = "pages/index/index"
+	}
+	coder = newMiniProgramCoder()
+}
+
+// loadPosterFont 字体不随程序分发，需通过 POSTER_FONT_PATH 指定一个 CJK 字体，例如镜像中的 Noto Sans SC
+func loadPosterFont() *opentype.Font {
+	path := os.Getenv("POSTER_FONT_PATH")
+	if path == "" {
+		log.Fatalln("lack env POSTER_FONT_PATH, set it to a CJK font file such as NotoSansSC-Regular.otf")
+	}
+	f, err := poster.LoadFont(path)
+	if err != nil {
+		log.Fatalln("invalid env POSTER_FONT_PATH, the error is", err)
+	}
+	return f
+}
+
+// newMiniProgramCoder 由 WXACODE_CLIENT 选择实现：默认调用微信接口，stub 为离线实现
+func newMiniProgramCoder() miniProgramCoder {
+	switch val := os.Getenv("WXACODE_CLIENT"); val {
+	case "", "wechat":
+		envVersion := os.Getenv("WXACODE_ENV_VERSION")
+		if envVersion == "" {
+			envVersion = "release"
+		}
+		return weChatCoder{envVersion: envVersion}
+	case "stub":
+		return stubCoder{}
+	default:
+		log.Fatalln("invalid env WXACODE_CLIENT " + val)
+		return nil
+	}
+}
+
+type weChatCoder struct {
+	envVersion string // release, trial or develop
+}
+
+type wxaCodeReq struct {
+	Scene      string `json:"scene"`
+	Page       string `json:"page"`
+	CheckPath  bool   `json:"check_path"`
+	EnvVersion string `json:"env_version"`
+	Width      int    `json:"width"`
+}
+
+type wxaCodeErr struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// Code 调用 wxacode.getUnlimited，成功时返回图片，失败时返回 json 格式的错误
+func (c weChatCoder) Code(ctx context.Context, scene string, page string) (code image.Image, err error) {
+	body, _ := json.Marshal(wxaCodeReq{Scene: scene, Page: page, EnvVersion: c.envVersion, Width: 280})
+	err = withAccessToken(ctx, func(token string) error {
+		reqUrl := weChatApiUrl + "/wxa/getwxacodeunlimit?access_token=" + url.QueryEscape(token)
+		r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "POST", reqUrl, bytes.NewReader(body))
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != 200 {
+			return classifyStatus(upstreamWeChat, r.StatusCode, nil)
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			result := wxaCodeErr{}
+			if err = json.NewDecoder(r.Body).Decode(&result); err != nil {
+				return err
+			}
+			log.Printf("get wxacode failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+			return weChatError(result.ErrCode, result.ErrMsg)
+		}
+		code, _, err = image.Decode(io.LimitReader(r.Body, maxImageSize))
+		return err
+	})
+	return code, err
+}
+
+// stubCoder 根据 scene 生成确定的色块图案代替小程序码，用于本地开发
+type stubCoder struct {
+}
+
+func (stubCoder) Code(_ context.Context, scene string, page string) (image.Image, error) {
+	const cells, cell = 16, 10
+	sum := sha256.Sum256([]byte(page + "?" + scene))
+	img := image.NewRGBA(image.Rect(0, 0, cells*cell, cells*cell))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for i := 0; i < cells*cells; i++ {
+		if sum[i/8%len(sum)]>>(i%8)&1 == 0 {
+			continue
+		}
+		x, y := i%cells*cell, i/cells*cell
+		draw.Draw(img, image.Rect(x, y, x+cell, y+cell), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	}
+	return img, nil
+}
+
+// posterScene 小程序码携带记录 id，以及作者的邀请码以便扫码的新用户绑定邀请关系
+func posterScene(record db.Record, user db.User) string {
+	scene := "r=" + strconv.FormatUint(uint64(record.ID), 10)
+	if user.InviteCode != nil {
+		if withInvite := scene + "&i=" + *user.InviteCode; len(withInvite) <= maxSceneLength {
+			scene = withInvite
+		}
+	}
+	return scene
+}
+
+// CreatePoster 为用户自己的生成记录合成分享海报，内容未变时直接返回已生成的海报
+func CreatePoster(ctx context.Context, openId string, recordId uint, index int) (relativeDst string, err error) {
+	ctx, span := tracer.Start(ctx, "poster.create")
+	defer func() { telemetry.End(span, err) }()
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if err != nil {
+		if errors.Is(err, db.ErrRecordNotFound) {
+			return "", apperror.New(apperror.CodeUnauthorized, err)
+		}
+		return "", err
+	}
+	record, err := recordMapper.FetchByUserAndId(ctx, openId, recordId)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return "", apperror.New(apperror.CodeNotFound, err)
+	} else if err != nil {
+		return "", err
+	}
+	var output []string
+	_ = json.Unmarshal([]byte(record.Output), &output)
+	if index < 0 || index >= len(output) {
+		return "", apperror.New(apperror.CodeNotFound, fmt.Errorf("image %d of record %d not found", index, recordId))
+	}
+	if err = checkVisible(ctx, output[index]); err != nil {
+		return "", err
+	}
+	spec := poster.Spec{Author: user.NickName, Hint: posterHint}
+	if spec.Author == "" {
+		spec.Author = "iDraw 用户"
+	}
+	// 变体的输入是用户上传的图片路径，不展示
+	if record.Type == typePrompt {
+		spec.Caption = record.Input
+	}
+	scene := posterScene(record, user)
+	sum := sha256.Sum256([]byte(strings.Join([]string{output[index], spec.Caption, spec.Author, codePage, scene}, "\n")))
+	relativeDst = fmt.Sprintf("%s%d-%d-%s.png", posterPath, record.ID, index, hex.EncodeToString(sum[:4]))
+	span.SetAttributes(attribute.String("file.path", relativeDst))
+	if _, err := os.Stat(dataDir + relativeDst); err == nil {
+		return relativeDst, nil
+	}
+	if spec.Image, err = decodeImage(dataDir + output[index]); err != nil {
+		return "", err
+	}
+	if spec.Code, err = coder.Code(ctx, scene, codePage); err != nil {
+		log.Printf("failed to get the mini-program code of record %d, the error is %s", record.ID, err)
+		return "", err
+	}
+	img, err := composer.Compose(spec)
+	if err != nil {
+		return "", err
+	}
+	// 内容变化后旧的海报不再使用
+	removePosters(fmt.Sprintf("%d-%d-*.png", record.ID, index))
+	if err = writePNG(dataDir+relativeDst, img, aigcMetadata(filepath.Base(relativeDst))); err != nil {
+		return "", err
+	}
+	log.Printf("composed poster %s for user %s", relativeDst, openId)
+	return relativeDst, nil
+}
+
+func decodeImage(filePath string) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, apperror.New(apperror.CodeNotFound, err)
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+// removePosters 删除文件名匹配 pattern 的海报
+func removePosters(pattern string) {
+	matches, _ := filepath.Glob(dataDir + posterPath + pattern)
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to remove poster %s, the error is %s", m, err)
+		}
+	}
+}
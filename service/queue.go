@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// generationQueue 限制单个副本同时进行的 provider 调用数量，超出的请求按优先级排队，同优先级按先后
+type generationQueue struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiting []*queueTicket
+}
+
+type queueTicket struct {
+	priority   int
+	ready      chan struct{}
+	onPosition func(position int)
+}
+
+var queue = newGenerationQueue()
+
+func newGenerationQueue() *generationQueue {
+	limit := 8
+	if val := os.Getenv("GENERATION_CONCURRENCY"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			limit = n
+		} else {
+			log.Println("invalid env GENERATION_CONCURRENCY, use the default value", limit)
+		}
+	}
+	return &generationQueue{limit: limit}
+}
+
+// acquire 获取一个执行名额，需要排队时每当前方位置变化都会回调 onPosition（从 1 开始）
+func (q *generationQueue) acquire(ctx context.Context, priority int, onPosition func(position int)) error {
+	q.mu.Lock()
+	if q.running < q.limit && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return nil
+	}
+	ticket := &queueTicket{priority: priority, ready: make(chan struct{}), onPosition: onPosition}
+	// queue up behind every ticket with the same or a higher priority
+	index := len(q.waiting)
+	for index > 0 && q.waiting[index-1].priority < priority {
+		index--
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[index+1:], q.waiting[index:])
+	q.waiting[index] = ticket
+	behind := q.snapshot(index)
+	q.mu.Unlock()
+	notifyPositions(behind, index)
+	select {
+	case <-ticket.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		for i, t := range q.waiting {
+			if t == ticket {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				behind := q.snapshot(i)
+				q.mu.Unlock()
+				notifyPositions(behind, i)
+				return ctx.Err()
+			}
+		}
+		q.mu.Unlock()
+		// the slot was handed over right before the cancellation, give it back
+		q.release()
+		return ctx.Err()
+	}
+}
+
+// release 归还名额，直接移交给队首的请求
+func (q *generationQueue) release() {
+	q.mu.Lock()
+	if len(q.waiting) == 0 {
+		q.running--
+		q.mu.Unlock()
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	behind := q.snapshot(0)
+	q.mu.Unlock()
+	close(next.ready)
+	notifyPositions(behind, 0)
+}
+
+// snapshot 复制 from 之后的排队请求，以便在锁外回调
+func (q *generationQueue) snapshot(from int) []*queueTicket {
+	return append([]*queueTicket{}, q.waiting[from:]...)
+}
+
+func notifyPositions(tickets []*queueTicket, offset int) {
+	for i, t := range tickets {
+		t.onPosition(offset + i + 1)
+	}
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"idraw-server/db"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	prefixCredits string = "credits-"
+	periodLayout  string = "2006-01-02"
+)
+
+var ledgerMapper = db.NewLedgerMapper()
+
+// QuotaDrift 缓存与流水不一致的一项额度
+type QuotaDrift struct {
+	User   string
+	Key    string
+	Cached string
+	Ledger int
+}
+
+// currentPeriod 每日额度按自然日划分
+func currentPeriod() string {
+	return time.Now().Format(periodLayout)
+}
+
+// untilNextPeriod 缓存在下一个周期开始时失效，避免跨天读到旧的每日额度
+func untilNextPeriod() time.Duration {
+	now := time.Now()
+	next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	return next.Sub(now)
+}
+
+func defaultDailyLimits() int {
+	limits, _ := strconv.Atoi(os.Getenv("DAILY_LIMITS"))
+	return limits
+}
+
+func quotaCacheKeys(user string) []string {
+	return []string{prefixDailyLimits + user, prefixCurrentUsage + user, prefixCredits + user}
+}
+
+// fetchBalance 优先读取缓存，缓存缺失时由流水重建
+func fetchBalance(ctx context.Context, user string) (db.Balance, error) {
+	ctx, span := tracer.Start(ctx, "quota.fetchBalance")
+	defer span.End()
+	if vals, err := redisCli.MGet(ctx, quotaCacheKeys(user)...).Result(); err == nil {
+		if balance, ok := parseCachedBalance(vals); ok {
+			return balance, nil
+		}
+	} else {
+		log.Println("failed to read quota cache, fall back to the ledger, the error is", err)
+	}
+	balance, err := fetchLedgerBalance(ctx, user)
+	if err != nil {
+		return balance, err
+	}
+	ttl := untilNextPeriod()
+	pipe := redisCli.TxPipeline()
+	pipe.Set(ctx, prefixDailyLimits+user, balance.DailyGranted, ttl)
+	pipe.Set(ctx, prefixCurrentUsage+user, balance.DailyConsumed, ttl)
+	pipe.Set(ctx, prefixCredits+user, balance.Paid, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println("failed to rebuild quota cache, the error is", err)
+	}
+	return balance, nil
+}
+
+// fetchLedgerBalance 由流水计算当前周期的额度，首次访问时按会员等级发放当天的每日额度
+func fetchLedgerBalance(ctx context.Context, user string) (db.Balance, error) {
+	period := currentPeriod()
+	if err := ensureDailyGrant(ctx, user, period); err != nil {
+		return db.Balance{}, err
+	}
+	return ledgerMapper.FetchBalance(ctx, user, period)
+}
+
+func ensureDailyGrant(ctx context.Context, user string, period string) error {
+	_, spec, err := fetchTier(ctx, user)
+	if err != nil {
+		return err
+	}
+	return ledgerMapper.EnsureDailyGrant(ctx, user, period, spec.DailyLimits)
+}
+
+func parseCachedBalance(vals []any) (db.Balance, bool) {
+	nums := make([]int, len(vals))
+	for i, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			return db.Balance{}, false
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return db.Balance{}, false
+		}
+		nums[i] = n
+	}
+	return db.Balance{DailyGranted: nums[0], DailyConsumed: nums[1], Paid: nums[2]}, true
+}
+
+// invalidateQuotaCache 流水变更后删除缓存，下次读取时重建
+func invalidateQuotaCache(ctx context.Context, user string) {
+	if err := redisCli.Del(ctx, quotaCacheKeys(user)...).Err(); err != nil {
+		log.Printf("failed to invalidate quota cache of user %s, the error is %s", user, err)
+	}
+}
+
+func GetDailyLimits(ctx context.Context, user string) int {
+	ctx, span := tracer.Start(ctx, "quota.getDailyLimits")
+	defer span.End()
+	if user == "" {
+		return tiers[TierFree].DailyLimits
+	}
+	balance, err := fetchBalance(ctx, user)
+	if err != nil {
+		if !errors.Is(err, db.ErrRecordNotFound) {
+			log.Println("failed to get daily limits, return the default value, the error is", err)
+		}
+		return tiers[TierFree].DailyLimits
+	}
+	return balance.DailyGranted
+}
+
+// IncreaseDailyLimits 为用户追加当天的每日额度
+func IncreaseDailyLimits(ctx context.Context, user string, num int) error {
+	ctx, span := tracer.Start(ctx, "quota.increaseDailyLimits")
+	defer span.End()
+	period := currentPeriod()
+	if err := ensureDailyGrant(ctx, user, period); err != nil {
+		return err
+	}
+	err := ledgerMapper.Append(ctx, user, db.LedgerEntry{
+		Kind:    db.LedgerGrant,
+		Bucket:  db.BucketDaily,
+		Period:  period,
+		Amount:  num,
+		RefType: db.RefAdmin,
+	})
+	invalidateQuotaCache(ctx, user)
+	return err
+}
+
+func GetCurrentUsages(ctx context.Context, user string) int {
+	ctx, span := tracer.Start(ctx, "quota.getCurrentUsages")
+	defer span.End()
+	balance, err := fetchBalance(ctx, user)
+	if err != nil {
+		if !errors.Is(err, db.ErrRecordNotFound) {
+			log.Println("failed to get current usage, return 0, the error is", err)
+		}
+		return 0
+	}
+	return balance.DailyConsumed
+}
+
+// GetCreditBalance 用户已购买且未使用的次数
+func GetCreditBalance(ctx context.Context, openId string) (int, error) {
+	balance, err := fetchBalance(ctx, openId)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return balance.Paid, err
+}
+
+// reserveQuota 调用 provider 前在流水中预扣一次生成的额度，优先使用每日额度，余额不足时返回 errQuotaExceeded，
+// 返回的 reservationId 在保存记录时转为记录的扣减，生成失败时由 releaseQuota 退还
+func reserveQuota(ctx context.Context, user string) (string, error) {
+	ctx, span := tracer.Start(ctx, "quota.reserve")
+	defer span.End()
+	reservationId := newBatchId()
+	bucket, err := ledgerMapper.Consume(ctx, user, currentPeriod(), db.RefGeneration, reservationId)
+	invalidateQuotaCache(ctx, user)
+	if errors.Is(err, db.ErrRecordNotFound) {
+		return "", errQuotaExceeded
+	}
+	if err != nil {
+		log.Printf("reserve quota of user %s failed, the error is %s", user, err)
+		return "", err
+	}
+	if bucket == "" {
+		return "", errQuotaExceeded
+	}
+	log.Printf("user %s reserved a generation from the %s quota, reservation %s", user, bucket, reservationId)
+	return reservationId, nil
+}
+
+// releaseQuota 生成失败时退还预扣的额度，重复调用只会退还一次
+func releaseQuota(ctx context.Context, user string, reservationId string) {
+	ctx, span := tracer.Start(ctx, "quota.release")
+	defer span.End()
+	_, err := ledgerMapper.Refund(ctx, user, db.RefGeneration, reservationId)
+	invalidateQuotaCache(ctx, user)
+	if err != nil {
+		log.Printf("release reservation %s of user %s failed, the error is %s", reservationId, user, err)
+	}
+}
+
+// expireDailyQuota 记录前一天未用完的每日额度过期
+func expireDailyQuota(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "quota.expire")
+	defer span.End()
+	period := time.Now().AddDate(0, 0, -1).Format(periodLayout)
+	count, err := ledgerMapper.ExpireDailyPeriod(ctx, period)
+	if err != nil {
+		log.Printf("failed to expire daily quota of %s, the error is %s", period, err)
+		return
+	}
+	log.Printf("expired daily quota of %s for %d users", period, count)
+}
+
+// ReconcileQuotaCache 对比所有用户的缓存与流水，fix 为 true 时删除不一致的缓存
+func ReconcileQuotaCache(ctx context.Context, fix bool) ([]QuotaDrift, error) {
+	ctx, span := tracer.Start(ctx, "quota.reconcile")
+	defer span.End()
+	users, err := userMapper.FetchAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	period := currentPeriod()
+	drifts := []QuotaDrift{}
+	for _, user := range users {
+		keys := quotaCacheKeys(user.OpenId)
+		vals, err := redisCli.MGet(ctx, keys...).Result()
+		if err != nil {
+			return drifts, err
+		}
+		balance, err := ledgerMapper.FetchBalance(ctx, user.OpenId, period)
+		if err != nil {
+			return drifts, err
+		}
+		cached := make([]*string, len(vals))
+		for i, v := range vals {
+			if s, ok := v.(string); ok {
+				cached[i] = &s
+			}
+		}
+		drifted := balance.Drifted(cached)
+		for _, i := range drifted {
+			drifts = append(drifts, QuotaDrift{User: user.OpenId, Key: keys[i], Cached: *cached[i], Ledger: balance.Fields()[i]})
+		}
+		if len(drifted) > 0 && fix {
+			invalidateQuotaCache(ctx, user.OpenId)
+		}
+	}
+	return drifts, nil
+}
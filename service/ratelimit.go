@@ -0,0 +1,27 @@
+package service
+
+import (
+	"context"
+	"idraw-server/ratelimit"
+	"time"
+)
+
+const prefixRateLimit string = "ratelimit-"
+
+// GenerationRoute 图片生成的路由，公众号发起的生成与小程序共用该路由的用户维度计数
+const GenerationRoute string = "POST /api/images/generations"
+
+// 图片生成在用户维度的限流
+const (
+	GenerationUserLimit  = 5
+	GenerationUserWindow = time.Minute
+)
+
+type RateLimitResult = ratelimit.Result
+
+// AllowRequest 基于 redis 的滑动窗口限流，多副本共享同一份计数
+func AllowRequest(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	ctx, span := tracer.Start(ctx, "ratelimit.allow")
+	defer span.End()
+	return ratelimit.New(redisCli, prefixRateLimit).Allow(ctx, key, limit, window)
+}
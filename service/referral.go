@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"idraw-server/api/response"
+	"idraw-server/db"
+	"log"
+	"os"
+	"strconv"
+)
+
+var (
+	referralMapper db.ReferralMapper
+	referralReward db.ReferralReward
+)
+
+func init() {
+	referralMapper = db.NewReferralMapper()
+	referralReward = db.ReferralReward{
+		Inviter:    intEnv("REFERRAL_INVITER_REWARD", 5),
+		Invitee:    intEnv("REFERRAL_INVITEE_REWARD", 3),
+		MaxRewards: intEnv("REFERRAL_MAX_REWARDS", 20),
+	}
+}
+
+// intEnv 读取整数类型的 env，未设置时使用默认值
+func intEnv(key string, defaultVal int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		log.Fatalln("invalid env " + key)
+	}
+	return n
+}
+
+// rewardReferral 被邀请人完成生成后尝试为邀请双方发放奖励，只有首次会实际发放
+func rewardReferral(ctx context.Context, user string) {
+	ctx, span := tracer.Start(ctx, "referral.reward")
+	defer span.End()
+	referral, err := referralMapper.Reward(ctx, user, referralReward)
+	if err != nil {
+		log.Printf("reward referral of user %s failed, the error is %s", user, err)
+		return
+	}
+	if referral == nil {
+		return
+	}
+	log.Printf("referral %d of invitee %s settled as %s", referral.ID, user, referral.Status)
+	invalidateQuotaCache(ctx, user)
+	if inviter, err := userMapper.FetchById(ctx, referral.InviterUid); err == nil {
+		invalidateQuotaCache(ctx, inviter.OpenId)
+	}
+}
+
+// FetchReferrals 用户的邀请码及其邀请的用户
+func FetchReferrals(ctx context.Context, openId string) (*response.ReferralsDto, error) {
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if err != nil {
+		return nil, err
+	}
+	views, err := referralMapper.FetchByInviter(ctx, openId)
+	if err != nil {
+		return nil, err
+	}
+	result := &response.ReferralsDto{Referrals: make([]response.ReferralDto, len(views))}
+	if user.InviteCode != nil {
+		result.InviteCode = *user.InviteCode
+	}
+	for i, v := range views {
+		dto := response.ReferralDto{
+			Invitee:   maskOpenId(v.InviteeOpenId),
+			NickName:  v.InviteeNickName,
+			Status:    v.Status,
+			CreatedAt: v.CreatedTime.UnixMilli(),
+		}
+		if v.Status != db.ReferralPending {
+			dto.RewardedAt = v.RewardedTime.UnixMilli()
+		}
+		if v.Status == db.ReferralRewarded {
+			result.Rewarded++
+		}
+		result.Referrals[i] = dto
+	}
+	return result, nil
+}
+
+func maskOpenId(openId string) string {
+	if len(openId) <= 8 {
+		return "****"
+	}
+	return openId[:4] + "****" + openId[len(openId)-4:]
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"log"
+	"strings"
+)
+
+// stylePlaceholder 模板中用户描述的占位符
+const stylePlaceholder = "{prompt}"
+
+var defaultStyles = []db.Style{
+	{Name: "anime", Title: "动漫", Sort: 10, Enabled: true, DefaultSize: "512x512",
+		PromptTemplate: "anime style illustration of {prompt}, vibrant colors, clean line art, detailed background",
+		NegativePrompt: "photorealistic, blurry, extra limbs"},
+	{Name: "watercolor", Title: "水彩", Sort: 20, Enabled: true, DefaultSize: "512x512",
+		PromptTemplate: "watercolor painting of {prompt}, soft washes, paper texture, gentle light",
+		NegativePrompt: "hard edges, digital artifacts"},
+	{Name: "cyberpunk", Title: "赛博朋克", Sort: 30, Enabled: true, DefaultSize: "1024x1024",
+		PromptTemplate: "cyberpunk scene of {prompt}, neon lights, rainy night, futuristic city, cinematic lighting",
+		NegativePrompt: "daylight, pastoral"},
+	{Name: "ink", Title: "水墨", Sort: 40, Enabled: true, DefaultSize: "512x512",
+		PromptTemplate: "traditional Chinese ink wash painting of {prompt}, minimal brush strokes, rice paper, generous negative space",
+		NegativePrompt: "vivid colors, photorealistic"},
+}
+
+var (
+	styleMapper db.StyleMapper
+
+	errUnknownStyle = apperror.New(apperror.CodeInvalidParams, errors.New("unknown or disabled style"))
+)
+
+func init() {
+	styleMapper = db.NewStyleMapper()
+	if err := styleMapper.SeedIfEmpty(context.Background(), defaultStyles); err != nil {
+		log.Println("failed to seed the default styles, the error is", err)
+	}
+}
+
+// expandPrompt 将用户的描述套入风格模板，负面描述以文字形式追加
+func expandPrompt(style db.Style, prompt string) string {
+	expanded := strings.ReplaceAll(style.PromptTemplate, stylePlaceholder, prompt)
+	if style.NegativePrompt != "" {
+		expanded += ". Avoid: " + style.NegativePrompt
+	}
+	return expanded
+}
+
+// fetchStyle 查询可用于生成的风格
+func fetchStyle(ctx context.Context, id uint) (db.Style, error) {
+	style, err := styleMapper.FetchById(ctx, id)
+	if errors.Is(err, db.ErrRecordNotFound) || (err == nil && !style.Enabled) {
+		return style, errUnknownStyle
+	}
+	return style, err
+}
+
+// FetchStyles 已启用的风格列表
+func FetchStyles(ctx context.Context) ([]response.StyleDto, error) {
+	styles, err := styleMapper.FetchAll(ctx, true)
+	if err != nil {
+		return []response.StyleDto{}, err
+	}
+	result := make([]response.StyleDto, len(styles))
+	for i, s := range styles {
+		result[i] = response.StyleDto{Id: s.ID, Name: s.Name, Title: s.Title, DefaultSize: s.DefaultSize}
+	}
+	return result, nil
+}
+
+// AllStyles 包括已停用在内的所有风格，用于运维管理
+func AllStyles(ctx context.Context) ([]db.Style, error) {
+	return styleMapper.FetchAll(ctx, false)
+}
+
+// SaveStyle 按 Name 新增或更新风格
+func SaveStyle(ctx context.Context, style db.Style) (db.Style, error) {
+	if style.Name == "" || style.Title == "" {
+		return style, errors.New("name and title are required")
+	}
+	if !strings.Contains(style.PromptTemplate, stylePlaceholder) {
+		return style, fmt.Errorf("prompt template must contain %s", stylePlaceholder)
+	}
+	if !validSizes[style.DefaultSize] {
+		return style, fmt.Errorf("invalid default size %s", style.DefaultSize)
+	}
+	return styleMapper.Save(ctx, style)
+}
+
+func SetStyleEnabled(ctx context.Context, name string, enabled bool) error {
+	found, err := styleMapper.SetEnabled(ctx, name, enabled)
+	if err == nil && !found {
+		return errors.New("style " + name + " not found")
+	}
+	return err
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/db"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// notificationLease 发送中的消息在该时长内不会被重试
+	notificationLease       = time.Minute
+	notificationMaxAttempts = 5
+	notificationRetryBase   = time.Minute
+	notificationBatchSize   = 100
+	// maxThingLength 订阅消息 thing 类型的字段最长 20 个字符
+	maxThingLength = 20
+)
+
+// 订阅消息模板「生成结果通知」的字段，需与公众平台中选用的模板一致
+const (
+	fieldPrompt = "thing1"  // 作品描述
+	fieldStatus = "phrase2" // 生成状态
+	fieldTime   = "time3"   // 完成时间
+	fieldRemark = "thing4"  // 备注
+)
+
+var (
+	subscriptionMapper = db.NewSubscriptionMapper()
+	// subscribeTemplateId 生成结果通知的模板 id，为空时不发送订阅消息
+	subscribeTemplateId = os.Getenv("SUBSCRIBE_TEMPLATE_ID")
+	// subscribePage 点击消息打开的页面，该页面需读取 recordId 或 batchId 参数
+	subscribePage = os.Getenv("SUBSCRIBE_PAGE")
+	// miniProgramState 点击消息打开的小程序版本：developer、trial 或 formal
+	miniProgramState = os.Getenv("SUBSCRIBE_MINIPROGRAM_STATE")
+	notifier         messageSender
+)
+
+// messageSender 发送订阅消息
+type messageSender interface {
+	Send(ctx context.Context, msg subscribeMessage) error
+}
+
+type subscribeMessage struct {
+	ToUser           string                  `json:"touser"`
+	TemplateId       string                  `json:"template_id"`
+	Page             string                  `json:"page"`
+	MiniProgramState string                  `json:"miniprogram_state"`
+	Lang             string                  `json:"lang"`
+	Data             map[string]messageValue `json:"data"`
+}
+
+type messageValue struct {
+	Value string `json:"value"`
+}
+
+func init() {
+	if subscribePage == "" {
+		subscribePage = "pages/index/index"
+	}
+	if miniProgramState == "" {
+		miniProgramState = "formal"
+	}
+	notifier = newMessageSender()
+}
+
+// newMessageSender 由 SUBSCRIBE_CLIENT 选择实现：默认调用微信接口，stub 只打印日志
+func newMessageSender() messageSender {
+	if subscribeTemplateId == "" {
+		log.Println("lack env SUBSCRIBE_TEMPLATE_ID, subscribe message is disabled")
+		return nil
+	}
+	switch val := os.Getenv("SUBSCRIBE_CLIENT"); val {
+	case "", "wechat":
+		return weChatMessageSender{}
+	case "stub":
+		return stubMessageSender{}
+	default:
+		log.Fatalln("invalid env SUBSCRIBE_CLIENT " + val)
+		return nil
+	}
+}
+
+type weChatMessageSender struct {
+}
+
+type subscribeMessageResp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (weChatMessageSender) Send(ctx context.Context, msg subscribeMessage) error {
+	body, _ := json.Marshal(msg)
+	return withAccessToken(ctx, func(token string) error {
+		reqUrl := weChatApiUrl + "/cgi-bin/message/subscribe/send?access_token=" + url.QueryEscape(token)
+		r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "POST", reqUrl, bytes.NewReader(body))
+		})
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if r.StatusCode != 200 {
+			return classifyStatus(upstreamWeChat, r.StatusCode, nil)
+		}
+		result := subscribeMessageResp{}
+		if err = json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return err
+		}
+		if result.ErrCode != 0 {
+			log.Printf("send subscribe message failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+			return weChatError(result.ErrCode, result.ErrMsg)
+		}
+		return nil
+	})
+}
+
+// stubMessageSender 只打印消息内容，用于本地开发
+type stubMessageSender struct {
+}
+
+func (stubMessageSender) Send(ctx context.Context, msg subscribeMessage) error {
+	log.Printf("stub subscribe message to %s, page: %s, data: %v", msg.ToUser, msg.Page, msg.Data)
+	return nil
+}
+
+// acceptSubscriptions 记录用户提交时接受的订阅，只记录生成结果通知的模板
+func acceptSubscriptions(ctx context.Context, openId string, templateIds []string) {
+	if notifier == nil {
+		return
+	}
+	for _, templateId := range templateIds {
+		if templateId != subscribeTemplateId {
+			continue
+		}
+		if err := subscriptionMapper.Accept(ctx, openId, templateId); err != nil {
+			log.Printf("failed to accept the subscription of user %s, the error is %s", openId, err)
+		}
+		return
+	}
+}
+
+// generationOutcome 一次生成的结果，用于组装订阅消息
+type generationOutcome struct {
+	input    string // prompt text, or the dynamic prompt of a batch
+	recordId uint   // 0 for a failed generation or a batch
+	batchId  string // empty if not a batch
+	images   int
+	err      error
+}
+
+// notifyGeneration 用户有剩余的订阅时发送生成结果通知，发送失败时由定时任务重试
+func notifyGeneration(ctx context.Context, openId string, outcome generationOutcome) {
+	if notifier == nil {
+		return
+	}
+	ctx, span := tracer.Start(ctx, "subscribe.notifyGeneration")
+	defer span.End()
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if err != nil {
+		log.Printf("failed to fetch user %s to notify, the error is %s", openId, err)
+		return
+	}
+	payload, _ := json.Marshal(generationMessage(openId, outcome))
+	notification, consumed, err := subscriptionMapper.Consume(ctx, user.ID, subscribeTemplateId, string(payload), notificationLease)
+	if err != nil {
+		log.Printf("failed to consume the subscription of user %s, the error is %s", openId, err)
+		return
+	}
+	if !consumed {
+		return
+	}
+	sendNotification(ctx, notification)
+}
+
+// generationMessage 组装生成结果通知，点击消息打开对应的记录
+func generationMessage(openId string, outcome generationOutcome) subscribeMessage {
+	params := url.Values{}
+	status, remark := "已完成", fmt.Sprintf("共 %d 张图片，点击查看", outcome.images)
+	switch {
+	case outcome.err != nil:
+		status, remark = "生成失败", "未扣除次数，可点击重新生成"
+	case outcome.batchId != "":
+		params.Set("batchId", outcome.batchId)
+	case outcome.recordId != 0:
+		params.Set("recordId", strconv.FormatUint(uint64(outcome.recordId), 10))
+	}
+	page := subscribePage
+	if len(params) != 0 {
+		page += "?" + params.Encode()
+	}
+	input := outcome.input
+	if input == "" {
+		input = "图片变体"
+	}
+	return subscribeMessage{
+		ToUser:           openId,
+		TemplateId:       subscribeTemplateId,
+		Page:             page,
+		MiniProgramState: miniProgramState,
+		Lang:             "zh_CN",
+		Data: map[string]messageValue{
+			fieldPrompt: {Value: truncateRunes(input, maxThingLength)},
+			fieldStatus: {Value: status},
+			fieldTime:   {Value: time.Now().Format("2006-01-02 15:04")},
+			fieldRemark: {Value: remark},
+		},
+	}
+}
+
+// truncateRunes 超出长度时截断并以省略号结尾
+func truncateRunes(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// sendNotification 发送一条待发送的消息并记录结果
+func sendNotification(ctx context.Context, notification db.Notification) {
+	msg := subscribeMessage{}
+	if err := json.Unmarshal([]byte(notification.Payload), &msg); err != nil {
+		log.Printf("invalid payload of notification %d, the error is %s", notification.ID, err)
+		subscriptionMapper.Fail(ctx, notification.ID, err.Error(), true)
+		return
+	}
+	err := notifier.Send(ctx, msg)
+	switch {
+	case err == nil:
+		err = subscriptionMapper.Sent(ctx, notification.ID)
+	case notification.Attempts+1 < notificationMaxAttempts && isTransientSendError(err):
+		backoff := notificationRetryBase << notification.Attempts
+		log.Printf("send notification %d failed, retry in %s, the error is %s", notification.ID, backoff, err)
+		err = subscriptionMapper.Retry(ctx, notification.ID, err.Error(), time.Now().Add(backoff))
+	default:
+		log.Printf("send notification %d failed, give up, the error is %s", notification.ID, err)
+		// 43101 用户拒绝接收或订阅已用完，此时微信侧已没有可用的订阅；其余错误微信不会消耗订阅
+		err = subscriptionMapper.Fail(ctx, notification.ID, err.Error(), weChatErrCode(err) != 43101)
+	}
+	if err != nil {
+		log.Printf("failed to save the result of notification %d, the error is %s", notification.ID, err)
+	}
+}
+
+// isTransientSendError 网络错误、上游不可用及微信系统繁忙可以重试，其余接口错误重试也不会成功
+func isTransientSendError(err error) bool {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.Kind != ErrKindRejected
+	}
+	switch weChatErrCode(err) {
+	case 0, -1, 45009:
+		// not an api error, system busy, or the daily api limit reached
+		return true
+	default:
+		return false
+	}
+}
+
+// weChatErrCode 微信接口返回的 errcode，不是接口错误时返回 0
+func weChatErrCode(err error) int {
+	apiErr := &weChatApiError{}
+	if !errors.As(err, &apiErr) {
+		return 0
+	}
+	return apiErr.ErrCode
+}
+
+// resendNotifications 重试到期的消息，先抢占再发送，多个副本不会重复发送
+func resendNotifications(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "subscribe.resend")
+	defer span.End()
+	notifications, err := subscriptionMapper.FetchDue(ctx, time.Now(), notificationBatchSize)
+	if err != nil {
+		log.Println("failed to fetch the due notifications, the error is", err)
+		return
+	}
+	for _, notification := range notifications {
+		claimed, err := subscriptionMapper.Claim(ctx, notification, notificationLease)
+		if err != nil {
+			log.Printf("failed to claim notification %d, the error is %s", notification.ID, err)
+			continue
+		}
+		if claimed {
+			sendNotification(ctx, notification)
+		}
+	}
+}
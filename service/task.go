@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/telemetry"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TaskEnhancing       string = "ENHANCING"
+	TaskQueued          string = "QUEUED"
+	TaskCallingProvider string = "CALLING_PROVIDER"
+	TaskDownloading     string = "DOWNLOADING"
+	TaskStored          string = "STORED"
+	TaskFailed          string = "FAILED"
+	prefixTaskEvent     string = "task-event-"
+	prefixTaskChannel   string = "task-events-"
+	// taskEventTTL 最近一次事件的保留时间，晚于该时间订阅的客户端将拿不到任何状态
+	taskEventTTL = time.Hour
+)
+
+// taskProgress 记录单个生成任务的进度，并将状态变化发布给所有副本
+type taskProgress struct {
+	id     string
+	total  int
+	stored atomic.Int32
+	prompt string // enhanced prompt, returned along with the output
+}
+
+// newTaskProgress 客户端未指定任务 id 时生成一个随机 id
+func newTaskProgress(id string) *taskProgress {
+	if id == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	return &taskProgress{id: id}
+}
+
+func (t *taskProgress) enhancing(ctx context.Context) {
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskEnhancing})
+}
+
+func (t *taskProgress) queued(ctx context.Context, position int) {
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskQueued, Position: position})
+}
+
+func (t *taskProgress) callingProvider(ctx context.Context) {
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskCallingProvider})
+}
+
+func (t *taskProgress) downloading(ctx context.Context, total int) {
+	t.total = total
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskDownloading, Total: total})
+}
+
+// imageStored 每保存完一张图片调用一次，可能被并发调用
+func (t *taskProgress) imageStored(ctx context.Context) {
+	current := int(t.stored.Add(1))
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskDownloading, Current: current, Total: t.total})
+}
+
+func (t *taskProgress) done(ctx context.Context, output []string) {
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskStored, Output: output, Prompt: t.prompt})
+}
+
+func (t *taskProgress) failed(ctx context.Context, err error) {
+	publishTaskEvent(ctx, response.TaskEventDto{TaskId: t.id, State: TaskFailed, ErrCode: apperror.From(err, 0).Code})
+}
+
+// publishTaskEvent 保存最新状态并通过 redis pub/sub 广播，任何副本都可以提供事件流
+func publishTaskEvent(ctx context.Context, event response.TaskEventDto) {
+	// the request may already be canceled, but the subscribers still deserve the final state
+	ctx = telemetry.Detach(ctx)
+	event.Time = time.Now().UnixMilli()
+	payload, _ := json.Marshal(event)
+	pipe := redisCli.Pipeline()
+	pipe.Set(ctx, prefixTaskEvent+event.TaskId, payload, taskEventTTL)
+	pipe.Publish(ctx, prefixTaskChannel+event.TaskId, payload)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("publish task %s event %s failed, the error is %s", event.TaskId, event.State, err)
+	}
+}
+
+// IsTerminalTaskState 任务是否已结束，结束后事件流将关闭
+func IsTerminalTaskState(state string) bool {
+	return state == TaskStored || state == TaskFailed
+}
+
+// SubscribeTaskEvents 订阅任务的状态变化，先推送当前最新状态，channel 在任务结束或 ctx 取消时关闭
+func SubscribeTaskEvents(ctx context.Context, taskId string) (<-chan response.TaskEventDto, error) {
+	// subscribe before reading the snapshot so that nothing falls in between
+	sub := redisCli.Subscribe(ctx, prefixTaskChannel+taskId)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	var last *response.TaskEventDto
+	val, err := redisCli.Get(ctx, prefixTaskEvent+taskId).Bytes()
+	switch {
+	case err == nil:
+		last = &response.TaskEventDto{}
+		json.Unmarshal(val, last)
+	case !errors.Is(err, redis.Nil):
+		sub.Close()
+		return nil, err
+	}
+	events := make(chan response.TaskEventDto)
+	go func() {
+		defer close(events)
+		defer sub.Close()
+		if last != nil {
+			select {
+			case events <- *last:
+			case <-ctx.Done():
+				return
+			}
+			if IsTerminalTaskState(last.State) {
+				return
+			}
+		}
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				event := response.TaskEventDto{}
+				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+					continue
+				}
+				// the snapshot may be newer than a message that was already in flight
+				if last != nil && event.Time < last.Time {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+				if IsTerminalTaskState(event.State) {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
+	"idraw-server/db"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	TierFree   string = "free"
+	TierMember string = "member"
+	TierPro    string = "pro"
+)
+
+// tierSpec 会员等级的额度与能力
+type tierSpec struct {
+	DailyLimits   int      `json:"dailyLimits"`
+	MaxN          int      `json:"maxN"`
+	Sizes         []string `json:"sizes"`
+	Models        []string `json:"models"`        // the provider default model (empty) is always allowed
+	Priority      int      `json:"priority"`      // higher priority is served first when queuing
+	RetentionDays int      `json:"retentionDays"` // 0 means kept forever, set it explicitly to purge old records
+	Watermark     bool     `json:"watermark"`     // whether to add the visible watermark
+	KeepOriginal  bool     `json:"keepOriginal"`  // whether to keep an unwatermarked original
+}
+
+var tiers map[string]tierSpec
+
+func init() {
+	tiers = loadTiers()
+}
+
+// loadTiers 可通过 MEMBERSHIP_TIERS 以 json 对象覆盖默认的等级配置，free 的每日额度默认取 DAILY_LIMITS，
+// 默认永久保存生成记录，需要清理时显式设置 retentionDays
+func loadTiers() map[string]tierSpec {
+	result := map[string]tierSpec{
+		TierFree: {
+			DailyLimits: defaultDailyLimits(),
+			MaxN:        2,
+			Sizes:       []string{"256x256", "512x512"},
+			Models:      []string{"dall-e-2"},
+			Watermark:   true,
+		},
+		TierMember: {
+			DailyLimits:  50,
+			MaxN:         4,
+			Sizes:        []string{"256x256", "512x512", "1024x1024"},
+			Models:       []string{"dall-e-2", "dall-e-3"},
+			Priority:     1,
+			Watermark:    true,
+			KeepOriginal: true,
+		},
+		TierPro: {
+			DailyLimits:  200,
+			MaxN:         10,
+			Sizes:        []string{"256x256", "512x512", "1024x1024"},
+			Models:       []string{"dall-e-2", "dall-e-3"},
+			Priority:     2,
+			Watermark:    true,
+			KeepOriginal: true,
+		},
+	}
+	if val := os.Getenv("MEMBERSHIP_TIERS"); val != "" {
+		overrides := map[string]tierSpec{}
+		if err := json.Unmarshal([]byte(val), &overrides); err != nil {
+			log.Fatalln("invalid env MEMBERSHIP_TIERS, the error is", err)
+		}
+		for name, spec := range overrides {
+			result[name] = spec
+		}
+	}
+	return result
+}
+
+// effectiveTier 用户当前生效的会员等级，未开通、已过期或等级已下线时均视为 free
+func effectiveTier(user db.User) string {
+	if user.Tier == "" || !user.TierExpiredTime.After(time.Now()) {
+		return TierFree
+	}
+	if _, ok := tiers[user.Tier]; !ok {
+		return TierFree
+	}
+	return user.Tier
+}
+
+// fetchTier 查询用户当前生效的会员等级，用户不存在时视为 free
+func fetchTier(ctx context.Context, openId string) (string, tierSpec, error) {
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return TierFree, tiers[TierFree], err
+	}
+	tier := effectiveTier(user)
+	return tier, tiers[tier], nil
+}
+
+// check 校验一次生成请求是否在等级允许的范围内
+func (spec tierSpec) check(n int, size string, model string) error {
+	if n > spec.MaxN {
+		return apperror.New(apperror.CodeNotEntitled, fmt.Errorf("n %d exceeds the tier limit %d", n, spec.MaxN))
+	}
+	if !contains(spec.Sizes, size) {
+		return apperror.New(apperror.CodeNotEntitled, fmt.Errorf("size %s is not allowed in the tier", size))
+	}
+	if model != "" && !contains(spec.Models, model) {
+		return apperror.New(apperror.CodeNotEntitled, fmt.Errorf("model %s is not allowed in the tier", model))
+	}
+	return nil
+}
+
+// fitSize 等级允许 preferred 时使用它，否则使用等级允许的最大尺寸，例如风格默认的尺寸超出了免费等级的范围
+func (spec tierSpec) fitSize(preferred string) string {
+	if len(spec.Sizes) == 0 || contains(spec.Sizes, preferred) {
+		return preferred
+	}
+	largest, largestArea := spec.Sizes[0], 0
+	for _, size := range spec.Sizes {
+		var width, height int
+		if _, err := fmt.Sscanf(size, "%dx%d", &width, &height); err == nil && width*height > largestArea {
+			largest, largestArea = size, width*height
+		}
+	}
+	return largest
+}
+
+func contains(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+// GetEntitlements 用户当前会员等级下的额度与能力
+func GetEntitlements(ctx context.Context, openId string) (*response.EntitlementsDto, error) {
+	user, err := userMapper.FetchByOpenId(ctx, openId)
+	if err != nil && !errors.Is(err, db.ErrRecordNotFound) {
+		return nil, err
+	}
+	tier := effectiveTier(user)
+	spec := tiers[tier]
+	dto := &response.EntitlementsDto{
+		Tier:          tier,
+		DailyLimits:   spec.DailyLimits,
+		MaxN:          spec.MaxN,
+		Sizes:         spec.Sizes,
+		Models:        spec.Models,
+		Priority:      spec.Priority,
+		RetentionDays: spec.RetentionDays,
+		Watermark:     spec.Watermark,
+		KeepOriginal:  spec.KeepOriginal,
+	}
+	if tier != TierFree {
+		dto.ExpiresAt = user.TierExpiredTime.UnixMilli()
+	}
+	return dto, nil
+}
+
+// membershipGrant 计算为用户开通或续期会员的结果。同等级续期时在原到期时间上顺延，其余情况从当前时间开始计算，
+// 当天的每日额度按新旧等级的差额补发
+func membershipGrant(user db.User, tier string, days int) (*db.MembershipGrant, error) {
+	spec, ok := tiers[tier]
+	if !ok {
+		return nil, fmt.Errorf("unknown tier %s", tier)
+	}
+	current := effectiveTier(user)
+	start := time.Now()
+	if current == tier {
+		start = user.TierExpiredTime
+	}
+	return &db.MembershipGrant{
+		FromTier:        user.Tier,
+		FromExpiredTime: user.TierExpiredTime,
+		Tier:            tier,
+		ExpiredTime:     start.AddDate(0, 0, days),
+		Period:          currentPeriod(),
+		DailyLimits:     tiers[current].DailyLimits,
+		Bonus:           spec.DailyLimits - tiers[current].DailyLimits,
+	}, nil
+}
+
+// retentionDays 记录的保存天数，取生成时的等级与当前等级中更长的一个，0 表示永久保存，
+// 因此会员到期后不会清理付费期间生成的记录
+func retentionDays(recordTier string, currentTier string) int {
+	if recordTier == "" {
+		// generated before the tier was recorded, keep it
+		return 0
+	}
+	recorded, current := tiers[recordTier].RetentionDays, tiers[currentTier].RetentionDays
+	if recorded <= 0 || current <= 0 {
+		return 0
+	}
+	if recorded > current {
+		return recorded
+	}
+	return current
+}
+
+// minRetentionDays 所有等级中最短的保存天数，所有等级均永久保存时返回 0
+func minRetentionDays() int {
+	days := 0
+	for _, spec := range tiers {
+		if spec.RetentionDays > 0 && (days == 0 || spec.RetentionDays < days) {
+			days = spec.RetentionDays
+		}
+	}
+	return days
+}
+
+// purgeExpiredImages 删除超出会员等级保存期限的生成记录及图片
+func purgeExpiredImages(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "storage.purge")
+	defer span.End()
+	minDays := minRetentionDays()
+	if minDays == 0 {
+		return
+	}
+	users, err := userMapper.FetchAll(ctx)
+	if err != nil {
+		log.Println("failed to fetch users for purging, the error is", err)
+		return
+	}
+	purged := 0
+	now := time.Now()
+	for _, user := range users {
+		current := effectiveTier(user)
+		records, err := recordMapper.FetchCreatedBefore(ctx, user.ID, now.AddDate(0, 0, -minDays))
+		if err != nil {
+			log.Printf("failed to fetch expired records of user %s, the error is %s", user.OpenId, err)
+			continue
+		}
+		ids := make([]uint, 0, len(records))
+		for _, record := range records {
+			days := retentionDays(record.Tier, current)
+			if days <= 0 || record.CreatedTime.After(now.AddDate(0, 0, -days)) {
+				continue
+			}
+			paths := []string{}
+			originals := []string{}
+			json.Unmarshal([]byte(record.Output), &paths)
+			json.Unmarshal([]byte(record.Original), &originals)
+			for _, p := range append(paths, originals...) {
+				if err := os.Remove(dataDir + p); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Printf("failed to remove expired image %s, the error is %s", p, err)
+				}
+			}
+			if err := imageMapper.DeleteByPaths(ctx, paths); err != nil {
+				log.Printf("failed to delete the image index of record %d, the error is %s", record.ID, err)
+			}
+			removePosters(fmt.Sprintf("%d-*.png", record.ID))
+			ids = append(ids, record.ID)
+		}
+		if err := recordMapper.DeleteByIds(ctx, ids); err != nil {
+			log.Printf("failed to delete expired records of user %s, the error is %s", user.OpenId, err)
+			continue
+		}
+		purged += len(ids)
+	}
+	log.Printf("purged %d expired records", purged)
+}
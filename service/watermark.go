@@ -0,0 +1,134 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"idraw-server/telemetry"
+	"idraw-server/watermark"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// originalPath 保留的无水印原图，仅对 keepOriginal 的会员等级保存
+const originalPath string = "/idraw-original-dir/"
+
+var (
+	// marker 为空时不添加可见水印，但仍写入 AI 生成标识
+	marker *watermark.Marker
+	// aigcProducer 元数据中的内容制作者
+	aigcProducer = os.Getenv("AIGC_PRODUCER")
+)
+
+func init() {
+	marker = newMarker()
+	if aigcProducer == "" {
+		aigcProducer = "idraw"
+	}
+}
+
+// newMarker 由 WATERMARK_* 配置可见水印，WATERMARK_TEXT 设为 none 且未配置 logo 时关闭
+func newMarker() *watermark.Marker {
+	cfg := watermark.Config{
+		Text:     os.Getenv("WATERMARK_TEXT"),
+		Position: os.Getenv("WATERMARK_POSITION"),
+		Opacity:  0.6,
+	}
+	switch cfg.Text {
+	case "":
+		cfg.Text = "AI 生成"
+	case "none":
+		cfg.Text = ""
+	}
+	if cfg.Position == "" {
+		cfg.Position = watermark.BottomRight
+	}
+	if val := os.Getenv("WATERMARK_OPACITY"); val != "" {
+		opacity, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			log.Fatalln("invalid env WATERMARK_OPACITY " + val)
+		}
+		cfg.Opacity = opacity
+	}
+	if val := os.Getenv("WATERMARK_LOGO_PATH"); val != "" {
+		logo, err := decodeImage(val)
+		if err != nil {
+			log.Fatalln("invalid env WATERMARK_LOGO_PATH, the error is", err)
+		}
+		cfg.Logo = logo
+	}
+	if cfg.Text == "" && cfg.Logo == nil {
+		log.Println("visible watermark is disabled")
+		return nil
+	}
+	m, err := watermark.New(cfg, posterFont)
+	if err != nil {
+		log.Fatalln("invalid env WATERMARK_*, the error is", err)
+	}
+	return m
+}
+
+// aigcMetadata 隐式标识，写入 PNG 的 tEXt 块
+func aigcMetadata(fileName string) map[string]string {
+	label, _ := json.Marshal(map[string]string{
+		"Label":           "1",
+		"ContentProducer": aigcProducer,
+		"ProduceID":       fileName,
+	})
+	return map[string]string{
+		"AIGC":       string(label),
+		"Disclaimer": "AI-generated content",
+		"Software":   "idraw-server",
+	}
+}
+
+// markImage 为已保存的图片写入 AI 生成标识，按等级添加可见水印并保留原图，返回原图路径，未保留时为空
+func markImage(ctx context.Context, relativePath string, spec tierSpec) (original string, err error) {
+	_, span := tracer.Start(ctx, "storage.watermark")
+	defer func() { telemetry.End(span, err) }()
+	span.SetAttributes(attribute.String("file.path", relativePath), attribute.Bool("watermark.visible", spec.Watermark && marker != nil))
+	img, err := decodeImage(dataDir + relativePath)
+	if err != nil {
+		return "", err
+	}
+	fileName := filepath.Base(relativePath)
+	metadata := aigcMetadata(fileName)
+	if spec.KeepOriginal {
+		original = originalPath + fileName
+		if err = writePNG(dataDir+original, img, metadata); err != nil {
+			return "", err
+		}
+	}
+	if spec.Watermark && marker != nil {
+		if img, err = marker.Apply(img); err != nil {
+			removeOriginal(original)
+			return "", err
+		}
+	}
+	if err = writePNG(dataDir+relativePath, img, metadata); err != nil {
+		removeOriginal(original)
+		return "", err
+	}
+	return original, nil
+}
+
+// removeOriginal 清理写入失败时已保留的原图，未保留原图时不做任何操作，避免误删 dataDir
+func removeOriginal(original string) {
+	if original != "" {
+		os.Remove(dataDir + original)
+	}
+}
+
+func writePNG(dst string, img image.Image, metadata map[string]string) error {
+	buf := &bytes.Buffer{}
+	if err := watermark.EncodePNG(buf, img, metadata); err != nil {
+		return err
+	}
+	_, err := writeImageAtomically(dst, buf, int64(buf.Len()), pngTypes)
+	return err
+}
@@ -1,8 +1,11 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"idraw-server/api/response"
+	"idraw-server/apperror"
 	"idraw-server/db"
 	"log"
 	"net/http"
@@ -10,14 +13,6 @@ import (
 	"os"
 )
 
-type weChatLoginResp struct {
-	SessionKey string `json:"session_key"`
-	OpenId     string `json:"openid"`
-	UnionId    string `json:"unionid"`
-	ErrCode    string `json:"errcode"`
-	ErrMsg     int32  `json:"errmsg"`
-}
-
 const weChatApiUrl = "https://api.weixin.qq.com"
 
 var userMapper db.UserMapper
@@ -46,30 +41,71 @@ func getWeAppSecret() string {
 	return os.Getenv("WE_APP_SECRET")
 }
 
-func WeChatLogin(code string) (*weChatLoginResp, error) {
+// WeChatLogin 登录并记录用户，新用户携带有效的 inviteCode 时绑定邀请关系
+func WeChatLogin(ctx context.Context, code string, inviteCode string) (*response.WeChatLoginDto, error) {
+	ctx, span := tracer.Start(ctx, "wechat.jscode2session")
+	defer span.End()
 	params := url.Values{}
 	params.Add("appid", getWeAppId())
 	params.Add("secret", getWeAppSecret())
 	params.Add("js_code", code)
 	params.Add("grant_type", "authorization_code")
 	reqUrl := weChatApiUrl + "/sns/jscode2session?" + params.Encode()
-	r, err := http.Get(reqUrl)
-	result := &weChatLoginResp{}
+	result := &response.WeChatLoginDto{}
+	r, err := doRequest(ctx, upstreamWeChat, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
+	})
 	if err != nil {
 		log.Println("build http request failed", err)
 		return result, err
 	}
+	defer r.Body.Close()
 	if r.StatusCode != 200 {
 		log.Printf("do http request failed, status: %s", r.Status)
-		return result, errors.New(r.Status)
+		return result, classifyStatus(upstreamWeChat, r.StatusCode, nil)
 	}
-	defer r.Body.Close()
 	err = json.NewDecoder(r.Body).Decode(result)
 	if err != nil {
 		log.Println("do response json decode failed", err)
 		return result, err
 	}
+	if result.ErrCode != 0 {
+		log.Printf("jscode2session failed, errcode: %d, errmsg: %s", result.ErrCode, result.ErrMsg)
+		return result, weChatError(result.ErrCode, result.ErrMsg)
+	}
 	// try to record user info
-	userMapper.Insert(result.OpenId)
+	userMapper.Insert(ctx, result.OpenId, inviteCode)
+	// only returned once the mini program is bound to an open platform account
+	if result.UnionId != "" {
+		if err := userMapper.BindUnionId(ctx, result.OpenId, result.UnionId); err != nil {
+			log.Printf("failed to bind the union id of user %s, the error is %s", result.OpenId, err)
+		}
+	}
 	return result, nil
 }
+
+// weChatApiError 微信服务端接口返回的错误码
+type weChatApiError struct {
+	ErrCode int
+	ErrMsg  string
+}
+
+func (e *weChatApiError) Error() string {
+	return fmt.Sprintf("wechat errcode %d: %s", e.ErrCode, e.ErrMsg)
+}
+
+// weChatError 将微信接口的 errcode 映射为业务错误
+func weChatError(errCode int, errMsg string) error {
+	err := &weChatApiError{ErrCode: errCode, ErrMsg: errMsg}
+	switch errCode {
+	case 40029, 40163, 40226:
+		// invalid code, code been used, high risk user
+		return apperror.New(apperror.CodeUnauthorized, err)
+	case 45011:
+		return apperror.New(apperror.CodeTooManyRequests, err)
+	case -1:
+		return apperror.New(apperror.CodeServiceUnavailable, err)
+	default:
+		return apperror.New(apperror.CodeInternal, err)
+	}
+}
@@ -0,0 +1,66 @@
+package telemetry
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const ServiceName = "idraw-server"
+
+// Setup 初始化全局 tracer provider，通过 OTEL_EXPORTER_OTLP_ENDPOINT 指向 collector，
+// 未配置或 OTEL_SDK_DISABLED=true 时不导出任何 span
+func Setup(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		log.Println("otlp exporter is not configured, tracing disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+	// endpoint, headers and insecure flag are all read from the standard OTEL_EXPORTER_OTLP_* envs
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	log.Println("tracing enabled, exporting spans to", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	return tp.Shutdown, nil
+}
+
+// Tracer 返回指定模块的 tracer，未启用导出时为 no-op 实现
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(ServiceName + "/" + name)
+}
+
+// End 记录错误（如有）并结束 span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach 返回一个不会随 ctx 取消的新 context，但保留 ctx 中的 span，用于请求结束后仍需完成的收尾工作
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
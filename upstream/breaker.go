@@ -0,0 +1,90 @@
+// Package upstream 上游调用共用的熔断与重试策略，与具体的传输方式无关
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	StateClosed   = "CLOSED"
+	StateOpen     = "OPEN"
+	StateHalfOpen = "HALF_OPEN"
+)
+
+// Breaker 连续失败达到阈值后熔断一段时间，冷却结束后只放行一个探测请求，成功才恢复
+type Breaker struct {
+	mu               sync.Mutex
+	state            string
+	failures         int
+	failureThreshold int
+	cooldown         time.Duration
+	openedAt         time.Time
+	probing          bool
+	now              func() time.Time
+}
+
+func NewBreaker(failureThreshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		state:            StateClosed,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+	}
+}
+
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow 判断当前是否可以向上游发起请求，放行后必须调用 OnSuccess、OnFailure 或 Release 之一
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case StateOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = StateHalfOpen
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		// only one probe request at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *Breaker) OnSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = StateClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *Breaker) OnFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == StateHalfOpen || b.failures >= b.failureThreshold {
+		b.state = StateOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Release 归还探测名额但不改变状态，用于请求被取消等无法判断上游是否健康的情况
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,124 @@
+package upstream
+
+import (
+	"testing"
+	"time"
+)
+
+// clock the time returned to the breaker and the retrier, moved forward by the tests
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newTestBreaker() (*Breaker, *clock) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := NewBreaker(3, 30*time.Second)
+	b.now = c.now
+	return b, c
+}
+
+// tripBreaker fails until the breaker opens
+func tripBreaker(t *testing.T, b *Breaker) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatalf("request #%d is rejected before reaching the threshold", i)
+		}
+		b.OnFailure()
+	}
+	if state := b.State(); state != StateOpen {
+		t.Fatalf("breaker is %s after reaching the threshold", state)
+	}
+}
+
+func TestBreakerOpensAtThreshold(t *testing.T) {
+	b, _ := newTestBreaker()
+	for i := 0; i < 2; i++ {
+		b.Allow()
+		b.OnFailure()
+	}
+	if state := b.State(); state != StateClosed {
+		t.Fatalf("breaker is %s below the threshold", state)
+	}
+	// a success resets the consecutive failures
+	b.Allow()
+	b.OnSuccess()
+	b.Allow()
+	b.OnFailure()
+	if state := b.State(); state != StateClosed {
+		t.Fatalf("breaker is %s after failures separated by a success", state)
+	}
+	b.OnSuccess()
+	tripBreaker(t, b)
+	if b.Allow() {
+		t.Fatal("open breaker lets a request through")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		report func(b *Breaker)
+		want   string
+	}{
+		{name: "probe succeeds", report: (*Breaker).OnSuccess, want: StateClosed},
+		{name: "probe fails", report: (*Breaker).OnFailure, want: StateOpen},
+		{name: "probe is canceled", report: (*Breaker).Release, want: StateHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, c := newTestBreaker()
+			tripBreaker(t, b)
+			c.t = c.t.Add(30*time.Second - time.Millisecond)
+			if b.Allow() {
+				t.Fatal("breaker lets a request through during the cooldown")
+			}
+			c.t = c.t.Add(time.Millisecond)
+			if !b.Allow() {
+				t.Fatal("breaker rejects the probe after the cooldown")
+			}
+			if state := b.State(); state != StateHalfOpen {
+				t.Fatalf("breaker is %s while probing", state)
+			}
+			if b.Allow() {
+				t.Fatal("breaker lets a second request through while probing")
+			}
+			tt.report(b)
+			if state := b.State(); state != tt.want {
+				t.Fatalf("breaker is %s after the probe, want %s", state, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerReopenRestartsCooldown(t *testing.T) {
+	b, c := newTestBreaker()
+	tripBreaker(t, b)
+	c.t = c.t.Add(30 * time.Second)
+	b.Allow()
+	b.OnFailure()
+	// the cooldown counts from the failed probe, not from the first trip
+	c.t = c.t.Add(29 * time.Second)
+	if b.Allow() {
+		t.Fatal("breaker lets a request through before the new cooldown ends")
+	}
+	c.t = c.t.Add(time.Second)
+	if !b.Allow() {
+		t.Fatal("breaker rejects the probe after the new cooldown")
+	}
+}
+
+func TestBreakerReleaseAllowsNextProbe(t *testing.T) {
+	b, c := newTestBreaker()
+	tripBreaker(t, b)
+	c.t = c.t.Add(30 * time.Second)
+	b.Allow()
+	b.Release()
+	if !b.Allow() {
+		t.Fatal("breaker is stuck in half open after the probe is released")
+	}
+}
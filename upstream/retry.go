@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Attempt 发起第 n 次调用（从 1 开始），返回是否值得重试及建议的等待时间，等待时间为 0 时按指数退避
+type Attempt func(n int) (wait time.Duration, retry bool, err error)
+
+// Retrier 以带抖动的指数退避重试失败的调用，上游给出的 Retry-After 优先
+type Retrier struct {
+	maxAttempts   int
+	baseBackoff   time.Duration
+	maxBackoff    time.Duration
+	maxRetryAfter time.Duration
+	now           func() time.Time
+	after         func(d time.Duration) <-chan time.Time
+	jitter        func(n int64) int64
+}
+
+func NewRetrier(maxAttempts int, baseBackoff, maxBackoff, maxRetryAfter time.Duration) *Retrier {
+	return &Retrier{
+		maxAttempts:   maxAttempts,
+		baseBackoff:   baseBackoff,
+		maxBackoff:    maxBackoff,
+		maxRetryAfter: maxRetryAfter,
+		now:           time.Now,
+		after:         time.After,
+		jitter:        rand.Int63n,
+	}
+}
+
+// Do 依次调用 attempt，直到成功、出现不可重试的错误或用尽次数，返回最后一次的错误。
+// 等待重试期间 ctx 结束时返回 ctx.Err()
+func (r *Retrier) Do(ctx context.Context, name string, attempt Attempt) error {
+	for n := 1; ; n++ {
+		wait, retry, err := attempt(n)
+		if err == nil || !retry || n >= r.maxAttempts {
+			return err
+		}
+		if wait == 0 {
+			wait = r.Backoff(n)
+		}
+		log.Printf("%s request failed at attempt %d, retry in %s, the error is %s", name, n, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.after(wait):
+		}
+	}
+}
+
+// Backoff full jitter: a random duration in [0, min(maxBackoff, base*2^attempt))
+func (r *Retrier) Backoff(attempt int) time.Duration {
+	d := r.baseBackoff << attempt
+	if d > r.maxBackoff || d <= 0 {
+		d = r.maxBackoff
+	}
+	return time.Duration(r.jitter(int64(d)))
+}
+
+// ParseRetryAfter 支持秒数与 http-date 两种格式，超过上限的值会被截断
+func (r *Retrier) ParseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(val); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(val); err == nil {
+		d = t.Sub(r.now())
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > r.maxRetryAfter {
+		return r.maxRetryAfter
+	}
+	return d
+}
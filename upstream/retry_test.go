@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errAttempt = errors.New("attempt failed")
+
+// newTestRetrier records the waits instead of sleeping, the jitter always picks the upper bound
+func newTestRetrier() (*Retrier, *clock, *[]time.Duration) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	waits := &[]time.Duration{}
+	r := NewRetrier(3, 500*time.Millisecond, 8*time.Second, 30*time.Second)
+	r.now = c.now
+	r.jitter = func(n int64) int64 { return n - 1 }
+	r.after = func(d time.Duration) <-chan time.Time {
+		*waits = append(*waits, d)
+		c.t = c.t.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- c.t
+		return ch
+	}
+	return r, c, waits
+}
+
+func TestRetrierDo(t *testing.T) {
+	tests := []struct {
+		name      string
+		results   []error
+		retry     bool
+		wait      time.Duration
+		wantCalls int
+		wantWaits []time.Duration
+		wantErr   error
+	}{
+		{name: "success", results: []error{nil}, retry: true, wantCalls: 1, wantWaits: []time.Duration{}},
+		{name: "success after retry", results: []error{errAttempt, nil}, retry: true, wantCalls: 2, wantWaits: []time.Duration{time.Second - 1}},
+		{name: "not retryable", results: []error{errAttempt, nil}, retry: false, wantCalls: 1, wantWaits: []time.Duration{}, wantErr: errAttempt},
+		{name: "attempts exhausted", results: []error{errAttempt, errAttempt, errAttempt, nil}, retry: true, wantCalls: 3,
+			wantWaits: []time.Duration{time.Second - 1, 2*time.Second - 1}, wantErr: errAttempt},
+		{name: "suggested wait", results: []error{errAttempt, errAttempt, nil}, retry: true, wait: 5 * time.Second, wantCalls: 3,
+			wantWaits: []time.Duration{5 * time.Second, 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, waits := newTestRetrier()
+			calls := 0
+			err := r.Do(context.Background(), "test", func(n int) (time.Duration, bool, error) {
+				calls++
+				if n != calls {
+					t.Fatalf("attempt %d is numbered %d", calls, n)
+				}
+				return tt.wait, tt.retry, tt.results[n-1]
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("the error is %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Fatalf("called %d times, want %d", calls, tt.wantCalls)
+			}
+			if !reflect.DeepEqual(*waits, tt.wantWaits) {
+				t.Fatalf("waited %v, want %v", *waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func TestRetrierDoCanceledWhileWaiting(t *testing.T) {
+	r, _, _ := newTestRetrier()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.after = func(d time.Duration) <-chan time.Time {
+		cancel()
+		return make(chan time.Time)
+	}
+	calls := 0
+	err := r.Do(ctx, "test", func(n int) (time.Duration, bool, error) {
+		calls++
+		return 0, true, errAttempt
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Fatalf("called %d times, the error is %v", calls, err)
+	}
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r, _, _ := newTestRetrier()
+	tests := map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  8 * time.Second, // capped
+		64: 8 * time.Second, // overflowed
+	}
+	for attempt, bound := range tests {
+		if got := r.Backoff(attempt); got != bound-1 {
+			t.Errorf("backoff of attempt %d is %s, want below %s", attempt, got, bound)
+		}
+	}
+	r.jitter = func(n int64) int64 { return 0 }
+	if got := r.Backoff(1); got != 0 {
+		t.Errorf("backoff with the lowest jitter is %s", got)
+	}
+}
+
+func TestRetrierParseRetryAfter(t *testing.T) {
+	r, c, _ := newTestRetrier()
+	tests := []struct {
+		val  string
+		want time.Duration
+	}{
+		{val: "", want: 0},
+		{val: "3", want: 3 * time.Second},
+		{val: "-1", want: 0},
+		{val: "120", want: 30 * time.Second},
+		{val: c.t.Add(10 * time.Second).Format(http.TimeFormat), want: 10 * time.Second},
+		{val: c.t.Add(-10 * time.Second).Format(http.TimeFormat), want: 0},
+		{val: c.t.Add(time.Hour).Format(http.TimeFormat), want: 30 * time.Second},
+		{val: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		if got := r.ParseRetryAfter(tt.val); got != tt.want {
+			t.Errorf("Retry-After %q is parsed as %s, want %s", tt.val, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package watermark
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"sort"
+)
+
+// ihdrEnd PNG 签名（8 字节）与 IHDR 块（25 字节）之后的位置，文本块写在这之后
+const ihdrEnd = 8 + 25
+
+// EncodePNG 编码为 PNG，并以 tEXt 块写入 text 中的键值，键值须为 Latin-1 字符
+func EncodePNG(w io.Writer, img image.Image, text map[string]string) error {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return errors.New("unexpected png layout")
+	}
+	if _, err := w.Write(data[:ihdrEnd]); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(text))
+	for k := range text {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := writeChunk(w, "tEXt", []byte(k+"\x00"+text[k])); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(data[ihdrEnd:])
+	return err
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	chunk := make([]byte, 0, len(data)+12)
+	chunk = binary.BigEndian.AppendUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := w.Write(chunk)
+	return err
+}
@@ -0,0 +1,123 @@
+// Package watermark 为生成的图片添加可见水印，并在 PNG 元数据中写入 AI 生成标识
+package watermark
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	TopLeft     = "top-left"
+	TopRight    = "top-right"
+	BottomLeft  = "bottom-left"
+	BottomRight = "bottom-right"
+	Center      = "center"
+)
+
+// Config 水印内容与样式，Text 与 Logo 至少设置一项，同时设置时 Logo 在左、文字在右
+type Config struct {
+	Text     string
+	Logo     image.Image
+	Position string  // one of the position constants
+	Opacity  float64 // 0 to 1
+}
+
+// Marker 按配置绘制水印，可并发使用
+type Marker struct {
+	cfg  Config
+	font *opentype.Font
+}
+
+// New 校验配置，f 用于绘制文字水印
+func New(cfg Config, f *opentype.Font) (*Marker, error) {
+	switch cfg.Position {
+	case TopLeft, TopRight, BottomLeft, BottomRight, Center:
+	default:
+		return nil, fmt.Errorf("unknown position %s", cfg.Position)
+	}
+	if cfg.Opacity <= 0 || cfg.Opacity > 1 {
+		return nil, fmt.Errorf("opacity %v is out of (0, 1]", cfg.Opacity)
+	}
+	if cfg.Text == "" && cfg.Logo == nil {
+		return nil, fmt.Errorf("neither text nor logo is set")
+	}
+	return &Marker{cfg: cfg, font: f}, nil
+}
+
+// Apply 返回添加了水印的新图片，水印大小随图片宽度缩放
+func (m *Marker) Apply(src image.Image) (*image.RGBA, error) {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	height := b.Dx() / 24
+	if height < 12 {
+		height = 12
+	}
+	gap := height / 3
+	var logoWidth, textWidth int
+	var face font.Face
+	if m.cfg.Logo != nil {
+		lb := m.cfg.Logo.Bounds()
+		logoWidth = lb.Dx() * height / lb.Dy()
+	}
+	if m.cfg.Text != "" {
+		var err error
+		face, err = opentype.NewFace(m.font, &opentype.FaceOptions{Size: float64(height), DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		defer face.Close()
+		textWidth = font.MeasureString(face, m.cfg.Text).Ceil()
+	}
+	width := logoWidth + textWidth
+	if logoWidth > 0 && textWidth > 0 {
+		width += gap
+	}
+
+	// 先绘制到单独的图层，再按透明度整体合成
+	layer := image.NewRGBA(image.Rect(0, 0, width, height))
+	if m.cfg.Logo != nil {
+		xdraw.CatmullRom.Scale(layer, image.Rect(0, 0, logoWidth, height), m.cfg.Logo, m.cfg.Logo.Bounds(), draw.Over, nil)
+	}
+	if face != nil {
+		x := width - textWidth
+		baseline := (height + face.Metrics().Ascent.Ceil() - face.Metrics().Descent.Ceil()) / 2
+		// 深色描边保证在浅色背景上也能看清
+		shadow := font.Drawer{Dst: layer, Src: image.NewUniform(color.RGBA{A: 0xc0}), Face: face}
+		for _, d := range []image.Point{{-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			shadow.Dot = fixed.P(x+d.X, baseline+d.Y)
+			shadow.DrawString(m.cfg.Text)
+		}
+		text := font.Drawer{Dst: layer, Src: image.White, Face: face, Dot: fixed.P(x, baseline)}
+		text.DrawString(m.cfg.Text)
+	}
+	at := m.position(dst.Bounds(), layer.Bounds(), gap)
+	mask := image.NewUniform(color.Alpha{A: uint8(m.cfg.Opacity * 0xff)})
+	draw.DrawMask(dst, layer.Bounds().Add(at), layer, image.Point{}, mask, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+func (m *Marker) position(canvas image.Rectangle, mark image.Rectangle, margin int) image.Point {
+	left, top := margin, margin
+	right, bottom := canvas.Dx()-mark.Dx()-margin, canvas.Dy()-mark.Dy()-margin
+	switch m.cfg.Position {
+	case TopLeft:
+		return image.Pt(left, top)
+	case TopRight:
+		return image.Pt(right, top)
+	case BottomLeft:
+		return image.Pt(left, bottom)
+	case Center:
+		return image.Pt((canvas.Dx()-mark.Dx())/2, (canvas.Dy()-mark.Dy())/2)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
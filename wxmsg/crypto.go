@@ -0,0 +1,111 @@
+package wxmsg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// blockSize 消息加解密使用 32 字节的 PKCS#7 填充，与 aes 的分组大小不同
+const blockSize = 32
+
+// Crypter 公众号安全模式下的消息加解密，算法为 AES-256-CBC，iv 取密钥的前 16 字节
+type Crypter struct {
+	token string
+	appId string
+	key   []byte
+}
+
+// NewCrypter encodingAESKey 为公众平台配置的 43 位 EncodingAESKey
+func NewCrypter(token string, encodingAESKey string, appId string) (*Crypter, error) {
+	key, err := base64.StdEncoding.DecodeString(encodingAESKey + "=")
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("encoding aes key must decode to 32 bytes")
+	}
+	return &Crypter{token: token, appId: appId, key: key}, nil
+}
+
+// Signature 将 token 与其余参数按字典序排序拼接后计算 sha1
+func Signature(token string, parts ...string) string {
+	all := append([]string{token}, parts...)
+	sort.Strings(all)
+	sum := sha1.Sum([]byte(strings.Join(all, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifySignature 校验服务器地址验证及明文消息的签名
+func VerifySignature(token string, signature string, timestamp string, nonce string) bool {
+	return subtle.ConstantTimeCompare([]byte(Signature(token, timestamp, nonce)), []byte(signature)) == 1
+}
+
+// Decrypt 校验 msg_signature 后解密消息，并确认消息属于本公众号
+func (c *Crypter) Decrypt(msgSignature string, timestamp string, nonce string, encrypted string) ([]byte, error) {
+	if subtle.ConstantTimeCompare([]byte(Signature(c.token, timestamp, nonce, encrypted)), []byte(msgSignature)) != 1 {
+		return nil, errors.New("invalid message signature")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid ciphertext length")
+	}
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, c.key[:aes.BlockSize]).CryptBlocks(plain, ciphertext)
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > blockSize || pad > len(plain) {
+		return nil, errors.New("invalid padding")
+	}
+	plain = plain[:len(plain)-pad]
+	// random(16) + msg length(4, big endian) + msg + appid
+	if len(plain) < 20 {
+		return nil, errors.New("decrypted message too short")
+	}
+	size := int(binary.BigEndian.Uint32(plain[16:20]))
+	if size > len(plain)-20 {
+		return nil, errors.New("invalid message length")
+	}
+	msg, appId := plain[20:20+size], plain[20+size:]
+	if string(appId) != c.appId {
+		return nil, errors.New("message is sent to another app " + string(appId))
+	}
+	return msg, nil
+}
+
+// Encrypt Decrypt 的逆过程，用于加密被动回复，返回密文及其 msg_signature
+func (c *Crypter) Encrypt(msg []byte, timestamp string, nonce string) (string, string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	plain := bytes.NewBuffer(random)
+	plain.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg))))
+	plain.Write(msg)
+	plain.WriteString(c.appId)
+	pad := blockSize - plain.Len()%blockSize
+	plain.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return "", "", err
+	}
+	ciphertext := make([]byte, plain.Len())
+	cipher.NewCBCEncrypter(block, c.key[:aes.BlockSize]).CryptBlocks(ciphertext, plain.Bytes())
+	encrypted := base64.StdEncoding.EncodeToString(ciphertext)
+	return encrypted, Signature(c.token, timestamp, nonce, encrypted), nil
+}
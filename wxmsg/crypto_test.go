@@ -0,0 +1,120 @@
+package wxmsg_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"idraw-server/wxmsg"
+	"testing"
+)
+
+// the sample of the message encryption guide on the WeChat official accounts platform
+const (
+	sampleToken     = "spamtest"
+	sampleAESKey    = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFG"
+	sampleAppId     = "wx2c2769f8efd9abc2"
+	sampleTimestamp = "1409735669"
+	sampleNonce     = "1320562132"
+	sampleSignature = "5d197aaffba7e9b25a30732f161a50dee96bd5fa"
+	sampleEncrypted = "hyzAe4OzmOMbd6TvGdIOO6uBmdJoD0Fk53REIHvxYtJlE2B655HuD0m8KUePWB3+LrPXo87wzQ1QLvbeUgmBM4x6F8PGHQHFVAFmOD2LdJF9FrXpbUAh0B5GIItb52sn896wVsMSHGuPE328HnRGBcrS7C41IzDWyWNlZkyyXwon8T332jisa+h6tEDYsVticbSnyU8dKOIbgU6ux5VTjg3yt+WGzjlpKn6NPhRjpA912xMezR4kw6KWwMrCVKSVCZciVGCgavjIQ6X8tCOp3yZbGpy0VxpAe+77TszTfRd5RJSVO/HTnifJpXgCSUdUue1v6h0EIBYYI1BD1DlD+C0CR8e6OewpusjZ4uBl9FyJvnhvQl+q5rv1ixrcpCumEPo5MJSgM9ehVsNPfUM669WuMyVWQLCzpu9GhglF2PE="
+)
+
+func newSampleCrypter(t *testing.T, appId string) *wxmsg.Crypter {
+	t.Helper()
+	c, err := wxmsg.NewCrypter(sampleToken, sampleAESKey, appId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDecryptSample(t *testing.T) {
+	c := newSampleCrypter(t, sampleAppId)
+	plain, err := c.Decrypt(sampleSignature, sampleTimestamp, sampleNonce, sampleEncrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := wxmsg.Message{}
+	if err := xml.Unmarshal(plain, &msg); err != nil {
+		t.Fatal(err)
+	}
+	want := wxmsg.Message{
+		XMLName:      xml.Name{Local: "xml"},
+		ToUserName:   "gh_10f6c3c3ac5a",
+		FromUserName: "oyORnuP8q7ou2gfYjqLzSIWZf0rs",
+		CreateTime:   1409735668,
+		MsgType:      wxmsg.MsgTypeText,
+		Content:      "abcdteT",
+		MsgId:        6054768590064713728,
+	}
+	if msg != want {
+		t.Fatalf("decrypted message is %+v, want %+v", msg, want)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	c := newSampleCrypter(t, sampleAppId)
+	for _, msg := range [][]byte{
+		[]byte("<xml><Content><![CDATA[你好]]></Content></xml>"),
+		{},
+		bytes.Repeat([]byte("a"), 64-20-len(sampleAppId)), // the plain text fills the block, a whole block of padding is added
+	} {
+		encrypted, signature, err := c.Encrypt(msg, sampleTimestamp, sampleNonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signature != wxmsg.Signature(sampleToken, sampleTimestamp, sampleNonce, encrypted) {
+			t.Fatalf("signature %s does not sign the ciphertext", signature)
+		}
+		plain, err := c.Decrypt(signature, sampleTimestamp, sampleNonce, encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, msg) {
+			t.Fatalf("round trip of %q returns %q", msg, plain)
+		}
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		appId     string
+		signature string
+		timestamp string
+		encrypted string
+	}{
+		{name: "bad signature", appId: sampleAppId, signature: "0000000000000000000000000000000000000000", timestamp: sampleTimestamp, encrypted: sampleEncrypted},
+		{name: "replayed with another timestamp", appId: sampleAppId, signature: sampleSignature, timestamp: "1409735670", encrypted: sampleEncrypted},
+		{name: "tampered ciphertext", appId: sampleAppId, signature: sampleSignature, timestamp: sampleTimestamp, encrypted: "A" + sampleEncrypted[1:]},
+		{name: "appid mismatch", appId: "wx0000000000000000", signature: sampleSignature, timestamp: sampleTimestamp, encrypted: sampleEncrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newSampleCrypter(t, tt.appId)
+			if plain, err := c.Decrypt(tt.signature, tt.timestamp, sampleNonce, tt.encrypted); err == nil {
+				t.Fatalf("message is accepted: %s", plain)
+			}
+		})
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	signature := wxmsg.Signature(sampleToken, sampleTimestamp, sampleNonce)
+	if !wxmsg.VerifySignature(sampleToken, signature, sampleTimestamp, sampleNonce) {
+		t.Fatal("valid signature is rejected")
+	}
+	if wxmsg.VerifySignature("another-token", signature, sampleTimestamp, sampleNonce) {
+		t.Fatal("signature of another token is accepted")
+	}
+	if wxmsg.VerifySignature(sampleToken, signature, sampleTimestamp, "1320562133") {
+		t.Fatal("signature of another nonce is accepted")
+	}
+}
+
+func TestNewCrypterRejectsBadKey(t *testing.T) {
+	for _, key := range []string{"", "too-short", sampleAESKey + "A"} {
+		if _, err := wxmsg.NewCrypter(sampleToken, key, sampleAppId); err == nil {
+			t.Fatalf("encoding aes key %q is accepted", key)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package wxmsg
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// message types and events
+const (
+	MsgTypeText      string = "text"
+	MsgTypeEvent     string = "event"
+	EventSubscribe   string = "subscribe"
+	EventUnsubscribe string = "unsubscribe"
+)
+
+// Envelope 安全模式下推送的加密消息
+type Envelope struct {
+	XMLName    xml.Name `xml:"xml"`
+	ToUserName string   `xml:"ToUserName"`
+	Encrypt    string   `xml:"Encrypt"`
+}
+
+// Message 公众号收到的普通消息及事件，只列出用到的字段
+type Message struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   string   `xml:"ToUserName"`   // id of the official account
+	FromUserName string   `xml:"FromUserName"` // openid of the sender
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      string   `xml:"MsgType"`
+	Content      string   `xml:"Content"` // text messages only
+	MsgId        int64    `xml:"MsgId"`   // 0 for events
+	Event        string   `xml:"Event"`   // events only
+}
+
+type cdata struct {
+	Value string `xml:",cdata"`
+}
+
+// TextReply 被动回复的文本消息
+type TextReply struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   cdata    `xml:"ToUserName"`
+	FromUserName cdata    `xml:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      cdata    `xml:"MsgType"`
+	Content      cdata    `xml:"Content"`
+}
+
+// NewTextReply 回复给消息的发送者
+func NewTextReply(msg Message, content string) TextReply {
+	return TextReply{
+		ToUserName:   cdata{msg.FromUserName},
+		FromUserName: cdata{msg.ToUserName},
+		CreateTime:   time.Now().Unix(),
+		MsgType:      cdata{MsgTypeText},
+		Content:      cdata{content},
+	}
+}
+
+// EncryptedReply 安全模式下加密后的被动回复
+type EncryptedReply struct {
+	XMLName      xml.Name `xml:"xml"`
+	Encrypt      cdata    `xml:"Encrypt"`
+	MsgSignature cdata    `xml:"MsgSignature"`
+	TimeStamp    string   `xml:"TimeStamp"`
+	Nonce        cdata    `xml:"Nonce"`
+}
+
+// EncryptReply 加密被动回复
+func (c *Crypter) EncryptReply(reply []byte, timestamp string, nonce string) ([]byte, error) {
+	encrypted, signature, err := c.Encrypt(reply, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return xml.Marshal(EncryptedReply{
+		Encrypt:      cdata{encrypted},
+		MsgSignature: cdata{signature},
+		TimeStamp:    timestamp,
+		Nonce:        cdata{nonce},
+	})
+}
@@ -0,0 +1,304 @@
+package wxpay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultApiUrl   string = "https://api.mch.weixin.qq.com"
+	algorithmAesGcm string = "AEAD_AES_256_GCM"
+	authSchema      string = "WECHATPAY2-SHA256-RSA2048"
+	// maxClockSkew 回调与应答签名中时间戳允许的最大偏差，超出视为重放
+	maxClockSkew = 5 * time.Minute
+
+	HeaderTimestamp string = "Wechatpay-Timestamp"
+	HeaderNonce     string = "Wechatpay-Nonce"
+	HeaderSignature string = "Wechatpay-Signature"
+	HeaderSerial    string = "Wechatpay-Serial"
+)
+
+// trade states of a transaction
+const (
+	TradeSuccess    string = "SUCCESS"
+	TradeRefund     string = "REFUND"
+	TradeNotPay     string = "NOTPAY"
+	TradeClosed     string = "CLOSED"
+	TradeRevoked    string = "REVOKED"
+	TradeUserPaying string = "USERPAYING"
+	TradePayError   string = "PAYERROR"
+)
+
+type Config struct {
+	ApiUrl         string // DefaultApiUrl if empty, point it to a fake server for local tests
+	AppId          string
+	MchId          string
+	SerialNo       string          // serial number of the merchant api certificate
+	PrivateKey     *rsa.PrivateKey // merchant api private key
+	ApiV3Key       []byte          // 32 bytes api v3 key
+	PlatformSerial string          // serial number of the wechat pay public key (or platform certificate)
+	PlatformKey    *rsa.PublicKey  // wechat pay public key used to verify responses and notifications
+	NotifyUrl      string
+	HttpClient     *http.Client
+}
+
+// Client 微信支付 APIv3 客户端，负责请求签名、应答验签与回调解密
+type Client struct {
+	cfg Config
+}
+
+// APIError 微信支付返回的非 2xx 应答
+type APIError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("wechat pay %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+type Amount struct {
+	Total         int    `json:"total"`
+	PayerTotal    int    `json:"payer_total,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	PayerCurrency string `json:"payer_currency,omitempty"`
+}
+
+type Payer struct {
+	OpenId string `json:"openid"`
+}
+
+type JsapiReq struct {
+	AppId       string `json:"appid"`
+	MchId       string `json:"mchid"`
+	Description string `json:"description"`
+	OutTradeNo  string `json:"out_trade_no"`
+	TimeExpire  string `json:"time_expire,omitempty"`
+	NotifyUrl   string `json:"notify_url"`
+	Amount      Amount `json:"amount"`
+	Payer       Payer  `json:"payer"`
+}
+
+type jsapiResp struct {
+	PrepayId string `json:"prepay_id"`
+}
+
+// PayParams 小程序 wx.requestPayment 所需的参数
+type PayParams struct {
+	AppId     string `json:"appId"`
+	TimeStamp string `json:"timeStamp"`
+	NonceStr  string `json:"nonceStr"`
+	Package   string `json:"package"`
+	SignType  string `json:"signType"`
+	PaySign   string `json:"paySign"`
+}
+
+type Transaction struct {
+	AppId          string `json:"appid"`
+	MchId          string `json:"mchid"`
+	OutTradeNo     string `json:"out_trade_no"`
+	TransactionId  string `json:"transaction_id"`
+	TradeType      string `json:"trade_type"`
+	TradeState     string `json:"trade_state"`
+	TradeStateDesc string `json:"trade_state_desc"`
+	SuccessTime    string `json:"success_time"`
+	Payer          Payer  `json:"payer"`
+	Amount         Amount `json:"amount"`
+}
+
+type Resource struct {
+	Algorithm      string `json:"algorithm"`
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data"`
+	OriginalType   string `json:"original_type"`
+	Nonce          string `json:"nonce"`
+}
+
+// Notification 支付结果回调通知的报文
+type Notification struct {
+	Id           string   `json:"id"`
+	CreateTime   string   `json:"create_time"`
+	EventType    string   `json:"event_type"`
+	ResourceType string   `json:"resource_type"`
+	Summary      string   `json:"summary"`
+	Resource     Resource `json:"resource"`
+}
+
+func NewClient(cfg Config) *Client {
+	if cfg.ApiUrl == "" {
+		cfg.ApiUrl = DefaultApiUrl
+	}
+	if cfg.HttpClient == nil {
+		cfg.HttpClient = http.DefaultClient
+	}
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) AppId() string {
+	return c.cfg.AppId
+}
+
+func (c *Client) MchId() string {
+	return c.cfg.MchId
+}
+
+// PrepayJsapi JSAPI/小程序下单，返回 prepay_id
+func (c *Client) PrepayJsapi(ctx context.Context, description string, outTradeNo string, total int, openId string, expire time.Time) (string, error) {
+	req := JsapiReq{
+		AppId:       c.cfg.AppId,
+		MchId:       c.cfg.MchId,
+		Description: description,
+		OutTradeNo:  outTradeNo,
+		TimeExpire:  expire.Format(time.RFC3339),
+		NotifyUrl:   c.cfg.NotifyUrl,
+		Amount:      Amount{Total: total, Currency: "CNY"},
+		Payer:       Payer{OpenId: openId},
+	}
+	result := &jsapiResp{}
+	if err := c.do(ctx, "POST", "/v3/pay/transactions/jsapi", req, result); err != nil {
+		return "", err
+	}
+	return result.PrepayId, nil
+}
+
+// JsapiPayParams 为 prepay_id 生成小程序调起支付的签名参数
+func (c *Client) JsapiPayParams(prepayId string) (PayParams, error) {
+	params := PayParams{
+		AppId:     c.cfg.AppId,
+		TimeStamp: strconv.FormatInt(time.Now().Unix(), 10),
+		NonceStr:  NonceStr(),
+		Package:   "prepay_id=" + prepayId,
+		SignType:  "RSA",
+	}
+	sig, err := Sign(c.cfg.PrivateKey, params.AppId+"\n"+params.TimeStamp+"\n"+params.NonceStr+"\n"+params.Package+"\n")
+	if err != nil {
+		return PayParams{}, err
+	}
+	params.PaySign = sig
+	return params, nil
+}
+
+// QueryOrder 按商户订单号查询订单
+func (c *Client) QueryOrder(ctx context.Context, outTradeNo string) (*Transaction, error) {
+	result := &Transaction{}
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(outTradeNo) + "?mchid=" + url.QueryEscape(c.cfg.MchId)
+	if err := c.do(ctx, "GET", path, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CloseOrder 关闭未支付的订单
+func (c *Client) CloseOrder(ctx context.Context, outTradeNo string) error {
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(outTradeNo) + "/close"
+	return c.do(ctx, "POST", path, map[string]string{"mchid": c.cfg.MchId}, nil)
+}
+
+// ParseNotify 校验支付结果通知的签名并解密出交易信息
+func (c *Client) ParseNotify(r *http.Request) (*Transaction, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.verify(r.Header, body); err != nil {
+		return nil, err
+	}
+	notification := &Notification{}
+	if err := json.Unmarshal(body, notification); err != nil {
+		return nil, err
+	}
+	plaintext, err := DecryptResource(c.cfg.ApiV3Key, notification.Resource)
+	if err != nil {
+		return nil, err
+	}
+	result := &Transaction{}
+	if err := json.Unmarshal(plaintext, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// do 发起签名请求并校验应答签名，result 为 nil 时忽略应答体
+func (c *Client) do(ctx context.Context, method string, path string, payload any, result any) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequestWithContext(ctx, method, c.cfg.ApiUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	authorization, err := c.authorization(method, path, body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", authorization)
+	r.Header.Set("Accept", "application/json")
+	if payload != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.cfg.HttpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		json.Unmarshal(respBody, apiErr)
+		return apiErr
+	}
+	if err := c.verify(resp.Header, respBody); err != nil {
+		return err
+	}
+	if result == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+// authorization 生成请求签名头，签名串为 method\nurl\ntimestamp\nnonce\nbody\n
+func (c *Client) authorization(method string, path string, body []byte) (string, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := NonceStr()
+	message := method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + string(body) + "\n"
+	sig, err := Sign(c.cfg.PrivateKey, message)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`%s mchid="%s",nonce_str="%s",signature="%s",timestamp="%s",serial_no="%s"`,
+		authSchema, c.cfg.MchId, nonce, sig, timestamp, c.cfg.SerialNo), nil
+}
+
+// verify 校验应答或回调的签名，签名串为 timestamp\nnonce\nbody\n
+func (c *Client) verify(header http.Header, body []byte) error {
+	timestamp := header.Get(HeaderTimestamp)
+	if serial := header.Get(HeaderSerial); serial != c.cfg.PlatformSerial {
+		return errors.New("unknown wechat pay serial " + serial)
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid wechat pay timestamp " + timestamp)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return errors.New("wechat pay timestamp expired")
+	}
+	message := timestamp + "\n" + header.Get(HeaderNonce) + "\n" + string(body) + "\n"
+	return Verify(c.cfg.PlatformKey, message, header.Get(HeaderSignature))
+}
@@ -0,0 +1,135 @@
+package wxpay
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+)
+
+// Sign 使用 SHA256-RSA2048 对消息签名，返回 base64 编码的签名
+func Sign(key *rsa.PrivateKey, message string) (string, error) {
+	hashed := sha256.Sum256([]byte(message))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Verify 校验 base64 编码的 SHA256-RSA2048 签名
+func Verify(key *rsa.PublicKey, message string, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256([]byte(message))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig)
+}
+
+// DecryptResource 使用 APIv3 密钥以 AEAD_AES_256_GCM 解密回调通知中的 resource
+func DecryptResource(apiV3Key []byte, r Resource) ([]byte, error) {
+	if r.Algorithm != algorithmAesGcm {
+		return nil, errors.New("unsupported resource algorithm " + r.Algorithm)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(r.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGcm(apiV3Key)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, []byte(r.Nonce), ciphertext, []byte(r.AssociatedData))
+}
+
+// EncryptResource DecryptResource 的逆过程，供本地模拟的支付服务生成回调通知
+func EncryptResource(apiV3Key []byte, plaintext []byte, associatedData string) (Resource, error) {
+	gcm, err := newGcm(apiV3Key)
+	if err != nil {
+		return Resource{}, err
+	}
+	nonce := NonceStr()[:gcm.NonceSize()]
+	ciphertext := gcm.Seal(nil, []byte(nonce), plaintext, []byte(associatedData))
+	return Resource{
+		Algorithm:      algorithmAesGcm,
+		Ciphertext:     base64.StdEncoding.EncodeToString(ciphertext),
+		AssociatedData: associatedData,
+		Nonce:          nonce,
+	}, nil
+}
+
+func newGcm(apiV3Key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(apiV3Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NonceStr 生成 32 位随机字符串
+func NonceStr() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LoadPrivateKey 读取商户 API 私钥（PKCS#8 PEM，即 apiclient_key.pem）
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPem(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not a rsa private key")
+	}
+	return rsaKey, nil
+}
+
+// LoadPublicKey 读取微信支付公钥或平台证书，两种 PEM 格式都支持
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPem(path)
+	if err != nil {
+		return nil, err
+	}
+	var key any
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	} else if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not a rsa public key")
+	}
+	return rsaKey, nil
+}
+
+func readPem(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no pem block found in " + path)
+	}
+	return block, nil
+}
@@ -0,0 +1,243 @@
+// Package fake 提供一个本地运行的微信支付 APIv3 模拟服务，实现下单、查单、关单与支付结果回调，
+// 用于测试与本地联调，不需要真实的商户号
+package fake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"idraw-server/wxpay"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PlatformSerial string = "FAKE-PLATFORM-SERIAL"
+
+type order struct {
+	req           wxpay.JsapiReq
+	prepayId      string
+	state         string
+	transactionId string
+	successTime   string
+}
+
+// Server 模拟的微信支付服务，通过 Url() 作为 wxpay.Config.ApiUrl 使用
+type Server struct {
+	*httptest.Server
+	platformKey *rsa.PrivateKey
+	merchantKey *rsa.PublicKey
+	apiV3Key    []byte
+	mu          sync.Mutex
+	orders      map[string]*order
+}
+
+// NewServer 启动模拟服务，merchantKey 用于校验请求签名，apiV3Key 用于加密回调通知
+func NewServer(merchantKey *rsa.PublicKey, apiV3Key []byte) (*Server, error) {
+	platformKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		platformKey: platformKey,
+		merchantKey: merchantKey,
+		apiV3Key:    apiV3Key,
+		orders:      map[string]*order{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s, nil
+}
+
+// PlatformKey 模拟服务用于签名的公钥，对应 wxpay.Config.PlatformKey
+func (s *Server) PlatformKey() *rsa.PublicKey {
+	return &s.platformKey.PublicKey
+}
+
+// Pay 模拟用户完成支付，并向下单时的 notify_url 发送已签名、已加密的回调通知
+func (s *Server) Pay(outTradeNo string) error {
+	s.mu.Lock()
+	o, ok := s.orders[outTradeNo]
+	if !ok {
+		s.mu.Unlock()
+		return errors.New("order not found " + outTradeNo)
+	}
+	if o.state != wxpay.TradeNotPay {
+		s.mu.Unlock()
+		return errors.New("order is " + o.state)
+	}
+	o.state = wxpay.TradeSuccess
+	o.transactionId = "4200" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	o.successTime = time.Now().Format(time.RFC3339)
+	tx := s.transaction(o)
+	notifyUrl := o.req.NotifyUrl
+	s.mu.Unlock()
+	return s.Notify(notifyUrl, tx)
+}
+
+// Notify 向 notifyUrl 发送一条交易通知，可用于模拟重复通知
+func (s *Server) Notify(notifyUrl string, tx wxpay.Transaction) error {
+	plaintext, _ := json.Marshal(tx)
+	resource, err := wxpay.EncryptResource(s.apiV3Key, plaintext, "transaction")
+	if err != nil {
+		return err
+	}
+	resource.OriginalType = "transaction"
+	body, _ := json.Marshal(wxpay.Notification{
+		Id:           wxpay.NonceStr(),
+		CreateTime:   time.Now().Format(time.RFC3339),
+		EventType:    "TRANSACTION.SUCCESS",
+		ResourceType: "encrypt-resource",
+		Summary:      "支付成功",
+		Resource:     resource,
+	})
+	r, err := http.NewRequest("POST", notifyUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if err := s.sign(r.Header, body); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("notify rejected, status: %s, body: %s", resp.Status, string(b))
+	}
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := s.verifyRequest(r, body); err != nil {
+		s.reply(w, http.StatusUnauthorized, map[string]string{"code": "SIGN_ERROR", "message": err.Error()})
+		return
+	}
+	const prefix = "/v3/pay/transactions/out-trade-no/"
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v3/pay/transactions/jsapi":
+		s.prepay(w, body)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, prefix):
+		s.query(w, strings.TrimPrefix(r.URL.Path, prefix))
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, prefix) && strings.HasSuffix(r.URL.Path, "/close"):
+		s.close(w, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/close"))
+	default:
+		s.reply(w, http.StatusNotFound, map[string]string{"code": "NOT_FOUND", "message": "no such api"})
+	}
+}
+
+func (s *Server) prepay(w http.ResponseWriter, body []byte) {
+	req := wxpay.JsapiReq{}
+	if err := json.Unmarshal(body, &req); err != nil || req.OutTradeNo == "" || req.Amount.Total <= 0 || req.Payer.OpenId == "" {
+		s.reply(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "invalid jsapi request"})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.orders[req.OutTradeNo]; ok {
+		// placing the same order again returns the same prepay id, like the real api does
+		s.reply(w, http.StatusOK, map[string]string{"prepay_id": o.prepayId})
+		return
+	}
+	o := &order{req: req, prepayId: "wx" + wxpay.NonceStr(), state: wxpay.TradeNotPay}
+	s.orders[req.OutTradeNo] = o
+	s.reply(w, http.StatusOK, map[string]string{"prepay_id": o.prepayId})
+}
+
+func (s *Server) query(w http.ResponseWriter, outTradeNo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[outTradeNo]
+	if !ok {
+		s.reply(w, http.StatusNotFound, map[string]string{"code": "ORDER_NOT_EXIST", "message": "订单不存在"})
+		return
+	}
+	s.reply(w, http.StatusOK, s.transaction(o))
+}
+
+func (s *Server) close(w http.ResponseWriter, outTradeNo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[outTradeNo]
+	if !ok {
+		s.reply(w, http.StatusNotFound, map[string]string{"code": "ORDER_NOT_EXIST", "message": "订单不存在"})
+		return
+	}
+	if o.state == wxpay.TradeSuccess {
+		s.reply(w, http.StatusBadRequest, map[string]string{"code": "ORDERPAID", "message": "订单已支付"})
+		return
+	}
+	o.state = wxpay.TradeClosed
+	s.reply(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) transaction(o *order) wxpay.Transaction {
+	tx := wxpay.Transaction{
+		AppId:         o.req.AppId,
+		MchId:         o.req.MchId,
+		OutTradeNo:    o.req.OutTradeNo,
+		TransactionId: o.transactionId,
+		TradeType:     "JSAPI",
+		TradeState:    o.state,
+		SuccessTime:   o.successTime,
+		Payer:         o.req.Payer,
+		Amount:        wxpay.Amount{Total: o.req.Amount.Total, Currency: "CNY"},
+	}
+	if o.state == wxpay.TradeSuccess {
+		tx.Amount.PayerTotal = o.req.Amount.Total
+		tx.Amount.PayerCurrency = "CNY"
+	}
+	return tx
+}
+
+// verifyRequest 校验商户请求的 Authorization 签名
+func (s *Server) verifyRequest(r *http.Request, body []byte) error {
+	auth := r.Header.Get("Authorization")
+	fields := map[string]string{}
+	_, params, _ := strings.Cut(auth, " ")
+	for _, kv := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		fields[k] = strings.Trim(v, `"`)
+	}
+	message := r.Method + "\n" + r.URL.RequestURI() + "\n" + fields["timestamp"] + "\n" + fields["nonce_str"] + "\n" + string(body) + "\n"
+	return wxpay.Verify(s.merchantKey, message, fields["signature"])
+}
+
+func (s *Server) reply(w http.ResponseWriter, status int, payload any) {
+	var body []byte
+	if payload != nil {
+		body, _ = json.Marshal(payload)
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := s.sign(w.Header(), body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// sign 按微信支付的方式为应答或通知签名
+func (s *Server) sign(header http.Header, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := wxpay.NonceStr()
+	sig, err := wxpay.Sign(s.platformKey, timestamp+"\n"+nonce+"\n"+string(body)+"\n")
+	if err != nil {
+		return err
+	}
+	header.Set(wxpay.HeaderTimestamp, timestamp)
+	header.Set(wxpay.HeaderNonce, nonce)
+	header.Set(wxpay.HeaderSignature, sig)
+	header.Set(wxpay.HeaderSerial, PlatformSerial)
+	return nil
+}
@@ -0,0 +1,216 @@
+package fake_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"idraw-server/wxpay"
+	"idraw-server/wxpay/fake"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	appId  = "wx-test-app"
+	mchId  = "1900000001"
+	openId = "test-open-id"
+	total  = 1500
+)
+
+var apiV3Key = []byte("0123456789abcdef0123456789abcdef")
+
+// merchant 模拟商户侧：下单记录订单，收到通知后校验并入账，重复通知只入账一次
+type merchant struct {
+	client    *wxpay.Client
+	notifyUrl string
+	mu        sync.Mutex
+	amounts   map[string]int
+	paid      map[string]string // out_trade_no -> transaction_id
+	credits   int
+}
+
+func (m *merchant) notify(w http.ResponseWriter, r *http.Request) {
+	tx, err := m.client.ParseNotify(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := m.settle(tx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *merchant) settle(tx *wxpay.Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tx.TradeState != wxpay.TradeSuccess {
+		return nil
+	}
+	amount, ok := m.amounts[tx.OutTradeNo]
+	if !ok {
+		return errors.New("order not found " + tx.OutTradeNo)
+	}
+	if tx.MchId != m.client.MchId() || tx.AppId != m.client.AppId() || tx.Amount.Total != amount || tx.Amount.PayerTotal != amount {
+		return errors.New("transaction does not match " + tx.OutTradeNo)
+	}
+	if _, ok := m.paid[tx.OutTradeNo]; ok {
+		return nil
+	}
+	m.paid[tx.OutTradeNo] = tx.TransactionId
+	m.credits += 10
+	return nil
+}
+
+// settled 已入账的次数及订单对应的微信支付订单号
+func (m *merchant) settled(outTradeNo string) (int, string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.credits, m.paid[outTradeNo]
+}
+
+func newMerchant(t *testing.T) (*merchant, *fake.Server) {
+	t.Helper()
+	merchantKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := fake.NewServer(&merchantKey.PublicKey, apiV3Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	m := &merchant{amounts: map[string]int{}, paid: map[string]string{}}
+	notifyServer := httptest.NewServer(http.HandlerFunc(m.notify))
+	t.Cleanup(notifyServer.Close)
+	m.notifyUrl = notifyServer.URL
+	m.client = wxpay.NewClient(wxpay.Config{
+		ApiUrl:         server.URL,
+		AppId:          appId,
+		MchId:          mchId,
+		SerialNo:       "MERCHANT-SERIAL",
+		PrivateKey:     merchantKey,
+		ApiV3Key:       apiV3Key,
+		PlatformSerial: fake.PlatformSerial,
+		PlatformKey:    server.PlatformKey(),
+		NotifyUrl:      notifyServer.URL,
+	})
+	return m, server
+}
+
+func (m *merchant) order(t *testing.T, outTradeNo string) {
+	t.Helper()
+	prepayId, err := m.client.PrepayJsapi(context.Background(), "会员 30 天", outTradeNo, total, openId, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepayId == "" {
+		t.Fatal("empty prepay id")
+	}
+	if _, err := m.client.JsapiPayParams(prepayId); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.amounts[outTradeNo] = total
+	m.mu.Unlock()
+}
+
+func TestOrderNotifySettle(t *testing.T) {
+	m, server := newMerchant(t)
+	ctx := context.Background()
+	const outTradeNo = "ID20260101000000abcdef"
+	m.order(t, outTradeNo)
+
+	tx, err := m.client.QueryOrder(ctx, outTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.TradeState != wxpay.TradeNotPay {
+		t.Fatalf("trade state before paying is %s", tx.TradeState)
+	}
+
+	if err := server.Pay(outTradeNo); err != nil {
+		t.Fatal(err)
+	}
+	credits, transactionId := m.settled(outTradeNo)
+	if credits != 10 || transactionId == "" {
+		t.Fatalf("order is not settled after the notify, credits: %d", credits)
+	}
+
+	// a repeated notify and a query after a lost notify must not credit the order again
+	tx, err = m.client.QueryOrder(ctx, outTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.TradeState != wxpay.TradeSuccess || tx.TransactionId != transactionId {
+		t.Fatalf("unexpected transaction after paying %+v", tx)
+	}
+	if err := server.Notify(m.notifyUrl, *tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.settle(tx); err != nil {
+		t.Fatal(err)
+	}
+	if credits, _ = m.settled(outTradeNo); credits != 10 {
+		t.Fatalf("order is settled twice, credits: %d", credits)
+	}
+
+	// a paid order can not be closed or paid again
+	var apiErr *wxpay.APIError
+	if err := m.client.CloseOrder(ctx, outTradeNo); !errors.As(err, &apiErr) || apiErr.Code != "ORDERPAID" {
+		t.Fatalf("close a paid order, the error is %v", err)
+	}
+	if err := server.Pay(outTradeNo); err == nil {
+		t.Fatal("pay a paid order again")
+	}
+}
+
+func TestCloseOrder(t *testing.T) {
+	m, server := newMerchant(t)
+	ctx := context.Background()
+	const outTradeNo = "ID20260101000000fedcba"
+	m.order(t, outTradeNo)
+
+	if err := m.client.CloseOrder(ctx, outTradeNo); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := m.client.QueryOrder(ctx, outTradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.TradeState != wxpay.TradeClosed {
+		t.Fatalf("trade state after closing is %s", tx.TradeState)
+	}
+	if err := server.Pay(outTradeNo); err == nil {
+		t.Fatal("pay a closed order")
+	}
+	if credits, _ := m.settled(outTradeNo); credits != 0 {
+		t.Fatalf("closed order is settled, credits: %d", credits)
+	}
+}
+
+func TestForgedNotify(t *testing.T) {
+	m, _ := newMerchant(t)
+	const outTradeNo = "ID20260101000000aaaaaa"
+	m.order(t, outTradeNo)
+
+	// signed by another platform key, the merchant must reject it
+	other, err := fake.NewServer(&rsa.PublicKey{}, apiV3Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	tx := wxpay.Transaction{AppId: appId, MchId: mchId, OutTradeNo: outTradeNo, TransactionId: "4200forged",
+		TradeState: wxpay.TradeSuccess, Amount: wxpay.Amount{Total: total, PayerTotal: total}}
+	if err := other.Notify(m.notifyUrl, tx); err == nil {
+		t.Fatal("forged notify is accepted")
+	}
+	if credits, _ := m.settled(outTradeNo); credits != 0 {
+		t.Fatalf("forged notify is settled, credits: %d", credits)
+	}
+}